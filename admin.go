@@ -0,0 +1,377 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Offline database maintenance. The server must be stopped as it holds the database lock.
+
+// adminCmd dispatches a maintenance subcommand
+func adminCmd(name string, subcommands map[string]func(a *admin, args []string) error) func(args []string) error {
+	return func(args []string) error {
+		if len(args) == 0 {
+			return fmt.Errorf("%s: subcommand is required", name)
+		}
+		run, ok := subcommands[args[0]]
+		if !ok {
+			return fmt.Errorf("%s: unknown subcommand %s", name, args[0])
+		}
+		fs := flag.NewFlagSet(name+" "+args[0], flag.ExitOnError)
+		networksFile := networksFlag(fs)
+		databaseFile := databaseFlag(fs)
+		fs.Parse(args[1:])
+		if fs.NArg() == 0 {
+			return errors.New("network name is required")
+		}
+
+		a, err := openAdmin(*networksFile, *databaseFile, fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer a.db.Close()
+		return run(a, fs.Args()[1:])
+	}
+}
+
+var poolCommands = map[string]func(a *admin, args []string) error{
+	"list":       (*admin).poolList,
+	"drop":       (*admin).poolDrop,
+	"resequence": (*admin).poolResequence,
+}
+
+var leaseCommands = map[string]func(a *admin, args []string) error{
+	"list":   (*admin).leaseList,
+	"expire": (*admin).leaseExpire,
+}
+
+// adminIdentity is recorded in the audit log for offline changes
+const adminIdentity = "admin-cli"
+
+type admin struct {
+	db      *bolt.DB
+	store   *keypool.BoltStore
+	network *config.NetworkConfig
+}
+
+func openAdmin(networksFile, databaseFile, network string) (*admin, error) {
+	cfg, err := readConfig(networksFile)
+	if err != nil {
+		return nil, err
+	}
+	net, ok := cfg.Networks[network]
+	if !ok {
+		return nil, fmt.Errorf("unknown network %s", network)
+	}
+	if databaseFile == "" {
+		return nil, errors.New("database file is required")
+	}
+	// don't create a missing file
+	if _, err := os.Stat(databaseFile); err != nil {
+		return nil, err
+	}
+	db, err := bolt.Open(databaseFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", databaseFile, err)
+	}
+	return &admin{
+		db:      db,
+		store:   keypool.NewBoltStore(db),
+		network: net,
+	}, nil
+}
+
+func (a *admin) view(fn func(tx keypool.Tx) error) error {
+	return a.store.View(a.network.GetBucket(), fn)
+}
+
+func (a *admin) update(fn func(tx keypool.Tx) error) error {
+	return a.store.Update(a.network.GetBucket(), fn)
+}
+
+func (a *admin) pkh(index uint64) string {
+	priv, err := a.network.GetSeed().Derive(index)
+	if err != nil {
+		return err.Error()
+	}
+	return priv.Public().Hash().String()
+}
+
+// audit records an offline change in the same transaction
+func (a *admin) audit(tx keypool.Tx, op string, index uint64) error {
+	return tx.AppendAudit(&keypool.AuditRecord{
+		Time:     time.Now(),
+		Op:       op,
+		KeyIndex: index,
+		PKH:      a.pkh(index),
+		Identity: adminIdentity,
+	})
+}
+
+func keyIndexArg(args []string) (uint64, error) {
+	if len(args) != 1 {
+		return 0, errors.New("key index is required")
+	}
+	return strconv.ParseUint(args[0], 10, 64)
+}
+
+func (a *admin) poolList(args []string) error {
+	var (
+		queue []uint64
+		seq   uint64
+	)
+	err := a.view(func(tx keypool.Tx) (err error) {
+		if queue, err = tx.Queue(); err != nil {
+			return err
+		}
+		seq, err = tx.Sequence()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPKH")
+	for _, index := range queue {
+		fmt.Fprintf(w, "%d\t%s\n", index, a.pkh(index))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	fmt.Printf("\n%d buffered, sequence %d\n", len(queue), seq)
+	return nil
+}
+
+// poolDrop removes a buffered key. Its funds stay on the account.
+func (a *admin) poolDrop(args []string) error {
+	index, err := keyIndexArg(args)
+	if err != nil {
+		return err
+	}
+	err = a.update(func(tx keypool.Tx) error {
+		ok, err := tx.Remove(index)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("key %d is not buffered", index)
+		}
+		return a.audit(tx, keypool.AuditDrop, index)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Dropped %d (%s)\n", index, a.pkh(index))
+	return nil
+}
+
+// poolResequence moves the sequence past every key in use, e.g. after the database was restored
+// from an old backup. It never goes backwards as that would hand out used keys again.
+func (a *admin) poolResequence(args []string) error {
+	var old, seq uint64
+	err := a.update(func(tx keypool.Tx) (err error) {
+		if old, err = tx.Sequence(); err != nil {
+			return err
+		}
+		seq = old
+		queue, err := tx.Queue()
+		if err != nil {
+			return err
+		}
+		leases, err := tx.Leases()
+		if err != nil {
+			return err
+		}
+		for _, l := range leases {
+			queue = append(queue, l.KeyIndex)
+		}
+		quarantined, err := tx.QuarantinedKeys()
+		if err != nil {
+			return err
+		}
+		for _, q := range quarantined {
+			queue = append(queue, q.KeyIndex)
+		}
+		for _, index := range queue {
+			seq = max(seq, index)
+		}
+		if seq == old {
+			return nil
+		}
+		return tx.SetSequence(seq)
+	})
+	if err != nil {
+		return err
+	}
+	if seq == old {
+		fmt.Printf("Sequence %d is up to date\n", seq)
+	} else {
+		fmt.Printf("Sequence %d -> %d\n", old, seq)
+	}
+	return nil
+}
+
+func (a *admin) leaseList(args []string) error {
+	var leases []*keypool.Lease
+	err := a.view(func(tx keypool.Tx) (err error) {
+		leases, err = tx.Leases()
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tPKH\tIDENTITY\tDEADLINE\t")
+	for _, l := range leases {
+		var expired string
+		if !l.Deadline.After(now) {
+			expired = "expired"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", l.KeyIndex, a.pkh(l.KeyIndex), l.Identity, l.Deadline.Format(time.RFC3339), expired)
+	}
+	return w.Flush()
+}
+
+// leaseExpire moves the deadline to now. The key is recycled when the server starts.
+func (a *admin) leaseExpire(args []string) error {
+	index, err := keyIndexArg(args)
+	if err != nil {
+		return err
+	}
+	err = a.update(func(tx keypool.Tx) error {
+		l, err := tx.GetLease(index)
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			return fmt.Errorf("key %d: %w", index, keypool.ErrNotLeased)
+		}
+		l.Deadline = time.Now()
+		if err := tx.PutLease(l); err != nil {
+			return err
+		}
+		return a.audit(tx, keypool.AuditExpire, index)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Expired %d (%s)\n", index, a.pkh(index))
+	return nil
+}
+
+// exportDocument carries the pools between databases. The HTTP export endpoint returns a single network's entry.
+type exportDocument struct {
+	Version  int                          `json:"version"`
+	Networks map[string]*keypool.Snapshot `json:"networks"`
+}
+
+const exportVersion = 1
+
+func exportCmd(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	databaseFile := databaseFlag(fs)
+	out := fs.String("o", "", "Output file. Stdout is used if not set")
+	fs.Parse(args)
+
+	if *databaseFile == "" {
+		return errors.New("database file is required")
+	}
+	if _, err := os.Stat(*databaseFile); err != nil {
+		return err
+	}
+	db, err := bolt.Open(*databaseFile, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("%s: %w", *databaseFile, err)
+	}
+	defer db.Close()
+
+	store := keypool.NewBoltStore(db)
+	pools, err := store.Pools()
+	if err != nil {
+		return err
+	}
+	doc := exportDocument{
+		Version:  exportVersion,
+		Networks: make(map[string]*keypool.Snapshot, len(pools)),
+	}
+	for _, pool := range pools {
+		if doc.Networks[pool], err = keypool.Export(store, pool); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(&doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if *out != "" {
+		return os.WriteFile(*out, data, 0600)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func importCmd(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	databaseFile := databaseFlag(fs)
+	in := fs.String("i", "", "Exported file. Stdin is used if not set")
+	fs.Parse(args)
+
+	if *databaseFile == "" {
+		return errors.New("database file is required")
+	}
+	var (
+		data []byte
+		err  error
+	)
+	if *in != "" {
+		data, err = os.ReadFile(*in)
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	var doc exportDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Version != exportVersion {
+		return fmt.Errorf("unsupported export version %d", doc.Version)
+	}
+
+	db, err := bolt.Open(*databaseFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("%s: %w", *databaseFile, err)
+	}
+	defer db.Close()
+
+	store := keypool.NewBoltStore(db)
+	names := sortedNames(doc.Networks)
+	// pools are written one by one, so nothing is written unless all of them can be
+	for _, name := range names {
+		if err := keypool.CheckImport(store, name, doc.Networks[name]); err != nil {
+			return err
+		}
+	}
+	for _, name := range names {
+		s := doc.Networks[name]
+		if err := keypool.Import(store, name, s); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d buffered, %d leased, sequence %d\n", name, len(s.Queue), len(s.Leases), s.Sequence)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+const testNetworks = `
+testnet:
+  url: http://127.0.0.1:8732
+  seed: f7353829d316c20922f8ff2ed696090801d9c775977df6423cd68a737c628b844b13c951de7cb7cd01cd62430edeefbc219885b388f06cb5d1e496f63bc9c0d5
+  private-key: edsk2mgqWz5tUQQPK2LCg4Ae2G9bdd8RGzJP9oR3S7cKgASndbnRjE
+  amount: 2000000
+`
+
+// newTestAdmin opens a fresh database with the pool holding keys 1 to 3 and a lease of 4
+func newTestAdmin(t *testing.T) *admin {
+	cfg, err := config.New(strings.NewReader(testNetworks))
+	require.NoError(t, err)
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+
+	a := &admin{
+		db:      db,
+		store:   keypool.NewBoltStore(db),
+		network: cfg.Networks["testnet"],
+	}
+	require.NoError(t, a.store.Init(a.network.GetBucket()))
+	err = a.update(func(tx keypool.Tx) error {
+		for i := uint64(1); i <= 3; i++ {
+			if err := tx.Push(i); err != nil {
+				return err
+			}
+		}
+		if err := tx.PutLease(&keypool.Lease{KeyIndex: 4, Deadline: time.Now().Add(time.Hour)}); err != nil {
+			return err
+		}
+		return tx.SetSequence(4)
+	})
+	require.NoError(t, err)
+	return a
+}
+
+func TestAdminAudit(t *testing.T) {
+	a := newTestAdmin(t)
+	require.NoError(t, a.poolDrop([]string{"2"}))
+	require.Error(t, a.poolDrop([]string{"2"}))
+	require.NoError(t, a.leaseExpire([]string{"4"}))
+	require.ErrorIs(t, a.leaseExpire([]string{"3"}), keypool.ErrNotLeased)
+
+	var (
+		queue []uint64
+		lease *keypool.Lease
+		log   []*keypool.AuditRecord
+	)
+	err := a.view(func(tx keypool.Tx) (err error) {
+		if queue, err = tx.Queue(); err != nil {
+			return err
+		}
+		if lease, err = tx.GetLease(4); err != nil {
+			return err
+		}
+		log, err = tx.AuditLog(&keypool.AuditQuery{})
+		return err
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 3}, queue)
+	require.NotNil(t, lease)
+	assert.False(t, lease.Deadline.After(time.Now()))
+
+	// failed commands leave no trace
+	require.Len(t, log, 2)
+	for i, expect := range []struct {
+		op    string
+		index uint64
+	}{{keypool.AuditDrop, 2}, {keypool.AuditExpire, 4}} {
+		assert.Equal(t, expect.op, log[i].Op)
+		assert.Equal(t, expect.index, log[i].KeyIndex)
+		assert.Equal(t, a.pkh(expect.index), log[i].PKH)
+		assert.Equal(t, adminIdentity, log[i].Identity)
+	}
+}
+
+func TestPoolResequence(t *testing.T) {
+	a := newTestAdmin(t)
+	err := a.update(func(tx keypool.Tx) error {
+		if err := tx.PutQuarantined(&keypool.Quarantined{KeyIndex: 7, Time: time.Now(), Failures: 5}); err != nil {
+			return err
+		}
+		// lost by an import, say
+		return tx.SetSequence(1)
+	})
+	require.NoError(t, err)
+	require.NoError(t, a.poolResequence(nil))
+
+	var seq uint64
+	require.NoError(t, a.view(func(tx keypool.Tx) (err error) {
+		seq, err = tx.Sequence()
+		return err
+	}))
+	assert.Equal(t, uint64(7), seq)
+}
@@ -0,0 +1,284 @@
+package balancer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// BaseURL is the RPC URL to give to the client. Requests are routed to the actual endpoints by the balancer.
+const BaseURL = "http://tezos-rpc"
+
+const probeTimeout = 10 * time.Second
+
+// Endpoint is a Tezos node RPC URL. Endpoints with lower priority values are preferred.
+type Endpoint struct {
+	URL      string
+	Priority int
+}
+
+// Status describes the endpoint health
+type Status struct {
+	Endpoint
+	Healthy bool
+	// Level is the head level as of the last probe
+	Level int64
+	// Lag is the number of levels behind the most advanced endpoint
+	Lag int64
+	// Errors is the number of consecutive failures
+	Errors    int
+	LastError string
+}
+
+type endpoint struct {
+	Endpoint
+	base    *url.URL
+	errors  int
+	lastErr error
+	level   int64
+}
+
+// Balancer is a http.RoundTripper which sends requests to the healthiest endpoint and fails over to the next one
+type Balancer struct {
+	// Transport is used to reach the nodes, http.DefaultTransport if nil
+	Transport http.RoundTripper
+
+	mtx       sync.Mutex
+	endpoints []*endpoint
+	maxLag    int64
+}
+
+func New(endpoints []Endpoint, maxLag int64) (*Balancer, error) {
+	b := &Balancer{}
+	if err := b.Set(endpoints, maxLag); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Set replaces the endpoint list. The health of endpoints which stay in the list is preserved.
+func (b *Balancer) Set(endpoints []Endpoint, maxLag int64) error {
+	if len(endpoints) == 0 {
+		return errors.New("no endpoints")
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	old := make(map[string]*endpoint, len(b.endpoints))
+	for _, e := range b.endpoints {
+		old[e.URL] = e
+	}
+	list := make([]*endpoint, len(endpoints))
+	for i, e := range endpoints {
+		u, err := url.Parse(e.URL)
+		if err != nil {
+			return err
+		}
+		ep := &endpoint{Endpoint: e, base: u}
+		if o, ok := old[e.URL]; ok {
+			ep.errors, ep.lastErr, ep.level = o.errors, o.lastErr, o.level
+		}
+		list[i] = ep
+	}
+	b.endpoints = list
+	b.maxLag = maxLag
+	return nil
+}
+
+func (b *Balancer) maxLevel() int64 {
+	var max int64
+	for _, e := range b.endpoints {
+		if e.level > max {
+			max = e.level
+		}
+	}
+	return max
+}
+
+func (b *Balancer) healthy(e *endpoint, maxLevel int64) bool {
+	return e.errors == 0 && maxLevel-e.level <= b.maxLag
+}
+
+// order returns the endpoints starting from the healthiest one
+func (b *Balancer) order() []*endpoint {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	maxLevel := b.maxLevel()
+	out := make([]*endpoint, len(b.endpoints))
+	copy(out, b.endpoints)
+	sort.SliceStable(out, func(i, j int) bool {
+		hi, hj := b.healthy(out[i], maxLevel), b.healthy(out[j], maxLevel)
+		if hi != hj {
+			return hi
+		}
+		if out[i].Priority != out[j].Priority {
+			return out[i].Priority < out[j].Priority
+		}
+		return out[i].errors < out[j].errors
+	})
+	return out
+}
+
+func (b *Balancer) report(e *endpoint, err error) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if err != nil {
+		if e.errors == 0 {
+			log.WithField("endpoint", e.URL).Warnf("Endpoint failed: %v", err)
+		}
+		e.errors++
+		e.lastErr = err
+	} else {
+		e.errors = 0
+	}
+}
+
+func (b *Balancer) transport() http.RoundTripper {
+	if b.Transport != nil {
+		return b.Transport
+	}
+	return http.DefaultTransport
+}
+
+func (e *endpoint) resolve(u *url.URL) *url.URL {
+	out := *e.base
+	out.Path = strings.TrimSuffix(e.base.Path, "/") + u.Path
+	out.RawPath = ""
+	out.RawQuery = u.RawQuery
+	return &out
+}
+
+// endpointFailure reports whether the status means the node itself is unavailable.
+// Tezos RPC returns 500 for protocol errors too, so it's not counted.
+func endpointFailure(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// RoundTrip implements http.RoundTripper. A request is retried on the next endpoint if its body can be
+// replayed. All POST requests used by the client are either pure computations or operation injections;
+// injecting the same signed operation twice is harmless as it can be included only once, so a failed
+// injection is retried without re-signing.
+func (b *Balancer) RoundTrip(req *http.Request) (*http.Response, error) {
+	order := b.order()
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+	for i, e := range order {
+		r := req.Clone(req.Context())
+		r.URL = e.resolve(req.URL)
+		r.Host = ""
+		if i != 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = body
+		}
+		res, err := b.transport().RoundTrip(r)
+		if err == nil && endpointFailure(res.StatusCode) {
+			b.report(e, fmt.Errorf("%s", res.Status))
+		} else {
+			b.report(e, err)
+			if err == nil {
+				return res, nil
+			}
+		}
+		last := i == len(order)-1
+		if last || !replayable || req.Context().Err() != nil {
+			return res, err
+		}
+		if res != nil {
+			res.Body.Close()
+		}
+		log.WithField("endpoint", e.URL).Debug("Failing over")
+	}
+	panic("unreachable")
+}
+
+func (b *Balancer) probe(ctx context.Context, e *endpoint) {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+	u := e.resolve(&url.URL{Path: "/chains/main/blocks/head/header"})
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		b.report(e, err)
+		return
+	}
+	res, err := b.transport().RoundTrip(req)
+	if err != nil {
+		b.report(e, err)
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		b.report(e, fmt.Errorf("%s", res.Status))
+		return
+	}
+	var header struct {
+		Level int64 `json:"level"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&header); err != nil {
+		b.report(e, err)
+		return
+	}
+	b.mtx.Lock()
+	e.level = header.Level
+	b.mtx.Unlock()
+	b.report(e, nil)
+}
+
+// Probe fetches the head level from all endpoints
+func (b *Balancer) Probe(ctx context.Context) {
+	b.mtx.Lock()
+	list := b.endpoints
+	b.mtx.Unlock()
+	var wg sync.WaitGroup
+	for _, e := range list {
+		wg.Add(1)
+		go func(e *endpoint) {
+			defer wg.Done()
+			b.probe(ctx, e)
+		}(e)
+	}
+	wg.Wait()
+}
+
+// Run probes the endpoints periodically until ctx is cancelled
+func (b *Balancer) Run(ctx context.Context, interval time.Duration) {
+	for {
+		b.Probe(ctx)
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Status returns the endpoints in the configured order
+func (b *Balancer) Status() []*Status {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	maxLevel := b.maxLevel()
+	out := make([]*Status, len(b.endpoints))
+	for i, e := range b.endpoints {
+		s := Status{
+			Endpoint: e.Endpoint,
+			Healthy:  b.healthy(e, maxLevel),
+			Level:    e.level,
+			Lag:      maxLevel - e.level,
+			Errors:   e.errors,
+		}
+		if e.lastErr != nil {
+			s.LastError = e.lastErr.Error()
+		}
+		out[i] = &s
+	}
+	return out
+}
@@ -0,0 +1,99 @@
+package balancer_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/balancer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type node struct {
+	*httptest.Server
+	name  string
+	level atomic.Int64
+	down  atomic.Bool
+}
+
+func newNode(t *testing.T, name string, level int64) *node {
+	n := &node{name: name}
+	n.level.Store(level)
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if n.down.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if r.URL.Path == "/chains/main/blocks/head/header" {
+			fmt.Fprintf(w, `{"level":%d}`, n.level.Load())
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s %s", n.name, r.URL.Path, body)
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func get(t *testing.T, c *http.Client, method, body string) string {
+	req, err := http.NewRequest(method, balancer.BaseURL+"/chains/main/chain_id", strings.NewReader(body))
+	require.NoError(t, err)
+	res, err := c.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	out, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	return string(out)
+}
+
+func TestBalancer(t *testing.T) {
+	a := newNode(t, "a", 100)
+	b := newNode(t, "b", 100)
+	bal, err := balancer.New([]balancer.Endpoint{
+		{URL: b.URL, Priority: 1},
+		{URL: a.URL, Priority: 0},
+	}, 2)
+	require.NoError(t, err)
+	c := &http.Client{Transport: bal}
+
+	// priority
+	assert.Equal(t, "a /chains/main/chain_id ", get(t, c, http.MethodGet, ""))
+
+	// fail over replaying the body
+	a.down.Store(true)
+	assert.Equal(t, "b /chains/main/chain_id op", get(t, c, http.MethodPost, "op"))
+	st := bal.Status()
+	assert.True(t, st[0].Healthy)
+	assert.False(t, st[1].Healthy)
+	assert.Equal(t, 1, st[1].Errors)
+	// the failed endpoint isn't tried first anymore
+	assert.Equal(t, "b /chains/main/chain_id ", get(t, c, http.MethodGet, ""))
+
+	// recovered but lagging
+	a.down.Store(false)
+	b.level.Store(110)
+	bal.Probe(context.Background())
+	st = bal.Status()
+	assert.Equal(t, int64(10), st[1].Lag)
+	assert.False(t, st[1].Healthy)
+	assert.Equal(t, "b /chains/main/chain_id ", get(t, c, http.MethodGet, ""))
+
+	// caught up
+	a.level.Store(110)
+	bal.Probe(context.Background())
+	assert.Equal(t, "a /chains/main/chain_id ", get(t, c, http.MethodGet, ""))
+
+	// health is preserved for the endpoints staying in the list
+	a.down.Store(true)
+	get(t, c, http.MethodGet, "")
+	require.NoError(t, bal.Set([]balancer.Endpoint{{URL: a.URL}}, 2))
+	st = bal.Status()
+	require.Len(t, st, 1)
+	assert.False(t, st[0].Healthy)
+}
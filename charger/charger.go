@@ -2,12 +2,17 @@ package charger
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/big"
+	"sync"
+	"sync/atomic"
 
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
 	"github.com/ecadlabs/go-tezos-keygen/utils"
 	tz "github.com/ecadlabs/gotez/v2"
 	"github.com/ecadlabs/gotez/v2/client"
-	"github.com/ecadlabs/gotez/v2/crypt"
 	"github.com/ecadlabs/gotez/v2/protocol/core"
 	"github.com/ecadlabs/gotez/v2/protocol/latest"
 	"github.com/ecadlabs/gotez/v2/teztool"
@@ -17,83 +22,295 @@ import (
 type Config interface {
 	GetChainID() *tz.ChainID
 	GetSeed() Seed
-	GetPrivateKey() crypt.PrivateKey
+	// GetFunder returns the signer of funding operations
+	GetFunder() teztool.Signer
+	GetFunderPKH() tz.PublicKeyHash
 	GetMinBalance() *big.Int
 	GetAmount() *big.Int
 	GetOpsPerGroup() int
 }
 
+var ErrChainMismatch = errors.New("node is on a different chain")
+
 type Charger struct {
+	mtx       sync.Mutex // serializes state updates
+	state     atomic.Pointer[chargerState]
+	healthErr atomic.Pointer[error]
+	events    *events.Bus
+	// injector replaces the teztool based one if set
+	injector Injector
+}
+
+type chargerState struct {
 	client *client.Client
 	cfg    Config
+	// configured or discovered chain ID, nil until known
+	chainID  *tz.ChainID
+	injector Injector
+}
+
+func (c *chargerState) chain() string {
+	if c.chainID != nil {
+		return c.chainID.String()
+	}
+	return "main"
+}
+
+// New creates a charger publishing funding events to bus, which may be nil
+func New(cfg Config, client *client.Client, bus *events.Bus) *Charger {
+	c := &Charger{events: bus}
+	c.Set(cfg, client)
+	return c
 }
 
-func New(cfg Config, client *client.Client) *Charger {
-	return &Charger{
-		client: client,
-		cfg:    cfg,
+// Set applies new settings to the running charger. Operations in progress complete with the old ones.
+// A previously discovered chain ID is kept unless one is configured explicitly.
+func (c *Charger) Set(cfg Config, client *client.Client) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	chainID := cfg.GetChainID()
+	if chainID == nil {
+		if old := c.state.Load(); old != nil {
+			chainID = old.chainID
+		}
 	}
+	c.state.Store(&chargerState{client: client, cfg: cfg, chainID: chainID, injector: c.injector})
+}
+
+// ChainID returns the configured or discovered chain ID or nil if it's not known yet
+func (c *Charger) ChainID() *tz.ChainID {
+	return c.state.Load().chainID
+}
+
+// Health returns the reason the network is unhealthy or nil
+func (c *Charger) Health() error {
+	if err := c.healthErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+func (c *Charger) setHealth(err error) {
+	if err == nil {
+		c.healthErr.Store(nil)
+	} else {
+		c.healthErr.Store(&err)
+	}
+}
+
+// ChainInfo identifies the chain the node is on
+type ChainInfo struct {
+	ChainID *tz.ChainID
+	Genesis *tz.BlockHash
 }
 
-func (c *Charger) ChargeKeys(ctx context.Context, keys []uint64) error {
-	amount, err := tz.NewBigUint(c.cfg.GetAmount())
+// CheckChain fetches the chain ID and genesis block hash from the node. If the chain ID is configured
+// explicitly and doesn't match, the network is marked unhealthy and ErrChainMismatch is returned.
+// Otherwise the node's chain ID is adopted, so a testnet reset is followed. Node errors are returned
+// as is and don't affect the health.
+func (c *Charger) CheckChain(ctx context.Context) (*ChainInfo, error) {
+	st := c.state.Load()
+	chainID, err := st.client.ChainID(ctx, "main")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	genesis, err := st.client.BlockHash(ctx, &client.SimpleRequest{Chain: "main", Block: "genesis"})
+	if err != nil {
+		return nil, err
 	}
 
-	tezTool := teztool.New(c.client, c.cfg.GetChainID())
+	if expect := st.cfg.GetChainID(); expect != nil {
+		if *chainID != *expect {
+			err := fmt.Errorf("%w: expected %v, got %v", ErrChainMismatch, expect, chainID)
+			c.setHealth(err)
+			return nil, err
+		}
+	} else {
+		c.mtx.Lock()
+		st = c.state.Load()
+		if st.chainID == nil || *st.chainID != *chainID {
+			log.WithField("chain_id", chainID).Info("Chain ID discovered")
+			c.state.Store(&chargerState{client: st.client, cfg: st.cfg, chainID: chainID, injector: c.injector})
+		}
+		c.mtx.Unlock()
+	}
+	c.setHealth(nil)
+	return &ChainInfo{ChainID: chainID, Genesis: genesis}, nil
+}
+
+// ChargeKeys funds the keys in groups of GetOpsPerGroup and returns the groups that were injected.
+// BatchInjected and BatchFailed are published here, the rest is up to the pool once it has committed
+// the keys.
+func (c *Charger) ChargeKeys(ctx context.Context, keys []uint64) ([]*keypool.Batch, error) {
+	st := c.state.Load()
+	amounts := make([]*big.Int, len(keys))
+	for i := range amounts {
+		amounts[i] = st.cfg.GetAmount()
+	}
+	return st.transfer(ctx, keys, amounts, false, c.events)
+}
+
+// TopUpKeys sends amounts[i] to keys[i] in groups like ChargeKeys
+func (c *Charger) TopUpKeys(ctx context.Context, keys []uint64, amounts []*big.Int) ([]*keypool.Batch, error) {
+	return c.state.Load().transfer(ctx, keys, amounts, true, c.events)
+}
+
+// Injector sends operation groups to the node
+type Injector interface {
+	// Inject fills, signs and injects the group without waiting for it to be included
+	Inject(ctx context.Context, signer teztool.Signer, ops []latest.OperationContents) (*tz.OperationHash, error)
+	// Wait returns once the injected operation is included, or an error if it isn't
+	Wait(ctx context.Context, hash *tz.OperationHash) error
+}
+
+// SetInjector replaces the teztool based injection, nil restores it
+func (c *Charger) SetInjector(inj Injector) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.injector = inj
+	st := *c.state.Load()
+	st.injector = inj
+	c.state.Store(&st)
+}
+
+type tezToolInjector struct {
+	*teztool.TezTool
+}
+
+func (t tezToolInjector) Inject(ctx context.Context, signer teztool.Signer, ops []latest.OperationContents) (*tz.OperationHash, error) {
+	return t.FillSignAndInject(ctx, signer, ops, teztool.FillAll)
+}
+
+func (t tezToolInjector) Wait(ctx context.Context, hash *tz.OperationHash) error {
+	_, err := t.WaitOperation(ctx, hash, client.MetadataNever)
+	return err
+}
+
+func (c *chargerState) getInjector() Injector {
+	if c.injector != nil {
+		return c.injector
+	}
+	tezTool := teztool.New(c.client, c.chainID)
 	tezTool.DebugLogger = (*utils.DebugLogger)(log.StandardLogger())
-	signer := teztool.NewLocalSigner(c.cfg.GetPrivateKey())
+	return tezToolInjector{tezTool}
+}
 
+// injectWait injects the group and waits for it to be included. injected is called in between.
+func (c *chargerState) injectWait(ctx context.Context, signer teztool.Signer, ops []latest.OperationContents, injected func(hash string)) (string, error) {
+	inj := c.getInjector()
+	opHash, err := inj.Inject(ctx, signer, ops)
+	if err != nil {
+		return "", err
+	}
+	hash := opHash.String()
+	log.WithField("hash", hash).Info("Injected")
+	if injected != nil {
+		injected(hash)
+	}
+	if err := inj.Wait(ctx, opHash); err != nil {
+		return hash, err
+	}
+	log.WithField("hash", hash).Info("Included")
+	return hash, nil
+}
+
+func (c *chargerState) transfer(ctx context.Context, keys []uint64, amounts []*big.Int, topUp bool, bus *events.Bus) ([]*keypool.Batch, error) {
+	if c.chainID == nil {
+		return nil, errors.New("chain ID is unknown")
+	}
+	signer := c.cfg.GetFunder()
+	msg := "Funding"
+	if topUp {
+		msg = "Topping up"
+	}
+
+	var injected []*keypool.Batch
 	for len(keys) != 0 {
-		var ops []latest.OperationContents
+		var (
+			ops   []latest.OperationContents
+			batch []uint64
+		)
 		for len(ops) < c.cfg.GetOpsPerGroup() && len(keys) != 0 {
 			keyIndex := keys[0]
 			keys = keys[1:]
+			amount, err := tz.NewBigUint(amounts[0])
+			amounts = amounts[1:]
+			if err != nil {
+				return injected, err
+			}
 
 			priv, err := c.cfg.GetSeed().Derive(keyIndex)
 			if err != nil {
 				log.Error(err)
-				return err
+				return injected, err
 			}
 			dest := priv.Public().Hash()
-			log.WithFields(log.Fields{"pkh": dest, "amount_mutez": amount}).Info("Funding")
+			log.WithFields(log.Fields{"pkh": dest, "amount_mutez": amount}).Info(msg)
 			tx := latest.Transaction{
 				ManagerOperation: latest.ManagerOperation{
-					Source: c.cfg.GetPrivateKey().Public().Hash(),
+					Source: c.cfg.GetFunderPKH(),
 				},
 				Amount:      amount,
 				Destination: core.ImplicitContract{PublicKeyHash: dest},
 			}
 			ops = append(ops, &tx)
+			batch = append(batch, keyIndex)
 		}
-		grp, err := tezTool.FillSignAndInjectWait(ctx, signer, ops, client.MetadataNever, teztool.FillAll)
+		hash, err := c.injectWait(ctx, signer, ops, func(hash string) {
+			bus.Publish(&events.Event{Type: events.BatchInjected, Keys: batch, OpHash: hash})
+		})
 		if err != nil {
 			log.Error(err)
-			return err
+			bus.Publish(&events.Event{Type: events.BatchFailed, Keys: batch, OpHash: hash, Error: err.Error()})
+			if hash != "" {
+				injected = append(injected, &keypool.Batch{Keys: batch, OpHash: hash})
+			}
+			return injected, err
 		}
-		log.WithField("hash", grp.GetHash()).Info("Injected")
+		injected = append(injected, &keypool.Batch{Keys: batch, OpHash: hash, Included: true})
 	}
-	return nil
+	return injected, nil
 }
 
 func (c *Charger) IsDrained(ctx context.Context, key uint64) (bool, error) {
+	st := c.state.Load()
+	balance, err := st.keyBalance(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	return balance.Cmp(st.cfg.GetMinBalance()) < 0, nil
+}
+
+// Shortfall returns how much the key lacks to the funding amount, zero if nothing
+func (c *Charger) Shortfall(ctx context.Context, key uint64) (*big.Int, error) {
+	st := c.state.Load()
+	balance, err := st.keyBalance(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	short := new(big.Int).Sub(st.cfg.GetAmount(), balance)
+	if short.Sign() < 0 {
+		short.SetInt64(0)
+	}
+	return short, nil
+}
+
+func (c *chargerState) keyBalance(ctx context.Context, key uint64) (*big.Int, error) {
 	priv, err := c.cfg.GetSeed().Derive(key)
 	if err != nil {
 		log.Error(err)
-		return false, err
+		return nil, err
 	}
-	address := priv.Public().Hash()
-	balance, err := c.getBalance(ctx, address)
+	balance, err := c.getBalance(ctx, priv.Public().Hash())
 	if err != nil {
 		log.Error(err)
-		return false, err
+		return nil, err
 	}
-	return balance.Cmp(c.cfg.GetMinBalance()) < 0, nil
+	return balance, nil
 }
 
 func (c *Charger) Hash(key uint64) string {
-	priv, err := c.cfg.GetSeed().Derive(key)
+	priv, err := c.state.Load().cfg.GetSeed().Derive(key)
 	if err != nil {
 		log.Error(err)
 		return ""
@@ -102,13 +319,14 @@ func (c *Charger) Hash(key uint64) string {
 }
 
 func (c *Charger) GetFunds(ctx context.Context) (*big.Int, error) {
-	address := c.cfg.GetPrivateKey().Public().Hash()
-	return c.getBalance(ctx, address)
+	st := c.state.Load()
+	address := st.cfg.GetFunderPKH()
+	return st.getBalance(ctx, address)
 }
 
-func (c *Charger) getBalance(ctx context.Context, address tz.PublicKeyHash) (*big.Int, error) {
+func (c *chargerState) getBalance(ctx context.Context, address tz.PublicKeyHash) (*big.Int, error) {
 	value, err := c.client.ContractBalance(ctx, &client.ContractRequest{
-		Chain: c.cfg.GetChainID().String(),
+		Chain: c.chain(),
 		Block: "head",
 		ID:    core.ImplicitContract{PublicKeyHash: address},
 	})
@@ -0,0 +1,255 @@
+package charger_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/client"
+	"github.com/ecadlabs/gotez/v2/protocol/latest"
+	"github.com/ecadlabs/gotez/v2/teztool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// nodeError makes nodeMock respond with 500
+type nodeError struct{}
+
+// nodeMock responds to the paths it knows with JSON and to everything else with 404
+type nodeMock struct {
+	*httptest.Server
+	mtx    sync.Mutex
+	routes map[string]any
+}
+
+func newNodeMock(t *testing.T) *nodeMock {
+	n := &nodeMock{routes: make(map[string]any)}
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n.mtx.Lock()
+		v, ok := n.routes[r.URL.Path]
+		n.mtx.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if _, ok := v.(nodeError); ok {
+			http.Error(w, "node error", http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+func (n *nodeMock) set(path string, v any) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	n.routes[path] = v
+}
+
+func (n *nodeMock) setChain(chainID *tz.ChainID, genesis *tz.BlockHash) {
+	n.set("/chains/main/chain_id", chainID.String())
+	n.set("/chains/main/blocks/genesis/hash", genesis.String())
+}
+
+func (n *nodeMock) client() *client.Client {
+	return &client.Client{URL: n.URL, Client: n.Server.Client()}
+}
+
+type chargerConfig struct {
+	chainID     *tz.ChainID
+	opsPerGroup int
+}
+
+func (c *chargerConfig) GetChainID() *tz.ChainID        { return c.chainID }
+func (c *chargerConfig) GetSeed() charger.Seed          { return testSeed }
+func (c *chargerConfig) GetFunder() teztool.Signer      { return nil }
+func (c *chargerConfig) GetFunderPKH() tz.PublicKeyHash { return nil }
+func (c *chargerConfig) GetMinBalance() *big.Int        { return big.NewInt(0) }
+func (c *chargerConfig) GetAmount() *big.Int            { return big.NewInt(1000) }
+func (c *chargerConfig) GetOpsPerGroup() int {
+	if c.opsPerGroup == 0 {
+		return 10
+	}
+	return c.opsPerGroup
+}
+
+var (
+	testChainID  = &tz.ChainID{1, 2, 3, 4}
+	otherChainID = &tz.ChainID{5, 6, 7, 8}
+	testGenesis  = &tz.BlockHash{1}
+	otherGenesis = &tz.BlockHash{2}
+)
+
+func TestCheckChain(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("discovered", func(t *testing.T) {
+		node := newNodeMock(t)
+		node.setChain(testChainID, testGenesis)
+		c := charger.New(&chargerConfig{}, node.client(), nil)
+		require.Nil(t, c.ChainID())
+
+		info, err := c.CheckChain(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, testChainID, info.ChainID)
+		assert.Equal(t, testGenesis, info.Genesis)
+		assert.Equal(t, testChainID, c.ChainID())
+
+		// a reset is followed
+		node.setChain(otherChainID, otherGenesis)
+		info, err = c.CheckChain(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, otherGenesis, info.Genesis)
+		assert.Equal(t, otherChainID, c.ChainID())
+		assert.NoError(t, c.Health())
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		node := newNodeMock(t)
+		node.setChain(otherChainID, testGenesis)
+		c := charger.New(&chargerConfig{chainID: testChainID}, node.client(), nil)
+
+		_, err := c.CheckChain(ctx)
+		require.ErrorIs(t, err, charger.ErrChainMismatch)
+		assert.ErrorIs(t, c.Health(), charger.ErrChainMismatch)
+		assert.Equal(t, testChainID, c.ChainID())
+
+		// node errors don't change the health
+		node.set("/chains/main/chain_id", "invalid")
+		_, err = c.CheckChain(ctx)
+		require.Error(t, err)
+		assert.ErrorIs(t, c.Health(), charger.ErrChainMismatch)
+
+		node.setChain(testChainID, testGenesis)
+		_, err = c.CheckChain(ctx)
+		require.NoError(t, err)
+		assert.NoError(t, c.Health())
+	})
+}
+
+// injectorMock calls inject instead of injecting and wait instead of waiting for inclusion
+type injectorMock struct {
+	inject func(ops []latest.OperationContents) (*tz.OperationHash, error)
+	wait   func(hash *tz.OperationHash) error
+}
+
+func (m *injectorMock) Inject(ctx context.Context, signer teztool.Signer, ops []latest.OperationContents) (*tz.OperationHash, error) {
+	return m.inject(ops)
+}
+
+func (m *injectorMock) Wait(ctx context.Context, hash *tz.OperationHash) error {
+	if m.wait == nil {
+		return nil
+	}
+	return m.wait(hash)
+}
+
+func drain(ch <-chan *events.Event) []*events.Event {
+	var out []*events.Event
+	for {
+		select {
+		case e := <-ch:
+			out = append(out, e)
+		default:
+			return out
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	opHash := &tz.OperationHash{7}
+	hash := opHash.String()
+
+	tests := []struct {
+		name   string
+		inject error
+		wait   error
+		err    string
+		// groups of one key
+		injected []*keypool.Batch
+		expect   []*events.Event
+	}{
+		{
+			name:     "included",
+			injected: []*keypool.Batch{{Keys: []uint64{1}, OpHash: hash, Included: true}, {Keys: []uint64{2}, OpHash: hash, Included: true}},
+			expect: []*events.Event{
+				{Type: events.BatchInjected, Keys: []uint64{1}, OpHash: hash},
+				{Type: events.BatchInjected, Keys: []uint64{2}, OpHash: hash},
+			},
+		},
+		{
+			name:   "not injected",
+			inject: errors.New("refused"),
+			err:    "refused",
+			expect: []*events.Event{
+				{Type: events.BatchFailed, Keys: []uint64{1}, Error: "refused"},
+			},
+		},
+		{
+			name:     "not included",
+			wait:     errors.New("isn't included"),
+			err:      "isn't included",
+			injected: []*keypool.Batch{{Keys: []uint64{1}, OpHash: hash}},
+			expect: []*events.Event{
+				{Type: events.BatchInjected, Keys: []uint64{1}, OpHash: hash},
+				{Type: events.BatchFailed, Keys: []uint64{1}, OpHash: hash},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newNodeMock(t)
+			bus := events.NewBus()
+			ch, unsubscribe := bus.Subscribe(events.DefaultBuffer)
+			defer unsubscribe()
+			c := charger.New(&chargerConfig{chainID: testChainID, opsPerGroup: 1}, node.client(), bus)
+
+			c.SetInjector(&injectorMock{
+				inject: func(ops []latest.OperationContents) (*tz.OperationHash, error) {
+					assert.Len(t, ops, 1)
+					if tt.inject != nil {
+						// nothing is published before the injection
+						assert.Empty(t, drain(ch))
+						return nil, tt.inject
+					}
+					return opHash, nil
+				},
+				wait: func(h *tz.OperationHash) error {
+					assert.Equal(t, opHash, h)
+					return tt.wait
+				},
+			})
+
+			injected, err := c.ChargeKeys(context.Background(), []uint64{1, 2})
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+			} else {
+				require.NoError(t, err)
+			}
+			assert.Equal(t, tt.injected, injected)
+
+			got := drain(ch)
+			require.Len(t, got, len(tt.expect))
+			for i, e := range tt.expect {
+				assert.Equal(t, e.Type, got[i].Type, i)
+				assert.Equal(t, e.OpHash, got[i].OpHash, i)
+				assert.Equal(t, e.Keys, got[i].Keys, i)
+				if e.Type == events.BatchFailed {
+					assert.Contains(t, got[i].Error, tt.err, i)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package charger
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/b58"
+	"github.com/ecadlabs/gotez/v2/crypt"
+)
+
+// RemoteSigner signs with a key held by an octez compatible remote signer
+type RemoteSigner struct {
+	URL        string
+	PKH        tz.PublicKeyHash
+	HTTPClient *http.Client
+
+	mtx sync.Mutex
+	pub crypt.PublicKey
+}
+
+func (r *RemoteSigner) request(ctx context.Context, method string, body any, out any) error {
+	var rd io.Reader
+	if body != nil {
+		buf, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rd = bytes.NewReader(buf)
+	}
+	u := strings.TrimSuffix(r.URL, "/") + "/keys/" + r.PKH.String()
+	req, err := http.NewRequestWithContext(ctx, method, u, rd)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := r.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("remote signer: %s: %s", res.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (r *RemoteSigner) Sign(ctx context.Context, message []byte) (crypt.Signature, error) {
+	var res struct {
+		Signature string `json:"signature"`
+	}
+	if err := r.request(ctx, http.MethodPost, hex.EncodeToString(message), &res); err != nil {
+		return nil, err
+	}
+	sig, err := b58.ParseSignature([]byte(res.Signature))
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewSignature(sig)
+}
+
+// PublicKey fetches the public key once and caches it
+func (r *RemoteSigner) PublicKey(ctx context.Context) (crypt.PublicKey, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.pub != nil {
+		return r.pub, nil
+	}
+	var res struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := r.request(ctx, http.MethodGet, nil, &res); err != nil {
+		return nil, err
+	}
+	p, err := b58.ParsePublicKey([]byte(res.PublicKey))
+	if err != nil {
+		return nil, err
+	}
+	pub, err := crypt.NewPublicKey(p)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Hash().String() != r.PKH.String() {
+		return nil, fmt.Errorf("remote signer: public key %v doesn't match %v", pub.Hash(), r.PKH)
+	}
+	r.pub = pub
+	return pub, nil
+}
@@ -0,0 +1,76 @@
+package charger_test
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/gotez/v2/crypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSeed = charger.Seed([]byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"))
+
+// signerMock serves a single key using the octez remote signer protocol
+func signerMock(t *testing.T, priv crypt.PrivateKey) *httptest.Server {
+	path := "/keys/" + priv.Public().Hash().String()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != path {
+			http.Error(w, `[{"kind":"temporary","id":"failure","msg":"unknown key"}]`, http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			json.NewEncoder(w).Encode(map[string]string{"public_key": priv.Public().String()})
+		case http.MethodPost:
+			var msg string
+			if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			data, err := hex.DecodeString(msg)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			sig, err := priv.Sign(data)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"signature": sig.String()})
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestRemoteSigner(t *testing.T) {
+	ctx := context.Background()
+	priv, err := testSeed.Derive(1)
+	require.NoError(t, err)
+	srv := signerMock(t, priv)
+
+	signer := charger.RemoteSigner{URL: srv.URL, PKH: priv.Public().Hash()}
+	pub, err := signer.PublicKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, priv.Public().String(), pub.String())
+
+	message := []byte{3, 1, 2, 3}
+	sig, err := signer.Sign(ctx, message)
+	require.NoError(t, err)
+	assert.True(t, pub.VerifySignature(sig, message))
+
+	other, err := testSeed.Derive(2)
+	require.NoError(t, err)
+	unknown := charger.RemoteSigner{URL: srv.URL, PKH: other.Public().Hash()}
+	_, err = unknown.Sign(ctx, message)
+	assert.ErrorContains(t, err, "404")
+}
@@ -0,0 +1,174 @@
+package charger
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/client"
+	"github.com/ecadlabs/gotez/v2/protocol/latest"
+	"github.com/ecadlabs/gotez/v2/teztool"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rules a recycled key must pass to go back into the queue
+const (
+	RuleNoDelegate   = "no-delegate"
+	RuleNoStake      = "no-stake"
+	RuleNoPendingOps = "no-pending-ops"
+	// RuleNoTokens checks ticket balances. FA1.2 and FA2 balances are kept in the storage of the token
+	// contracts and can't be looked up by holder on a node.
+	RuleNoTokens = "no-tokens"
+)
+
+var Rules = []string{RuleNoDelegate, RuleNoStake, RuleNoPendingOps, RuleNoTokens}
+
+// resettable rules are fixed by withdrawing the delegation. Staked funds are only released cycles
+// after an unstake, so a staked key can't be reset.
+var resettable = map[string]bool{
+	RuleNoDelegate: true,
+}
+
+// Inspect returns the rules the key breaks
+func (c *Charger) Inspect(ctx context.Context, key uint64, rules []string) ([]string, error) {
+	st := c.state.Load()
+	priv, err := st.cfg.GetSeed().Derive(key)
+	if err != nil {
+		return nil, err
+	}
+	pkh := priv.Public().Hash()
+
+	var broken []string
+	for _, rule := range rules {
+		var ok bool
+		switch rule {
+		case RuleNoDelegate:
+			ok, err = st.noDelegate(ctx, pkh)
+		case RuleNoStake:
+			ok, err = st.noStake(ctx, pkh)
+		case RuleNoPendingOps:
+			ok, err = st.noPendingOps(ctx, pkh)
+		case RuleNoTokens:
+			ok, err = st.noTokens(ctx, pkh)
+		default:
+			err = fmt.Errorf("unknown rule: %s", rule)
+		}
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if !ok {
+			broken = append(broken, rule)
+		}
+	}
+	return broken, nil
+}
+
+// ResetKey withdraws the key's delegation. It returns false without doing anything if a broken rule
+// can't be fixed that way.
+func (c *Charger) ResetKey(ctx context.Context, key uint64, broken []string) (bool, error) {
+	for _, rule := range broken {
+		if !resettable[rule] {
+			return false, nil
+		}
+	}
+	st := c.state.Load()
+	if st.chainID == nil {
+		return false, errors.New("chain ID is unknown")
+	}
+	priv, err := st.cfg.GetSeed().Derive(key)
+	if err != nil {
+		return false, err
+	}
+	pkh := priv.Public().Hash()
+
+	log.WithFields(log.Fields{"pkh": pkh, "rules": broken}).Info("Withdrawing delegation")
+	// no delegate means withdrawal
+	op := latest.Delegation{
+		ManagerOperation: latest.ManagerOperation{Source: pkh},
+	}
+	if _, err := st.injectWait(ctx, teztool.NewLocalSigner(priv), []latest.OperationContents{&op}, nil); err != nil {
+		log.Error(err)
+		return false, err
+	}
+	return true, nil
+}
+
+func (c *chargerState) noDelegate(ctx context.Context, pkh tz.PublicKeyHash) (bool, error) {
+	var delegate string
+	found, err := c.get(ctx, c.contractPath(pkh)+"/delegate", &delegate)
+	return !found || delegate == "", err
+}
+
+func (c *chargerState) noStake(ctx context.Context, pkh tz.PublicKeyHash) (bool, error) {
+	var staked *string
+	found, err := c.get(ctx, c.contractPath(pkh)+"/staked_balance", &staked)
+	if err != nil || !found || staked == nil {
+		return true, err
+	}
+	v, ok := new(big.Int).SetString(*staked, 10)
+	if !ok {
+		return false, fmt.Errorf("invalid staked balance: %q", *staked)
+	}
+	return v.Sign() == 0, nil
+}
+
+// noPendingOps looks for the key's operations in the node's mempool
+func (c *chargerState) noPendingOps(ctx context.Context, pkh tz.PublicKeyHash) (bool, error) {
+	var pending map[string]json.RawMessage
+	q := url.Values{"sources": {pkh.String()}, "version": {"2"}}
+	if _, err := c.get(ctx, "/chains/"+c.chain()+"/mempool/pending_operations?"+q.Encode(), &pending); err != nil {
+		return false, err
+	}
+	// refused and outdated operations are never included
+	for _, class := range []string{"validated", "applied", "branch_delayed", "branch_refused", "unprocessed"} {
+		var ops []json.RawMessage
+		if data, ok := pending[class]; ok {
+			if err := json.Unmarshal(data, &ops); err != nil {
+				return false, fmt.Errorf("pending operations: %s: %w", class, err)
+			}
+		}
+		if len(ops) != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *chargerState) noTokens(ctx context.Context, pkh tz.PublicKeyHash) (bool, error) {
+	var tickets []struct {
+		Amount string `json:"amount"`
+	}
+	if _, err := c.get(ctx, c.contractPath(pkh)+"/all_ticket_balances", &tickets); err != nil {
+		return false, err
+	}
+	for _, t := range tickets {
+		v, ok := new(big.Int).SetString(t.Amount, 10)
+		if !ok {
+			return false, fmt.Errorf("invalid ticket balance: %q", t.Amount)
+		}
+		if v.Sign() != 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *chargerState) contractPath(pkh tz.PublicKeyHash) string {
+	return "/chains/" + c.chain() + "/blocks/head/context/contracts/" + pkh.String()
+}
+
+// get queries the node through the client. It returns false if the node responds with 404.
+func (c *chargerState) get(ctx context.Context, path string, out any) (bool, error) {
+	err := c.client.Get(ctx, path, out)
+	var e *client.Error
+	if errors.As(err, &e) && e.Status == http.StatusNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,227 @@
+package charger_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/protocol/latest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func contractPath(t *testing.T, key uint64) string {
+	priv, err := testSeed.Derive(key)
+	require.NoError(t, err)
+	return "/chains/" + testChainID.String() + "/blocks/head/context/contracts/" + priv.Public().Hash().String()
+}
+
+var pendingPath = "/chains/" + testChainID.String() + "/mempool/pending_operations"
+
+func TestInspect(t *testing.T) {
+	op := map[string]string{"hash": "oo"}
+	tests := []struct {
+		name string
+		// paths relative to the contract unless absolute
+		routes map[string]any
+		rules  []string
+		broken []string
+		err    string
+	}{
+		{
+			name: "clean",
+			routes: map[string]any{
+				"/staked_balance":      "0",
+				pendingPath:            map[string]any{"applied": []any{}},
+				"/all_ticket_balances": []any{map[string]string{"amount": "0"}},
+			},
+			rules: charger.Rules,
+		},
+		{
+			name:   "unknown contract",
+			routes: map[string]any{pendingPath: map[string]any{}},
+			rules:  charger.Rules,
+		},
+		{
+			name:   "delegate",
+			routes: map[string]any{"/delegate": "tz1delegate"},
+			rules:  []string{charger.RuleNoDelegate},
+			broken: []string{charger.RuleNoDelegate},
+		},
+		{
+			name:   "no delegate",
+			routes: map[string]any{"/delegate": ""},
+			rules:  []string{charger.RuleNoDelegate},
+		},
+		{
+			name:   "staked",
+			routes: map[string]any{"/staked_balance": "1000"},
+			rules:  []string{charger.RuleNoStake},
+			broken: []string{charger.RuleNoStake},
+		},
+		{
+			name:   "no stake",
+			routes: map[string]any{"/staked_balance": nil},
+			rules:  []string{charger.RuleNoStake},
+		},
+		{
+			name:   "invalid stake",
+			routes: map[string]any{"/staked_balance": "x"},
+			rules:  []string{charger.RuleNoStake},
+			err:    "invalid staked balance",
+		},
+		{
+			name:   "pending",
+			routes: map[string]any{pendingPath: map[string]any{"refused": []any{}, "validated": []any{op}}},
+			rules:  []string{charger.RuleNoPendingOps},
+			broken: []string{charger.RuleNoPendingOps},
+		},
+		{
+			name:   "never included",
+			routes: map[string]any{pendingPath: map[string]any{"refused": []any{op}, "outdated": []any{op}}},
+			rules:  []string{charger.RuleNoPendingOps},
+		},
+		{
+			name:   "tickets",
+			routes: map[string]any{"/all_ticket_balances": []any{map[string]string{"amount": "0"}, map[string]string{"amount": "5"}}},
+			rules:  []string{charger.RuleNoTokens},
+			broken: []string{charger.RuleNoTokens},
+		},
+		{
+			name:   "invalid ticket balance",
+			routes: map[string]any{"/all_ticket_balances": []any{map[string]string{"amount": "x"}}},
+			rules:  []string{charger.RuleNoTokens},
+			err:    "invalid ticket balance",
+		},
+		{
+			name:   "node error",
+			routes: map[string]any{"/delegate": nodeError{}},
+			rules:  []string{charger.RuleNoDelegate},
+			err:    "500",
+		},
+		{
+			name: "several",
+			routes: map[string]any{
+				"/delegate":            "tz1delegate",
+				"/staked_balance":      "1000",
+				pendingPath:            map[string]any{"branch_delayed": []any{op}},
+				"/all_ticket_balances": []any{map[string]string{"amount": "1"}},
+			},
+			rules:  charger.Rules,
+			broken: charger.Rules,
+		},
+		{
+			name:  "unknown rule",
+			rules: []string{"no-nfts"},
+			err:   "unknown rule",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newNodeMock(t)
+			for path, v := range tt.routes {
+				if path[0] == '/' && path != pendingPath {
+					path = contractPath(t, 1) + path
+				}
+				node.set(path, v)
+			}
+			c := charger.New(&chargerConfig{chainID: testChainID}, node.client(), nil)
+			broken, err := c.Inspect(context.Background(), 1, tt.rules)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.broken, broken)
+		})
+	}
+}
+
+func TestResetKey(t *testing.T) {
+	opHash := &tz.OperationHash{9}
+	rules := []string{charger.RuleNoDelegate}
+
+	tests := []struct {
+		name   string
+		broken []string
+		inject func(node *nodeMock) error
+		wait   error
+		ok     bool
+		err    string
+	}{
+		{
+			name:   "reset",
+			broken: rules,
+			inject: func(node *nodeMock) error {
+				node.set(contractPath(t, 1)+"/delegate", "")
+				return nil
+			},
+			ok: true,
+		},
+		{
+			name:   "not resettable",
+			broken: []string{charger.RuleNoDelegate, charger.RuleNoPendingOps},
+		},
+		{
+			name:   "staked",
+			broken: []string{charger.RuleNoDelegate, charger.RuleNoStake},
+		},
+		{
+			name:   "refused",
+			broken: rules,
+			inject: func(node *nodeMock) error { return errors.New("refused") },
+			err:    "refused",
+		},
+		{
+			name:   "not included",
+			broken: rules,
+			inject: func(node *nodeMock) error { return nil },
+			wait:   errors.New("isn't included"),
+			err:    "isn't included",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := newNodeMock(t)
+			node.set(contractPath(t, 1)+"/delegate", "tz1delegate")
+			c := charger.New(&chargerConfig{chainID: testChainID}, node.client(), nil)
+
+			var injected bool
+			c.SetInjector(&injectorMock{
+				inject: func(ops []latest.OperationContents) (*tz.OperationHash, error) {
+					injected = true
+					require.Len(t, ops, 1)
+					op, ok := ops[0].(*latest.Delegation)
+					require.True(t, ok)
+					assert.Equal(t, contractPath(t, 1), "/chains/"+testChainID.String()+"/blocks/head/context/contracts/"+op.Source.String())
+					if err := tt.inject(node); err != nil {
+						return nil, err
+					}
+					return opHash, nil
+				},
+				wait: func(hash *tz.OperationHash) error { return tt.wait },
+			})
+
+			ok, err := c.ResetKey(context.Background(), 1, tt.broken)
+			assert.Equal(t, tt.inject != nil, injected)
+			if tt.err != "" {
+				require.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.ok, ok)
+
+			broken, err := c.Inspect(context.Background(), 1, rules)
+			require.NoError(t, err)
+			if ok {
+				assert.Empty(t, broken)
+			} else {
+				assert.Equal(t, rules, broken)
+			}
+		})
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/utils"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/term"
+)
+
+// command is a subcommand taking the rest of the command line
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]*command{
+	"validate": {
+		usage: "Validate the networks configuration and exit",
+		run:   validateCmd,
+	},
+	"encrypt-seed": {
+		usage: "Encrypt a hex encoded seed with a passphrase",
+		run:   encryptSeedCmd,
+	},
+	"export": {
+		usage: "Write the buffered keys, leases and sequences to JSON: export [-d db] [-o file]",
+		run:   exportCmd,
+	},
+	"import": {
+		usage: "Restore exported pools into empty ones: import [-d db] [-i file]",
+		run:   importCmd,
+	},
+	"lease": {
+		usage: "Inspect leases offline: lease list|expire [-n file] [-d db] <network> [id]",
+		run:   adminCmd("lease", leaseCommands),
+	},
+	"pool": {
+		usage: "Inspect and repair the buffer offline: pool list|drop|resequence [-n file] [-d db] <network> [id]",
+		run:   adminCmd("pool", poolCommands),
+	},
+	"migrate": {
+		usage: "Upgrade the database to the current schema and exit",
+		run:   migrateCmd,
+	},
+}
+
+// networksFlag registers -n defaulting to KEYGEN_NETWORKS
+func networksFlag(fs *flag.FlagSet) *string {
+	return fs.String("n", os.Getenv("KEYGEN_NETWORKS"), "Networks configuration file")
+}
+
+// databaseFlag registers -d defaulting to KEYGEN_DB
+func databaseFlag(fs *flag.FlagSet) *string {
+	return fs.String("d", os.Getenv("KEYGEN_DB"), "Database")
+}
+
+func validateCmd(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	networksFile := networksFlag(fs)
+	fs.Parse(args)
+
+	cfg, err := readConfig(*networksFile)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedNames(cfg.Networks) {
+		fmt.Printf("%s: OK\n", name)
+	}
+	return nil
+}
+
+func readPassword(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, errors.New("passphrase is required but stdin is not a terminal")
+	}
+	fmt.Fprint(os.Stderr, prompt)
+	defer fmt.Fprintln(os.Stderr)
+	return term.ReadPassword(fd)
+}
+
+// promptPassphrase reads the network's passphrase from the terminal
+func promptPassphrase(network string) ([]byte, error) {
+	return readPassword(fmt.Sprintf("Passphrase for %s: ", network))
+}
+
+func encryptSeedCmd(args []string) error {
+	fs := flag.NewFlagSet("encrypt-seed", flag.ExitOnError)
+	in := fs.String("i", "", "Hex encoded seed file. Stdin is used if not set")
+	out := fs.String("o", "", "Output file. Stdout is used if not set")
+	passFile := fs.String("passphrase-file", "", "Passphrase file. KEYGEN_PASSPHRASE environment variable or interactive prompt is used if not set")
+	fs.Parse(args)
+
+	var (
+		data []byte
+		err  error
+	)
+	if *in != "" {
+		data, err = os.ReadFile(*in)
+	} else {
+		data, err = io.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	data = bytes.TrimSpace(data)
+	if _, err := config.DecodeSeed(data); err != nil {
+		return fmt.Errorf("seed: %w", err)
+	}
+
+	var pass []byte
+	switch {
+	case os.Getenv("KEYGEN_PASSPHRASE") != "":
+		pass = []byte(os.Getenv("KEYGEN_PASSPHRASE"))
+	case *passFile != "":
+		if pass, err = os.ReadFile(*passFile); err != nil {
+			return err
+		}
+		pass = bytes.TrimRight(pass, "\r\n")
+	default:
+		if pass, err = readPassword("Passphrase: "); err != nil {
+			return err
+		}
+		confirm, err := readPassword("Repeat passphrase: ")
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(pass, confirm) {
+			return errors.New("passphrases don't match")
+		}
+	}
+	if len(pass) == 0 {
+		return errors.New("empty passphrase")
+	}
+
+	enc, err := utils.Encrypt(data, pass)
+	if err != nil {
+		return err
+	}
+	enc = append(enc, '\n')
+	if *out != "" {
+		return os.WriteFile(*out, enc, 0600)
+	}
+	_, err = os.Stdout.Write(enc)
+	return err
+}
+
+func migrateCmd(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ExitOnError)
+	databaseFile := databaseFlag(fs)
+	dryRun := fs.Bool("dry-run", false, "Run the migrations and roll them back")
+	fs.Parse(args)
+
+	if *databaseFile == "" {
+		return errors.New("database file is required")
+	}
+	// don't create a missing file
+	if _, err := os.Stat(*databaseFile); err != nil {
+		return err
+	}
+	db, err := bolt.Open(*databaseFile, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	store := keypool.NewBoltStore(db)
+	pools, err := store.Pools()
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		applied, err := store.Migrate(pool, *dryRun)
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Printf("%s: up to date\n", pool)
+		}
+		for _, m := range applied {
+			fmt.Printf("%s: %s\n", pool, m)
+		}
+	}
+	return nil
+}
@@ -1,108 +1,259 @@
 package config
 
 import (
+	"bytes"
 	"encoding/hex"
+	"fmt"
 	"io"
 	"math/big"
-	"os"
-	"strings"
 	"time"
 
+	"github.com/ecadlabs/go-tezos-keygen/balancer"
 	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
 	tz "github.com/ecadlabs/gotez/v2"
-	"github.com/ecadlabs/gotez/v2/crypt"
+	"github.com/ecadlabs/gotez/v2/teztool"
 	"gopkg.in/yaml.v3"
 )
 
 type networkConfig struct {
-	URL             string        `yaml:"url"`
-	ChainID         *tz.ChainID   `yaml:"chain-id"`
-	Seed            string        `yaml:"seed"`
-	SeedFile        string        `yaml:"seed-file"`
-	PrivateKey      string        `yaml:"private-key"`
-	PrivateKeyFile  string        `yaml:"private-key-file"`
-	MinBalance      *big.Int      `yaml:"min-balance"`
-	Amount          *big.Int      `yaml:"amount"`
-	OpsPerGroup     int           `yaml:"ops-per-group"`
-	LeaseTime       time.Duration `yaml:"lease-time"`
-	BufferLength    int           `yaml:"buffer-length"`
-	BufferThreshold int           `yaml:"buffer-threshold"`
-	Timeout         time.Duration `yaml:"rpc-timeout"`
+	URL             string            `yaml:"url"`
+	URLs            []*EndpointConfig `yaml:"urls"`
+	MaxHeadLag      int64             `yaml:"max-head-lag"`
+	ChainID         *tz.ChainID       `yaml:"chain-id"`
+	Seed            string            `yaml:"seed"`
+	SeedFile        string            `yaml:"seed-file"`
+	PrivateKey      string            `yaml:"private-key"`
+	PrivateKeyFile  string            `yaml:"private-key-file"`
+	PassphraseFile  string            `yaml:"passphrase-file"`
+	FunderSigner    *SignerConfig     `yaml:"funder-signer"`
+	MinBalance      *big.Int          `yaml:"min-balance"`
+	Amount          *big.Int          `yaml:"amount"`
+	OpsPerGroup     *int              `yaml:"ops-per-group"`
+	LeaseTime       time.Duration     `yaml:"lease-time"`
+	BufferLength    int               `yaml:"buffer-length"`
+	BufferThreshold int               `yaml:"buffer-threshold"`
+	Timeout         *time.Duration    `yaml:"rpc-timeout"`
+	DailyKeys       uint64            `yaml:"daily-keys"`
+	DailyAmount     *big.Int          `yaml:"daily-amount"`
+	AuditRetention  time.Duration     `yaml:"audit-retention"`
+	RecycleRetries  *int              `yaml:"recycle-retries"`
+	RecycleBackoff  time.Duration     `yaml:"recycle-backoff"`
+	RecyclePolicy   string            `yaml:"recycle-policy"`
+	TopUpLimit      *int              `yaml:"topup-limit"`
+	RecycleRules    []string          `yaml:"recycle-rules"`
+	DirtyKeys       string            `yaml:"dirty-keys"`
+	ChainCheck      time.Duration     `yaml:"chain-check-interval"`
+	KeepSequence    bool              `yaml:"keep-sequence"`
+}
+
+// EndpointConfig is an additional RPC URL. Endpoints with lower priority values are preferred.
+type EndpointConfig struct {
+	URL      string `yaml:"url"`
+	Priority int    `yaml:"priority"`
+}
+
+// SignerConfig points to a key held by an octez compatible remote signer
+type SignerConfig struct {
+	URL string `yaml:"url"`
+	PKH string `yaml:"pkh"`
 }
 
 type NetworkConfig struct {
 	*networkConfig
-	name       string
-	seed       charger.Seed
-	privateKey crypt.PrivateKey
-}
-
-func (n *NetworkConfig) GetURL() string                  { return n.URL }
-func (n *NetworkConfig) GetChainID() *tz.ChainID         { return n.ChainID }
-func (n *NetworkConfig) GetSeed() charger.Seed           { return n.seed }
-func (n *NetworkConfig) GetPrivateKey() crypt.PrivateKey { return n.privateKey }
-func (n *NetworkConfig) GetMinBalance() *big.Int         { return n.MinBalance }
-func (n *NetworkConfig) GetAmount() *big.Int             { return n.Amount }
-func (n *NetworkConfig) GetOpsPerGroup() int             { return n.OpsPerGroup }
-func (n *NetworkConfig) GetLeaseTime() time.Duration     { return n.LeaseTime }
-func (n *NetworkConfig) GetBucket() string               { return n.name }
-func (n *NetworkConfig) GetBufferLength() int            { return n.BufferLength }
-func (n *NetworkConfig) GetBufferThreshold() int         { return n.BufferThreshold }
-func (n *NetworkConfig) GetTimeout() time.Duration       { return n.Timeout }
-
-type Config map[string]*NetworkConfig
-
-func inlineOrFile(inline, file string) ([]byte, error) {
-	if inline != "" {
-		return []byte(inline), nil
-	}
-	return os.ReadFile(file)
+	name      string
+	seed      charger.Seed
+	funder    teztool.Signer
+	funderPKH tz.PublicKeyHash
 }
 
-func New(rd io.Reader) (Config, error) {
-	var raw map[string]*networkConfig
-	if err := yaml.NewDecoder(rd).Decode(&raw); err != nil {
-		return nil, err
+func (n *NetworkConfig) GetMaxHeadLag() int64             { return n.MaxHeadLag }
+func (n *NetworkConfig) GetChainID() *tz.ChainID          { return n.ChainID }
+func (n *NetworkConfig) GetSeed() charger.Seed            { return n.seed }
+func (n *NetworkConfig) GetFunder() teztool.Signer        { return n.funder }
+func (n *NetworkConfig) GetFunderPKH() tz.PublicKeyHash   { return n.funderPKH }
+func (n *NetworkConfig) GetMinBalance() *big.Int          { return n.MinBalance }
+func (n *NetworkConfig) GetAmount() *big.Int              { return n.Amount }
+func (n *NetworkConfig) GetOpsPerGroup() int              { return *n.OpsPerGroup }
+func (n *NetworkConfig) GetLeaseTime() time.Duration      { return n.LeaseTime }
+func (n *NetworkConfig) GetBucket() string                { return n.name }
+func (n *NetworkConfig) GetBufferLength() int             { return n.BufferLength }
+func (n *NetworkConfig) GetBufferThreshold() int          { return n.BufferThreshold }
+func (n *NetworkConfig) GetTimeout() time.Duration        { return *n.Timeout }
+func (n *NetworkConfig) GetAuditRetention() time.Duration { return n.AuditRetention }
+func (n *NetworkConfig) GetRecycleRetries() int           { return *n.RecycleRetries }
+func (n *NetworkConfig) GetRecycleBackoff() time.Duration { return n.RecycleBackoff }
+func (n *NetworkConfig) GetRecyclePolicy() string         { return n.RecyclePolicy }
+func (n *NetworkConfig) GetTopUpLimit() int               { return *n.TopUpLimit }
+func (n *NetworkConfig) GetRecycleRules() []string        { return n.RecycleRules }
+func (n *NetworkConfig) GetDirtyKeys() string             { return n.DirtyKeys }
+func (n *NetworkConfig) GetChainCheck() time.Duration     { return n.ChainCheck }
+func (n *NetworkConfig) GetKeepSequence() bool            { return n.KeepSequence }
+
+// GetEndpoints returns url followed by urls
+func (n *NetworkConfig) GetEndpoints() []balancer.Endpoint {
+	var out []balancer.Endpoint
+	if n.URL != "" {
+		out = append(out, balancer.Endpoint{URL: n.URL})
 	}
-	out := make(Config, len(raw))
-	for name, data := range raw {
-		envPrefix := strings.ToUpper(name)
-		var privData []byte
-		if v := os.Getenv(envPrefix + "_PRIVATE_KEY"); v != "" {
-			privData = []byte(v)
-		} else {
-			var err error
-			privData, err = inlineOrFile(data.PrivateKey, data.PrivateKeyFile)
-			if err != nil {
-				return nil, err
-			}
+	for _, e := range n.URLs {
+		out = append(out, balancer.Endpoint{URL: e.URL, Priority: e.Priority})
+	}
+	return out
+}
+
+func (n *NetworkConfig) GetQuota() *keypool.Quota {
+	return &keypool.Quota{Keys: n.DailyKeys, Amount: n.DailyAmount}
+}
+
+// TokenConfig describes an API token. Only the token's SHA-256 hash is stored.
+type TokenConfig struct {
+	Name   string              `yaml:"name"`
+	SHA256 string              `yaml:"sha256"`
+	Scopes map[string][]string `yaml:"scopes"`
+}
+
+// CertificateConfig maps a client certificate subject to an identity
+type CertificateConfig struct {
+	Name    string              `yaml:"name"`
+	Subject string              `yaml:"subject"`
+	Scopes  map[string][]string `yaml:"scopes"`
+}
+
+type ServerConfig struct {
+	Tokens       []*TokenConfig       `yaml:"tokens"`
+	Certificates []*CertificateConfig `yaml:"certificates"`
+	// RateLimit holds requests per minute per client keyed by scope
+	RateLimit map[string]int `yaml:"rate-limit"`
+}
+
+func (s *ServerConfig) RateLimits() (map[string]int, error) {
+	for scope, limit := range s.RateLimit {
+		if !knownScopes[scope] {
+			return nil, fmt.Errorf("rate-limit: unknown scope %s", scope)
 		}
-		priv, err := crypt.ParsePrivateKey(privData)
-		if err != nil {
-			return nil, err
+		if limit < 0 {
+			return nil, fmt.Errorf("rate-limit: negative limit for %s", scope)
 		}
+	}
+	return s.RateLimit, nil
+}
 
-		var seedData []byte
-		if v := os.Getenv(envPrefix + "_SEED"); v != "" {
-			seedData = []byte(v)
-		} else {
-			var err error
-			seedData, err = inlineOrFile(data.Seed, data.SeedFile)
-			if err != nil {
-				return nil, err
-			}
+var knownScopes = map[string]bool{
+	middleware.ScopePop:    true,
+	middleware.ScopeLease:  true,
+	middleware.ScopeSign:   true,
+	middleware.ScopeStatus: true,
+	middleware.ScopeAdmin:  true,
+}
+
+func checkScopes(scopes map[string][]string) error {
+	for scope := range scopes {
+		if !knownScopes[scope] {
+			return fmt.Errorf("unknown scope %s", scope)
+		}
+	}
+	return nil
+}
+
+// Principals returns the configured tokens keyed by their hashes
+func (s *ServerConfig) Principals() (map[middleware.TokenHash]*middleware.Principal, error) {
+	out := make(map[middleware.TokenHash]*middleware.Principal, len(s.Tokens))
+	for _, t := range s.Tokens {
+		var h middleware.TokenHash
+		if n, err := hex.Decode(h[:], []byte(t.SHA256)); err != nil {
+			return nil, fmt.Errorf("token %s: %w", t.Name, err)
+		} else if n != len(h) {
+			return nil, fmt.Errorf("token %s: SHA-256 hash expected", t.Name)
+		}
+		if err := checkScopes(t.Scopes); err != nil {
+			return nil, fmt.Errorf("token %s: %w", t.Name, err)
 		}
-		seed := make([]byte, hex.DecodedLen(len(seedData)))
-		if _, err := hex.Decode(seed, seedData); err != nil {
-			return nil, err
+		out[h] = &middleware.Principal{
+			Identity: identity.Identity{Name: t.Name, Method: identity.MethodToken},
+			Scopes:   t.Scopes,
 		}
+	}
+	return out, nil
+}
 
-		out[name] = &NetworkConfig{
-			networkConfig: data,
-			name:          name,
-			seed:          seed,
-			privateKey:    priv,
+// CertificatePrincipals returns the configured client certificate identities keyed by subjects
+func (s *ServerConfig) CertificatePrincipals() (map[string]*middleware.Principal, error) {
+	out := make(map[string]*middleware.Principal, len(s.Certificates))
+	for _, c := range s.Certificates {
+		if err := checkScopes(c.Scopes); err != nil {
+			return nil, fmt.Errorf("certificate %s: %w", c.Name, err)
+		}
+		name := c.Name
+		if name == "" {
+			name = c.Subject
+		}
+		out[c.Subject] = &middleware.Principal{
+			Identity: identity.Identity{Name: name, Method: identity.MethodCert},
+			Scopes:   c.Scopes,
 		}
 	}
 	return out, nil
 }
+
+// decodeStrict decodes the node rejecting unknown fields
+func decodeStrict(node *yaml.Node, out any) error {
+	data, err := yaml.Marshal(node)
+	if err != nil {
+		return err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	return dec.Decode(out)
+}
+
+// ServerSection is the reserved top level key holding the server configuration.
+// All other keys are network names.
+const ServerSection = "server"
+
+type Config struct {
+	Server   ServerConfig
+	Networks map[string]*NetworkConfig
+}
+
+// New parses the configuration, applies defaults and validates the result. All problems
+// found are reported at once as ValidationError.
+func New(rd io.Reader) (*Config, error) {
+	var raw map[string]yaml.Node
+	if err := yaml.NewDecoder(rd).Decode(&raw); err != nil {
+		return nil, err
+	}
+	out := Config{
+		Networks: make(map[string]*NetworkConfig, len(raw)),
+	}
+	var errs ValidationError
+	for _, name := range sortedKeys(raw) {
+		node := raw[name]
+		v := validator{section: name}
+		if name == ServerSection {
+			if err := decodeStrict(&node, &out.Server); err != nil {
+				// most likely a network configured before the section was reserved
+				v.fail("", "invalid server settings (the section is reserved, networks can't be named %q): %v", ServerSection, err)
+			} else {
+				v.server(&out.Server)
+			}
+		} else {
+			var data networkConfig
+			if err := node.Decode(&data); err != nil {
+				v.error("", err)
+			} else {
+				out.Networks[name] = v.network(name, &data)
+			}
+		}
+		errs = append(errs, v.errors...)
+	}
+	if len(out.Networks) == 0 && len(errs) == 0 {
+		errs = append(errs, &FieldError{Section: "config", Err: errNoNetworks})
+	}
+	if len(errs) != 0 {
+		return nil, errs
+	}
+	return &out, nil
+}
@@ -0,0 +1,190 @@
+package config_test
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const validNetwork = `
+testnet:
+  url: https://ghostnet.ecadinfra.com
+  chain-id: NetXnHfVqm9iesp
+  seed: f7353829d316c20922f8ff2ed696090801d9c775977df6423cd68a737c628b844b13c951de7cb7cd01cd62430edeefbc219885b388f06cb5d1e496f63bc9c0d5
+  private-key: edsk2mgqWz5tUQQPK2LCg4Ae2G9bdd8RGzJP9oR3S7cKgASndbnRjE
+  amount: 2000000
+`
+
+func TestDefaults(t *testing.T) {
+	cfg, err := config.New(strings.NewReader(validNetwork))
+	require.NoError(t, err)
+	net := cfg.Networks["testnet"]
+	require.NotNil(t, net)
+	assert.Equal(t, config.DefaultOpsPerGroup, net.GetOpsPerGroup())
+	assert.Equal(t, config.DefaultBufferLength, net.GetBufferLength())
+	assert.Equal(t, config.DefaultLeaseTime, net.GetLeaseTime())
+	assert.Equal(t, config.DefaultTimeout, net.GetTimeout())
+	assert.Equal(t, config.DefaultChainCheck, net.GetChainCheck())
+	assert.Equal(t, config.DefaultRecycleRetries, net.GetRecycleRetries())
+	assert.Equal(t, config.DefaultRecycleBackoff, net.GetRecycleBackoff())
+	assert.Equal(t, config.DefaultRecyclePolicy, net.GetRecyclePolicy())
+	assert.Equal(t, config.DefaultTopUpLimit, net.GetTopUpLimit())
+	assert.Empty(t, net.GetRecycleRules())
+	assert.Equal(t, config.DefaultDirtyKeys, net.GetDirtyKeys())
+	assert.Equal(t, 0, net.GetMinBalance().Sign())
+	assert.Len(t, net.GetSeed(), 64)
+}
+
+func TestValidation(t *testing.T) {
+	src := `
+broken:
+  url: ftp://example.com
+  seed: abc
+  private-key: edsk2mgqWz5tUQQPK2LCg4Ae2G9bdd8RGzJP9oR3S7cKgASndbnRjE
+  ops-per-group: -1
+  buffer-length: 5
+  buffer-threshold: 5
+  recycle-rules: [no-delegate, no-nfts]
+  dirty-keys: keep
+`
+	_, err := config.New(strings.NewReader(src))
+	require.Error(t, err)
+	var verr config.ValidationError
+	require.True(t, errors.As(err, &verr))
+
+	fields := make(map[string]bool)
+	for _, e := range verr {
+		assert.Equal(t, "broken", e.Section)
+		fields[e.Field] = true
+	}
+	for _, f := range []string{"url", "amount", "seed", "ops-per-group", "buffer-threshold", "recycle-rules", "dirty-keys"} {
+		assert.True(t, fields[f], f)
+	}
+	assert.False(t, fields["private-key"])
+	// discovered from the node
+	assert.False(t, fields["chain-id"])
+}
+
+// options where zero isn't the default
+func TestZeroValues(t *testing.T) {
+	for _, tt := range []struct {
+		field  string
+		get    func(n *config.NetworkConfig) int
+		def    int
+		values map[string]int
+		errs   []string
+	}{
+		{
+			field:  "recycle-retries",
+			get:    (*config.NetworkConfig).GetRecycleRetries,
+			def:    config.DefaultRecycleRetries,
+			values: map[string]int{"0": 0, "3": 3},
+			errs:   []string{"-1"},
+		},
+		{
+			field:  "topup-limit",
+			get:    (*config.NetworkConfig).GetTopUpLimit,
+			def:    config.DefaultTopUpLimit,
+			values: map[string]int{"0": 0, "100": 100},
+			errs:   []string{"-1", "101"},
+		},
+		{
+			field:  "ops-per-group",
+			get:    (*config.NetworkConfig).GetOpsPerGroup,
+			def:    config.DefaultOpsPerGroup,
+			values: map[string]int{"1": 1, "10": 10},
+			errs:   []string{"0", "-1"},
+		},
+		{
+			field:  "rpc-timeout",
+			get:    func(n *config.NetworkConfig) int { return int(n.GetTimeout()) },
+			def:    int(config.DefaultTimeout),
+			values: map[string]int{"0s": 0, "30s": int(30 * time.Second)},
+			errs:   []string{"-1s"},
+		},
+	} {
+		cfg, err := config.New(strings.NewReader(validNetwork))
+		require.NoError(t, err)
+		assert.Equal(t, tt.def, tt.get(cfg.Networks["testnet"]), tt.field)
+		for src, expect := range tt.values {
+			cfg, err := config.New(strings.NewReader(validNetwork + "  " + tt.field + ": " + src + "\n"))
+			require.NoError(t, err, tt.field)
+			assert.Equal(t, expect, tt.get(cfg.Networks["testnet"]), tt.field)
+		}
+		for _, src := range tt.errs {
+			_, err := config.New(strings.NewReader(validNetwork + "  " + tt.field + ": " + src + "\n"))
+			assert.ErrorContains(t, err, tt.field, src)
+		}
+	}
+}
+
+func TestEncryptedSeed(t *testing.T) {
+	const seed = "f7353829d316c20922f8ff2ed69609080801d9c775977df6423cd68a737c628b"
+	enc, err := utils.Encrypt([]byte(seed), []byte("secret"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	seedFile := filepath.Join(dir, "seed")
+	require.NoError(t, os.WriteFile(seedFile, enc, 0600))
+	passFile := filepath.Join(dir, "passphrase")
+	require.NoError(t, os.WriteFile(passFile, []byte("secret\n"), 0600))
+
+	src := fmt.Sprintf(`
+testnet:
+  url: https://ghostnet.ecadinfra.com
+  seed-file: %s
+  passphrase-file: %s
+  private-key: edsk2mgqWz5tUQQPK2LCg4Ae2G9bdd8RGzJP9oR3S7cKgASndbnRjE
+  amount: 2000000
+`, seedFile, passFile)
+	cfg, err := config.New(strings.NewReader(src))
+	require.NoError(t, err)
+	expect, err := hex.DecodeString(seed)
+	require.NoError(t, err)
+	assert.Equal(t, expect, []byte(cfg.Networks["testnet"].GetSeed()))
+
+	// the environment variable takes precedence
+	t.Setenv("TESTNET_PASSPHRASE", "wrong")
+	_, err = config.New(strings.NewReader(src))
+	var verr config.ValidationError
+	require.ErrorAs(t, err, &verr)
+	require.Len(t, verr, 1)
+	assert.Equal(t, "seed", verr[0].Field)
+	assert.ErrorIs(t, verr[0], utils.ErrPassphrase)
+}
+
+func TestServerSection(t *testing.T) {
+	cfg, err := config.New(strings.NewReader(validNetwork + `
+server:
+  tokens:
+    - name: ci
+      sha256: ` + strings.Repeat("0", 64) + `
+      scopes:
+        pop: [testnet]
+  rate-limit:
+    pop: 10
+`))
+	require.NoError(t, err)
+	require.Len(t, cfg.Server.Tokens, 1)
+	assert.Equal(t, 10, cfg.Server.RateLimit["pop"])
+
+	// a network named server
+	_, err = config.New(strings.NewReader(validNetwork + `
+server:
+  url: https://ghostnet.ecadinfra.com
+  amount: 1000
+`))
+	var verr config.ValidationError
+	require.ErrorAs(t, err, &verr)
+	assert.ErrorContains(t, err, "section is reserved")
+	assert.ErrorContains(t, err, "url")
+}
@@ -0,0 +1,358 @@
+package config
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/utils"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/b58"
+	"github.com/ecadlabs/gotez/v2/crypt"
+	"github.com/ecadlabs/gotez/v2/teztool"
+)
+
+// Defaults applied to unset or zero network options
+const (
+	DefaultOpsPerGroup    = 5
+	DefaultLeaseTime      = 10 * time.Minute
+	DefaultBufferLength   = 10
+	DefaultTimeout        = 2 * time.Minute
+	DefaultChainCheck     = time.Minute
+	DefaultMaxHeadLag     = 2
+	DefaultRecycleRetries = 5
+	DefaultRecycleBackoff = 10 * time.Second
+	DefaultRecyclePolicy  = keypool.RecycleKeep
+	DefaultTopUpLimit     = 50
+	DefaultDirtyKeys      = keypool.DirtyDiscard
+)
+
+// Seed length limits as per SLIP-10
+const (
+	minSeedLength = 16
+	maxSeedLength = 64
+)
+
+// Prompt asks for the network's passphrase interactively. It's used if encrypted secrets are
+// configured and neither the passphrase environment variable nor the file is given.
+var Prompt func(network string) ([]byte, error)
+
+// FieldError describes a problem with a single option
+type FieldError struct {
+	Section string
+	Field   string
+	Err     error
+}
+
+func (e *FieldError) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %v", e.Section, e.Err)
+	}
+	return fmt.Sprintf("%s: %s: %v", e.Section, e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error { return e.Err }
+
+// ValidationError lists all problems found in the configuration
+type ValidationError []*FieldError
+
+func (v ValidationError) Error() string {
+	lines := make([]string, len(v))
+	for i, e := range v {
+		lines[i] = e.Error()
+	}
+	return strings.Join(lines, "\n")
+}
+
+type validator struct {
+	section string
+	errors  ValidationError
+}
+
+func (v *validator) fail(field string, format string, args ...any) {
+	v.errors = append(v.errors, &FieldError{Section: v.section, Field: field, Err: fmt.Errorf(format, args...)})
+}
+
+func (v *validator) error(field string, err error) {
+	v.errors = append(v.errors, &FieldError{Section: v.section, Field: field, Err: err})
+}
+
+// secret returns the value of the environment variable, the inline value or the file contents, in this order
+func (v *validator) secret(env, inline, file, field string) []byte {
+	if x := os.Getenv(env); x != "" {
+		return []byte(x)
+	}
+	if inline != "" {
+		return []byte(inline)
+	}
+	if file == "" {
+		v.fail(field, "either %s, %s-file or %s environment variable is required", field, field, env)
+		return nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		v.error(field+"-file", err)
+		return nil
+	}
+	return bytes.TrimSpace(data)
+}
+
+func (v *validator) nonNegative(field string, x int64) {
+	if x < 0 {
+		v.fail(field, "must not be negative")
+	}
+}
+
+func (v *validator) httpURL(field, s string) {
+	if u, err := url.Parse(s); err != nil {
+		v.error(field, err)
+	} else if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		v.fail(field, "HTTP(S) URL expected: %s", s)
+	}
+}
+
+func (v *validator) network(name string, data *networkConfig) *NetworkConfig {
+	if data.URL == "" && len(data.URLs) == 0 {
+		v.fail("url", "either url or urls is required")
+	}
+	if data.URL != "" {
+		v.httpURL("url", data.URL)
+	}
+	for _, e := range data.URLs {
+		v.httpURL("urls", e.URL)
+	}
+	v.nonNegative("max-head-lag", data.MaxHeadLag)
+	if data.MaxHeadLag == 0 {
+		data.MaxHeadLag = DefaultMaxHeadLag
+	}
+
+	if data.Amount == nil {
+		v.fail("amount", "required")
+	} else if data.Amount.Sign() <= 0 {
+		v.fail("amount", "must be positive")
+	}
+
+	if data.MinBalance == nil {
+		data.MinBalance = new(big.Int)
+	} else if data.MinBalance.Sign() < 0 {
+		v.fail("min-balance", "must not be negative")
+	}
+
+	if data.DailyAmount != nil && data.DailyAmount.Sign() < 0 {
+		v.fail("daily-amount", "must not be negative")
+	}
+
+	if data.OpsPerGroup == nil {
+		ops := DefaultOpsPerGroup
+		data.OpsPerGroup = &ops
+	} else if *data.OpsPerGroup <= 0 {
+		v.fail("ops-per-group", "must be positive")
+	}
+	v.nonNegative("lease-time", int64(data.LeaseTime))
+	if data.LeaseTime == 0 {
+		data.LeaseTime = DefaultLeaseTime
+	}
+	// zero means no timeout
+	if data.Timeout == nil {
+		timeout := DefaultTimeout
+		data.Timeout = &timeout
+	}
+	v.nonNegative("rpc-timeout", int64(*data.Timeout))
+	v.nonNegative("chain-check-interval", int64(data.ChainCheck))
+	if data.ChainCheck == 0 {
+		data.ChainCheck = DefaultChainCheck
+	}
+	v.nonNegative("audit-retention", int64(data.AuditRetention))
+	// zero means never
+	if data.RecycleRetries == nil {
+		retries := DefaultRecycleRetries
+		data.RecycleRetries = &retries
+	}
+	v.nonNegative("recycle-retries", int64(*data.RecycleRetries))
+	v.nonNegative("recycle-backoff", int64(data.RecycleBackoff))
+	if data.RecycleBackoff == 0 {
+		data.RecycleBackoff = DefaultRecycleBackoff
+	}
+	switch data.RecyclePolicy {
+	case "":
+		data.RecyclePolicy = DefaultRecyclePolicy
+	case keypool.RecycleKeep, keypool.RecycleTopUp:
+	default:
+		v.fail("recycle-policy", "%s or %s expected: %s", keypool.RecycleKeep, keypool.RecycleTopUp, data.RecyclePolicy)
+	}
+	// zero means always discard
+	if data.TopUpLimit == nil {
+		limit := DefaultTopUpLimit
+		data.TopUpLimit = &limit
+	}
+	if *data.TopUpLimit < 0 || *data.TopUpLimit > 100 {
+		v.fail("topup-limit", "must be between 0 and 100")
+	}
+	for _, rule := range data.RecycleRules {
+		if !slices.Contains(charger.Rules, rule) {
+			v.fail("recycle-rules", "one of %s expected: %s", strings.Join(charger.Rules, ", "), rule)
+		}
+	}
+	switch data.DirtyKeys {
+	case "":
+		data.DirtyKeys = DefaultDirtyKeys
+	case keypool.DirtyDiscard, keypool.DirtyReset:
+	default:
+		v.fail("dirty-keys", "%s or %s expected: %s", keypool.DirtyDiscard, keypool.DirtyReset, data.DirtyKeys)
+	}
+	v.nonNegative("buffer-length", int64(data.BufferLength))
+	if data.BufferLength == 0 {
+		data.BufferLength = DefaultBufferLength
+	}
+	v.nonNegative("buffer-threshold", int64(data.BufferThreshold))
+	if data.BufferThreshold >= data.BufferLength {
+		v.fail("buffer-threshold", "must be less than buffer-length (%d)", data.BufferLength)
+	}
+
+	envPrefix := strings.ToUpper(name)
+	var pass []byte
+	passphrase := func() ([]byte, error) {
+		if pass == nil {
+			var err error
+			if pass, err = getPassphrase(name, envPrefix+"_PASSPHRASE", data.PassphraseFile); err != nil {
+				return nil, err
+			}
+		}
+		return pass, nil
+	}
+
+	var (
+		funder    teztool.Signer
+		funderPKH tz.PublicKeyHash
+	)
+	if data.FunderSigner != nil {
+		if data.PrivateKey != "" || data.PrivateKeyFile != "" {
+			v.fail("funder-signer", "private-key and funder-signer are mutually exclusive")
+		}
+		v.httpURL("funder-signer", data.FunderSigner.URL)
+		if pkh, err := b58.ParsePublicKeyHash([]byte(data.FunderSigner.PKH)); err != nil {
+			v.fail("funder-signer", "pkh: %v", err)
+		} else {
+			funderPKH = pkh
+			funder = &charger.RemoteSigner{URL: data.FunderSigner.URL, PKH: pkh}
+		}
+	} else if privData := v.secret(envPrefix+"_PRIVATE_KEY", data.PrivateKey, data.PrivateKeyFile, "private-key"); privData != nil {
+		if priv, err := parsePrivateKey(privData, passphrase); err != nil {
+			v.error("private-key", err)
+		} else {
+			funderPKH = priv.Public().Hash()
+			funder = teztool.NewLocalSigner(priv)
+		}
+	}
+
+	var seed charger.Seed
+	if seedData := v.secret(envPrefix+"_SEED", data.Seed, data.SeedFile, "seed"); seedData != nil {
+		var err error
+		if utils.IsEncrypted(seedData) {
+			var p []byte
+			if p, err = passphrase(); err == nil {
+				seedData, err = utils.Decrypt(seedData, p)
+			}
+		}
+		if err == nil {
+			seed, err = DecodeSeed(seedData)
+		}
+		if err != nil {
+			v.error("seed", err)
+		}
+	}
+
+	return &NetworkConfig{
+		networkConfig: data,
+		name:          name,
+		seed:          seed,
+		funder:        funder,
+		funderPKH:     funderPKH,
+	}
+}
+
+// DecodeSeed decodes the hex encoded seed and checks its length
+func DecodeSeed(data []byte) (charger.Seed, error) {
+	if len(data)%2 != 0 {
+		return nil, fmt.Errorf("hex string of even length expected, got %d characters", len(data))
+	}
+	seed := make([]byte, hex.DecodedLen(len(data)))
+	if _, err := hex.Decode(seed, data); err != nil {
+		return nil, fmt.Errorf("invalid hex string: %w", err)
+	}
+	if len(seed) < minSeedLength || len(seed) > maxSeedLength {
+		return nil, fmt.Errorf("must be %d to %d bytes long, got %d", minSeedLength, maxSeedLength, len(seed))
+	}
+	return seed, nil
+}
+
+// encryptedKeyPrefixes are Base58 prefixes of passphrase encrypted Tezos keys
+var encryptedKeyPrefixes = []string{"edesk", "spesk", "p2esk", "BLesk"}
+
+func parsePrivateKey(data []byte, passphrase func() ([]byte, error)) (crypt.PrivateKey, error) {
+	for _, prefix := range encryptedKeyPrefixes {
+		if bytes.HasPrefix(data, []byte(prefix)) {
+			enc, err := b58.ParseEncryptedPrivateKey(data)
+			if err != nil {
+				return nil, err
+			}
+			priv, err := enc.Decrypt(passphrase)
+			if err != nil {
+				return nil, err
+			}
+			return crypt.NewPrivateKey(priv)
+		}
+	}
+	return crypt.ParsePrivateKey(data)
+}
+
+// getPassphrase returns the value of the environment variable, the file contents or asks for it interactively
+func getPassphrase(network, env, file string) ([]byte, error) {
+	if x := os.Getenv(env); x != "" {
+		return []byte(x), nil
+	}
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		return bytes.TrimRight(data, "\r\n"), nil
+	}
+	if Prompt != nil {
+		return Prompt(network)
+	}
+	return nil, fmt.Errorf("passphrase is required, use passphrase-file or %s environment variable", env)
+}
+
+func (v *validator) server(s *ServerConfig) {
+	if _, err := s.Principals(); err != nil {
+		v.error("tokens", err)
+	}
+	if _, err := s.CertificatePrincipals(); err != nil {
+		v.error("certificates", err)
+	}
+	if _, err := s.RateLimits(); err != nil {
+		v.error("rate-limit", err)
+	}
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errNoNetworks = errors.New("no networks defined")
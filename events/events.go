@@ -0,0 +1,90 @@
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	Funded    = "funded"
+	Popped    = "popped"
+	Leased    = "leased"
+	Released  = "released"
+	Recycled  = "recycled"
+	Discarded = "discarded"
+	// Quarantined is published when a key is set aside after its recycling check kept failing
+	Quarantined = "quarantined"
+	// ToppedUp is published when a recycled key is put back after a top-up
+	ToppedUp = "topped_up"
+	// BatchInjected is published once a funding group is injected, with its operation hash
+	BatchInjected = "batch_injected"
+	// BatchConfirmed is published once the group is included and its keys are committed, followed
+	// by Funded for each new key
+	BatchConfirmed = "batch_confirmed"
+	// BatchFailed is published if the group can't be injected or isn't included. The operation
+	// hash is set if it was injected.
+	BatchFailed = "batch_failed"
+)
+
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// ID is the key index. Key indices start at 1.
+	ID     uint64 `json:"id,omitempty"`
+	PKH    string `json:"pkh,omitempty"`
+	OpHash string `json:"op_hash,omitempty"`
+	// Keys lists the key indices of a funding batch
+	Keys  []uint64 `json:"keys,omitempty"`
+	Error string   `json:"error,omitempty"`
+}
+
+// DefaultBuffer is the number of events a subscriber may lag behind
+const DefaultBuffer = 256
+
+// Bus fans events out to subscribers. A nil Bus discards events.
+type Bus struct {
+	mtx  sync.Mutex
+	subs map[chan *Event]struct{}
+}
+
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan *Event]struct{})}
+}
+
+// Publish never blocks. A subscriber whose buffer is full is dropped and its channel is closed,
+// so it can tell a gap in the stream from a quiet period.
+func (b *Bus) Publish(e *Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving events published from now on and a function
+// that unsubscribes and closes it
+func (b *Bus) Subscribe(buffer int) (<-chan *Event, func()) {
+	ch := make(chan *Event, buffer)
+	b.mtx.Lock()
+	b.subs[ch] = struct{}{}
+	b.mtx.Unlock()
+	return ch, func() {
+		b.mtx.Lock()
+		defer b.mtx.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBus(t *testing.T) {
+	var nilBus *events.Bus
+	nilBus.Publish(&events.Event{Type: events.Popped})
+
+	bus := events.NewBus()
+	a, unsubscribeA := bus.Subscribe(1)
+	b, unsubscribeB := bus.Subscribe(2)
+	defer unsubscribeB()
+
+	bus.Publish(&events.Event{Type: events.Popped, ID: 1})
+	e := <-a
+	assert.Equal(t, events.Popped, e.Type)
+	assert.False(t, e.Time.IsZero())
+
+	unsubscribeA()
+	_, ok := <-a
+	assert.False(t, ok)
+	// no double close
+	unsubscribeA()
+
+	// slow subscriber is dropped
+	bus.Publish(&events.Event{Type: events.Leased, ID: 2})
+	bus.Publish(&events.Event{Type: events.Released, ID: 2})
+	var got []string
+	for e := range b {
+		got = append(got, e.Type)
+	}
+	require.Equal(t, []string{events.Popped, events.Leased}, got)
+}
@@ -0,0 +1,52 @@
+package identity
+
+import (
+	"context"
+)
+
+const (
+	MethodToken = "token"
+	MethodCert  = "cert"
+	MethodIP    = "ip"
+)
+
+// Identity is the authenticated client on whose behalf a request is served
+type Identity struct {
+	Name   string
+	Method string
+}
+
+func (i *Identity) String() string {
+	return i.Method + ":" + i.Name
+}
+
+type idKey struct{}
+type slotKey struct{}
+
+type slot struct {
+	id *Identity
+}
+
+// WithSlot returns a context through which an outer handler can see the identity
+// attached by an inner one using NewContext
+func WithSlot(ctx context.Context) context.Context {
+	return context.WithValue(ctx, slotKey{}, &slot{})
+}
+
+func NewContext(ctx context.Context, id *Identity) context.Context {
+	if s, ok := ctx.Value(slotKey{}).(*slot); ok {
+		s.id = id
+	}
+	return context.WithValue(ctx, idKey{}, id)
+}
+
+// FromContext returns the identity attached to the context or nil
+func FromContext(ctx context.Context) *Identity {
+	if id, ok := ctx.Value(idKey{}).(*Identity); ok {
+		return id
+	}
+	if s, ok := ctx.Value(slotKey{}).(*slot); ok {
+		return s.id
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package keygenclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/b58"
+)
+
+// The server ignores the last path component of the key routes. It exists for
+// compatibility with the octez remote signer layout.
+const keyPlaceholder = "key"
+
+// Error is returned for any non-2xx response
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("keygen: %s (HTTP %d)", e.Message, e.StatusCode)
+	}
+	return fmt.Sprintf("keygen: HTTP %d", e.StatusCode)
+}
+
+var knownErrors = []error{
+	server.ErrUnknownNetwork,
+	server.ErrUnknownLease,
+	server.ErrQuotaExceeded,
+	server.ErrUnhealthy,
+	server.ErrNotQuarantined,
+}
+
+// Unwrap maps the error message back to one of the server's sentinel errors
+func (e *Error) Unwrap() error {
+	for _, err := range knownErrors {
+		if err.Error() == e.Message {
+			return err
+		}
+	}
+	return nil
+}
+
+type Client struct {
+	URL        string
+	HTTPClient *http.Client
+	// Token is sent as a bearer token if not empty
+	Token string
+}
+
+func (c *Client) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+func (c *Client) request(ctx context.Context, method string, body []byte, out any, path ...string) error {
+	return c.requestQuery(ctx, method, nil, body, out, path...)
+}
+
+func (c *Client) requestQuery(ctx context.Context, method string, query url.Values, body []byte, out any, path ...string) error {
+	res, err := c.do(ctx, method, query, body, path...)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// do returns the response if its status is 2xx
+func (c *Client) do(ctx context.Context, method string, query url.Values, body []byte, path ...string) (*http.Response, error) {
+	u, err := url.JoinPath(c.URL, path...)
+	if err != nil {
+		return nil, err
+	}
+	if len(query) != 0 {
+		u += "?" + query.Encode()
+	}
+	var rd io.Reader
+	if body != nil {
+		rd = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, rd)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode/100 != 2 {
+		defer res.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		// the body may be anything if the error didn't come from the server itself
+		_ = json.NewDecoder(res.Body).Decode(&e)
+		return nil, &Error{StatusCode: res.StatusCode, Message: e.Error}
+	}
+	return res, nil
+}
+
+// Pop takes a funded key from the pool for good
+func (c *Client) Pop(ctx context.Context, network string) (tz.PrivateKey, error) {
+	var res string
+	if err := c.request(ctx, http.MethodPost, nil, &res, network); err != nil {
+		return nil, err
+	}
+	return b58.ParsePrivateKey([]byte(res))
+}
+
+// Status returns the funder balance and the number of buffered keys
+func (c *Client) Status(ctx context.Context, network string) (*server.NetworkStatus, error) {
+	var res server.NetworkStatus
+	if err := c.request(ctx, http.MethodGet, nil, &res, network); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Lease takes a funded key from the pool until its lease time runs out. The secret key never leaves the server.
+func (c *Client) Lease(ctx context.Context, network string) (*server.Lease, error) {
+	var res struct {
+		ID  uint64 `json:"id"`
+		PKH string `json:"pkh"`
+	}
+	if err := c.request(ctx, http.MethodPost, nil, &res, network, "ephemeral"); err != nil {
+		return nil, err
+	}
+	pkh, err := b58.ParsePublicKeyHash([]byte(res.PKH))
+	if err != nil {
+		return nil, err
+	}
+	return &server.Lease{ID: res.ID, PKH: pkh}, nil
+}
+
+// Release returns a leased key before its lease time runs out
+func (c *Client) Release(ctx context.Context, network string, id uint64) error {
+	return c.request(ctx, http.MethodDelete, nil, nil, network, "ephemeral", strconv.FormatUint(id, 10))
+}
+
+func (c *Client) Pub(ctx context.Context, network string, id uint64) (tz.PublicKey, error) {
+	var res struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := c.request(ctx, http.MethodGet, nil, &res, network, "ephemeral", strconv.FormatUint(id, 10), "keys", keyPlaceholder); err != nil {
+		return nil, err
+	}
+	return b58.ParsePublicKey([]byte(res.PublicKey))
+}
+
+func (c *Client) Sign(ctx context.Context, network string, id uint64, message []byte) (tz.Signature, error) {
+	var res struct {
+		Signature string `json:"signature"`
+	}
+	if message == nil {
+		message = []byte{}
+	}
+	if err := c.request(ctx, http.MethodPost, message, &res, network, "ephemeral", strconv.FormatUint(id, 10), "keys", keyPlaceholder); err != nil {
+		return nil, err
+	}
+	return b58.ParseSignature([]byte(res.Signature))
+}
+
+// Audit returns the most recent audit log records matching query, oldest first. The server returns
+// at most server.DefaultAuditLimit records if query.Limit is 0.
+func (c *Client) Audit(ctx context.Context, network string, query *server.AuditQuery) ([]*server.AuditRecord, error) {
+	q := make(url.Values)
+	if !query.Since.IsZero() {
+		q.Set("since", query.Since.Format(time.RFC3339))
+	}
+	if query.Before != 0 {
+		q.Set("before", strconv.FormatUint(query.Before, 10))
+	}
+	if query.PKH != "" {
+		q.Set("pkh", query.PKH)
+	}
+	if query.Limit != 0 {
+		q.Set("limit", strconv.Itoa(query.Limit))
+	}
+	var res []*server.AuditRecord
+	if err := c.requestQuery(ctx, http.MethodGet, q, nil, &res, network, "audit"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// Export returns the portable state of the network's pool
+func (c *Client) Export(ctx context.Context, network string) (*server.PoolSnapshot, error) {
+	var res server.PoolSnapshot
+	if err := c.request(ctx, http.MethodGet, nil, &res, network, "export"); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Quarantine returns the keys set aside after their recycling check kept failing
+func (c *Client) Quarantine(ctx context.Context, network string) ([]*server.QuarantinedKey, error) {
+	var res []*server.QuarantinedKey
+	if err := c.request(ctx, http.MethodGet, nil, &res, network, "quarantine"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// ReleaseQuarantined hands the quarantined key back to recycling
+func (c *Client) ReleaseQuarantined(ctx context.Context, network string, id uint64) error {
+	return c.request(ctx, http.MethodPost, nil, nil, network, "quarantine", strconv.FormatUint(id, 10), "release")
+}
+
+// DiscardQuarantined drops the quarantined key for good
+func (c *Client) DiscardQuarantined(ctx context.Context, network string, id uint64) error {
+	return c.request(ctx, http.MethodDelete, nil, nil, network, "quarantine", strconv.FormatUint(id, 10))
+}
+
+// Events streams the network's events until ctx is cancelled or the server ends the stream. The channel
+// is closed in either case. The server ends the stream if the client falls behind, so a consumer that
+// must not miss events should reconnect and reconcile.
+func (c *Client) Events(ctx context.Context, network string) (<-chan *events.Event, error) {
+	res, err := c.do(ctx, http.MethodGet, nil, nil, network, "events")
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan *events.Event)
+	go func() {
+		defer close(ch)
+		defer res.Body.Close()
+		sc := bufio.NewScanner(res.Body)
+		for sc.Scan() {
+			// the event name is repeated in the payload
+			data, ok := strings.CutPrefix(sc.Text(), "data:")
+			if !ok {
+				continue
+			}
+			var e events.Event
+			if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &e); err != nil {
+				return
+			}
+			select {
+			case ch <- &e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
@@ -0,0 +1,278 @@
+package keygenclient_test
+
+import (
+	"context"
+	"io"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/keygenclient"
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/crypt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSeed = charger.Seed([]byte("0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"))
+
+type serviceMock struct {
+	next        uint64
+	leased      map[uint64]bool
+	quarantined map[uint64]bool
+}
+
+func (s *serviceMock) derive(network string, id uint64) (crypt.PrivateKey, error) {
+	if network != "test" {
+		return nil, server.ErrUnknownNetwork
+	}
+	return testSeed.Derive(id)
+}
+
+func (s *serviceMock) Pop(ctx context.Context, network string) (tz.PrivateKey, error) {
+	s.next++
+	priv, err := s.derive(network, s.next)
+	if err != nil {
+		return nil, err
+	}
+	return priv.ToProtocol(), nil
+}
+
+func (s *serviceMock) Status(ctx context.Context, network string) (*server.NetworkStatus, error) {
+	if network != "test" {
+		return nil, server.ErrUnknownNetwork
+	}
+	return &server.NetworkStatus{Balance: big.NewInt(1000), Count: 10}, nil
+}
+
+func (s *serviceMock) Lease(ctx context.Context, network string) (*server.Lease, error) {
+	s.next++
+	priv, err := s.derive(network, s.next)
+	if err != nil {
+		return nil, err
+	}
+	s.leased[s.next] = true
+	return &server.Lease{ID: s.next, PKH: priv.Public().Hash()}, nil
+}
+
+func (s *serviceMock) Release(ctx context.Context, network string, id uint64) error {
+	if network != "test" {
+		return server.ErrUnknownNetwork
+	}
+	if !s.leased[id] {
+		return server.ErrUnknownLease
+	}
+	delete(s.leased, id)
+	return nil
+}
+
+func (s *serviceMock) Pub(ctx context.Context, network string, id uint64) (tz.PublicKey, error) {
+	priv, err := s.derive(network, id)
+	if err != nil {
+		return nil, err
+	}
+	return priv.Public().ToProtocol(), nil
+}
+
+func (s *serviceMock) Sign(ctx context.Context, network string, id uint64, r io.Reader) (tz.Signature, error) {
+	priv, err := s.derive(network, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := priv.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+	return sig.ToProtocol(), nil
+}
+
+func (s *serviceMock) Audit(ctx context.Context, network string, q *server.AuditQuery) ([]*server.AuditRecord, error) {
+	if network != "test" {
+		return nil, server.ErrUnknownNetwork
+	}
+	return []*server.AuditRecord{{Seq: q.Before - 1, Time: q.Since, Op: "pop", ID: 1, PKH: q.PKH}}, nil
+}
+
+func (s *serviceMock) Export(ctx context.Context, network string) (*server.PoolSnapshot, error) {
+	if network != "test" {
+		return nil, server.ErrUnknownNetwork
+	}
+	return &server.PoolSnapshot{Sequence: 2, Queue: []uint64{2}, Leases: []*server.SnapshotLease{}}, nil
+}
+
+func (s *serviceMock) Quarantine(ctx context.Context, network string) ([]*server.QuarantinedKey, error) {
+	var out []*server.QuarantinedKey
+	for id := range s.quarantined {
+		priv, err := s.derive(network, id)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &server.QuarantinedKey{ID: id, PKH: priv.Public().Hash().String(), Failures: 5, Error: "rpc"})
+	}
+	return out, nil
+}
+
+func (s *serviceMock) unquarantine(network string, id uint64) error {
+	if network != "test" {
+		return server.ErrUnknownNetwork
+	}
+	if !s.quarantined[id] {
+		return server.ErrNotQuarantined
+	}
+	delete(s.quarantined, id)
+	return nil
+}
+
+func (s *serviceMock) ReleaseQuarantined(ctx context.Context, network string, id uint64) error {
+	return s.unquarantine(network, id)
+}
+
+func (s *serviceMock) DiscardQuarantined(ctx context.Context, network string, id uint64) error {
+	return s.unquarantine(network, id)
+}
+
+func (s *serviceMock) Events(ctx context.Context, network string) (<-chan *events.Event, func(), error) {
+	if network != "test" {
+		return nil, nil, server.ErrUnknownNetwork
+	}
+	ch := make(chan *events.Event, 2)
+	ch <- &events.Event{Type: events.Popped, ID: 1, PKH: "tz1"}
+	ch <- &events.Event{Type: events.BatchConfirmed, Keys: []uint64{2, 3}, OpHash: "op"}
+	close(ch)
+	return ch, func() {}, nil
+}
+
+func newTestClient(t *testing.T) *keygenclient.Client {
+	srv := server.Server{Service: &serviceMock{
+		leased:      make(map[uint64]bool),
+		quarantined: map[uint64]bool{7: true, 8: true},
+	}}
+	ts := httptest.NewServer(srv.Router())
+	t.Cleanup(ts.Close)
+	return &keygenclient.Client{URL: ts.URL}
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	status, err := c.Status(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, 10, status.Count)
+	assert.Equal(t, big.NewInt(1000), status.Balance)
+
+	priv, err := c.Pop(ctx, "test")
+	require.NoError(t, err)
+	expect, err := testSeed.Derive(1)
+	require.NoError(t, err)
+	assert.Equal(t, expect.ToProtocol(), priv)
+
+	lease, err := c.Lease(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), lease.ID)
+
+	pub, err := c.Pub(ctx, "test", lease.ID)
+	require.NoError(t, err)
+	assert.Equal(t, lease.PKH, pub.Hash())
+
+	message := []byte("message")
+	sig, err := c.Sign(ctx, "test", lease.ID, message)
+	require.NoError(t, err)
+	cpub, err := crypt.NewPublicKey(pub)
+	require.NoError(t, err)
+	csig, err := crypt.NewSignature(sig)
+	require.NoError(t, err)
+	assert.True(t, cpub.VerifySignature(csig, message))
+
+	require.NoError(t, c.Release(ctx, "test", lease.ID))
+
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	records, err := c.Audit(ctx, "test", &server.AuditQuery{Since: since, Before: 10, PKH: lease.PKH.String()})
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.True(t, since.Equal(records[0].Time))
+	assert.Equal(t, lease.PKH.String(), records[0].PKH)
+	assert.Equal(t, uint64(9), records[0].Seq)
+
+	_, err = c.Audit(ctx, "test", &server.AuditQuery{Limit: server.MaxAuditLimit + 1})
+	assert.Error(t, err)
+
+	snapshot, err := c.Export(ctx, "test")
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2}, snapshot.Queue)
+}
+
+func TestQuarantine(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	keys, err := c.Quarantine(ctx, "test")
+	require.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	require.NoError(t, c.ReleaseQuarantined(ctx, "test", 7))
+	require.NoError(t, c.DiscardQuarantined(ctx, "test", 8))
+	assert.ErrorIs(t, c.DiscardQuarantined(ctx, "test", 8), server.ErrNotQuarantined)
+
+	keys, err = c.Quarantine(ctx, "test")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+}
+
+func TestEvents(t *testing.T) {
+	c := newTestClient(t)
+	ch, err := c.Events(context.Background(), "test")
+	require.NoError(t, err)
+	var got []*events.Event
+	for e := range ch {
+		got = append(got, e)
+	}
+	require.Len(t, got, 2)
+	assert.Equal(t, events.Popped, got[0].Type)
+	assert.Equal(t, uint64(1), got[0].ID)
+	assert.Equal(t, []uint64{2, 3}, got[1].Keys)
+	assert.Equal(t, "op", got[1].OpHash)
+
+	_, err = c.Events(context.Background(), "unknown")
+	assert.ErrorIs(t, err, server.ErrUnknownNetwork)
+}
+
+func TestClientErrors(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	_, err := c.Pop(ctx, "unknown")
+	assert.ErrorIs(t, err, server.ErrUnknownNetwork)
+	var e *keygenclient.Error
+	require.ErrorAs(t, err, &e)
+	assert.Equal(t, 404, e.StatusCode)
+
+	err = c.Release(ctx, "test", 100)
+	assert.ErrorIs(t, err, server.ErrUnknownLease)
+}
+
+func TestSigner(t *testing.T) {
+	ctx := context.Background()
+	c := newTestClient(t)
+
+	signer, err := c.NewSigner(ctx, "test")
+	require.NoError(t, err)
+	pub, err := signer.PublicKey(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, signer.Lease.PKH, pub.Hash())
+
+	message := []byte("message")
+	sig, err := signer.Sign(ctx, message)
+	require.NoError(t, err)
+	assert.True(t, pub.VerifySignature(sig, message))
+
+	require.NoError(t, signer.Release(ctx))
+}
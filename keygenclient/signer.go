@@ -0,0 +1,59 @@
+package keygenclient
+
+import (
+	"context"
+
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	"github.com/ecadlabs/gotez/v2/crypt"
+	"github.com/ecadlabs/gotez/v2/teztool"
+)
+
+// Signer signs with a leased key through the keygen server
+type Signer struct {
+	Client  *Client
+	Network string
+	Lease   *server.Lease
+	pub     crypt.PublicKey
+}
+
+var _ teztool.Signer = (*Signer)(nil)
+
+// NewSigner leases a new key and returns a signer backed by it
+func (c *Client) NewSigner(ctx context.Context, network string) (*Signer, error) {
+	lease, err := c.Lease(ctx, network)
+	if err != nil {
+		return nil, err
+	}
+	return &Signer{
+		Client:  c,
+		Network: network,
+		Lease:   lease,
+	}, nil
+}
+
+func (s *Signer) Sign(ctx context.Context, message []byte) (crypt.Signature, error) {
+	sig, err := s.Client.Sign(ctx, s.Network, s.Lease.ID, message)
+	if err != nil {
+		return nil, err
+	}
+	return crypt.NewSignature(sig)
+}
+
+func (s *Signer) PublicKey(ctx context.Context) (crypt.PublicKey, error) {
+	if s.pub != nil {
+		return s.pub, nil
+	}
+	pub, err := s.Client.Pub(ctx, s.Network, s.Lease.ID)
+	if err != nil {
+		return nil, err
+	}
+	if s.pub, err = crypt.NewPublicKey(pub); err != nil {
+		return nil, err
+	}
+	return s.pub, nil
+}
+
+// Release returns the leased key to the server
+func (s *Signer) Release(ctx context.Context) error {
+	return s.Client.Release(ctx, s.Network, s.Lease.ID)
+}
@@ -0,0 +1,136 @@
+package keypool
+
+import (
+	"context"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+	"github.com/ecadlabs/go-tezos-keygen/requestid"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	AuditPop     = "pop"
+	AuditLease   = "lease"
+	AuditRelease = "release"
+	AuditRecycle = "recycle"
+	AuditDiscard = "discard"
+	AuditSign    = "sign"
+	// AuditCancel records a key put back because the caller had gone before it was handed over
+	AuditCancel = "cancel"
+	// AuditQuarantine records a leased key set aside after its recycling check kept failing
+	AuditQuarantine = "quarantine"
+	// AuditTopUp records a key put back after its balance was topped up to the funding amount
+	AuditTopUp = "topup"
+	// AuditDrop and AuditExpire record offline changes made with the pool and lease commands
+	AuditDrop   = "drop"
+	AuditExpire = "expire"
+)
+
+type AuditRecord struct {
+	// ID is assigned by the store in the order the records are appended
+	ID        uint64
+	Time      time.Time
+	Op        string
+	KeyIndex  uint64
+	PKH       string
+	Identity  string
+	RequestID string
+}
+
+// AuditQuery selects audit log records. The most recent matching records are returned, so older
+// ones are read page by page by passing the ID of the oldest record received as Before.
+type AuditQuery struct {
+	// Since skips records older than this time
+	Since time.Time
+	// Before skips the record with this ID and the ones appended after it. 0 means none.
+	Before uint64
+	// PKH returns records of this key only if not empty
+	PKH string
+	// Limit is the largest number of records returned. 0 means no limit.
+	Limit int
+}
+
+func (q *AuditQuery) match(pkh string) bool {
+	return q.PKH == "" || q.PKH == pkh
+}
+
+// actor is the client on whose behalf an operation is performed
+type actor struct {
+	identity  string
+	requestID string
+}
+
+func actorFromContext(ctx context.Context) actor {
+	var a actor
+	if id := identity.FromContext(ctx); id != nil {
+		a.identity = id.String()
+	}
+	a.requestID = requestid.FromContext(ctx)
+	return a
+}
+
+// audit appends a record, old ones are pruned by pruner
+func (p *Pool) audit(tx Tx, op string, keyIndex uint64, a actor) error {
+	return tx.AppendAudit(&AuditRecord{
+		Time:      time.Now(),
+		Op:        op,
+		KeyIndex:  keyIndex,
+		PKH:       p.charger.Hash(keyIndex),
+		Identity:  a.identity,
+		RequestID: a.requestID,
+	})
+}
+
+// pruneInterval is the longest time between two prunes of the audit log
+const pruneInterval = time.Hour
+
+// pruner deletes audit records older than the retention period. It checks the configuration on each
+// tick, so the retention can be changed on reload.
+func (p *Pool) pruner() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(pruneDelay(p.cfg().GetAuditRetention()))
+	defer ticker.Stop()
+	for {
+		retention := p.cfg().GetAuditRetention()
+		if retention != 0 {
+			err := p.update(func(tx Tx) error {
+				return tx.PruneAudit(time.Now().Add(-retention))
+			})
+			if err != nil && p.ctx.Err() == nil {
+				log.Error(err)
+			}
+		}
+		ticker.Reset(pruneDelay(retention))
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// pruneDelay keeps records at most a tenth of the retention period longer than configured
+func pruneDelay(retention time.Duration) time.Duration {
+	if d := retention / 10; d > 0 && d < pruneInterval {
+		return d
+	}
+	return pruneInterval
+}
+
+// Audit records an operation performed on the key outside of the pool, e.g. signing
+func (p *Pool) Audit(ctx context.Context, op string, keyIndex uint64) error {
+	return p.update(func(tx Tx) error {
+		return p.audit(tx, op, keyIndex, actorFromContext(ctx))
+	})
+}
+
+// AuditLog returns the most recent records matching q, oldest first
+func (p *Pool) AuditLog(q *AuditQuery) ([]*AuditRecord, error) {
+	var records []*AuditRecord
+	err := p.view(func(tx Tx) (err error) {
+		records, err = tx.AuditLog(q)
+		return
+	})
+	return records, err
+}
@@ -0,0 +1,482 @@
+package keypool
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	poolBucket  = []byte("keys")
+	leaseBucket = []byte("lease")
+	// deadlineBucket indexes leases by deadline, see deadlineKey. Values are empty.
+	deadlineBucket   = []byte("deadline")
+	quarantineBucket = []byte("quarantine")
+	quotaBucket      = []byte("quota")
+	auditBucket      = []byte("audit")
+	archiveBucket    = []byte("archive")
+	chainKey         = []byte("chain")
+	// queueLenKey holds the number of keys in the queue, so Len doesn't walk it
+	queueLenKey = []byte("queue-length")
+)
+
+// BoltStore keeps each pool in a bucket named after it. Pools are migrated to the current schema on Init.
+type BoltStore struct {
+	db         *bolt.DB
+	mtx        sync.Mutex
+	backupFile string
+}
+
+func NewBoltStore(db *bolt.DB) *BoltStore {
+	return &BoltStore{db: db}
+}
+
+func (s *BoltStore) Init(pool string) error {
+	if _, err := s.Migrate(pool, false); err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(pool))
+		if root == nil {
+			var err error
+			if root, err = tx.CreateBucket([]byte(pool)); err != nil {
+				return err
+			}
+			if err := setSchemaVersion(root, SchemaVersion); err != nil {
+				return err
+			}
+		}
+		for _, name := range [][]byte{poolBucket, leaseBucket, deadlineBucket, quarantineBucket, quotaBucket, auditBucket} {
+			if _, err := root.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltRoot(tx *bolt.Tx, pool string) (*boltTx, error) {
+	root := tx.Bucket([]byte(pool))
+	if root == nil {
+		return nil, fmt.Errorf("%s: %w", pool, ErrNoPool)
+	}
+	// a layout this build can't read or hasn't upgraded yet
+	if v, err := schemaVersion(root); err != nil {
+		return nil, err
+	} else if v != SchemaVersion {
+		return nil, fmt.Errorf("%s: schema version is %d, expected %d", pool, v, SchemaVersion)
+	}
+	return &boltTx{root: root}, nil
+}
+
+func (s *BoltStore) View(pool string, fn func(tx Tx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		t, err := boltRoot(tx, pool)
+		if err != nil {
+			return err
+		}
+		return fn(t)
+	})
+}
+
+func (s *BoltStore) Update(pool string, fn func(tx Tx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		t, err := boltRoot(tx, pool)
+		if err != nil {
+			return err
+		}
+		return fn(t)
+	})
+}
+
+type boltTx struct {
+	root *bolt.Bucket
+}
+
+func (t *boltTx) bucket(name []byte) *bucket {
+	return &bucket{t.root.Bucket(name)}
+}
+
+func (t *boltTx) Push(index uint64) error {
+	b := t.bucket(poolBucket)
+	// positions are only used for ordering
+	var pos uint64
+	c := b.Cursor()
+	if err := c.Last(&pos, new(uint64)); err != nil && err != errEOF {
+		return err
+	}
+	if err := b.Put(pos+1, &index); err != nil {
+		return err
+	}
+	return t.addLen(1)
+}
+
+func (t *boltTx) Pop() (uint64, bool, error) {
+	c := t.bucket(poolBucket).Cursor()
+	var pos, index uint64
+	if err := c.First(&pos, &index); err != nil {
+		if err == errEOF {
+			return 0, false, nil
+		}
+		return 0, false, err
+	}
+	if err := c.Delete(); err != nil {
+		return 0, false, err
+	}
+	return index, true, t.addLen(-1)
+}
+
+func (t *boltTx) Remove(index uint64) (bool, error) {
+	c := t.bucket(poolBucket).Cursor()
+	var (
+		pos, v uint64
+		err    error
+	)
+	for err = c.First(&pos, &v); err == nil; err = c.Next(&pos, &v) {
+		if v == index {
+			if err := c.Delete(); err != nil {
+				return false, err
+			}
+			return true, t.addLen(-1)
+		}
+	}
+	if err != errEOF {
+		return false, err
+	}
+	return false, nil
+}
+
+func (t *boltTx) Len() (int, error) {
+	v := t.root.Get(queueLenKey)
+	if v == nil {
+		return 0, nil
+	}
+	n, err := decodeKey(v)
+	return int(n), err
+}
+
+func (t *boltTx) addLen(delta int) error {
+	n, err := t.Len()
+	if err != nil {
+		return err
+	}
+	return t.root.Put(queueLenKey, encodeKey(uint64(n+delta)))
+}
+
+func (t *boltTx) Queue() ([]uint64, error) {
+	c := t.bucket(poolBucket).Cursor()
+	var (
+		out        []uint64
+		pos, index uint64
+		err        error
+	)
+	for err = c.First(&pos, &index); err == nil; err = c.Next(&pos, &index) {
+		out = append(out, index)
+	}
+	if err != errEOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (t *boltTx) NextSequence() (uint64, error) {
+	return t.root.Bucket(poolBucket).NextSequence()
+}
+
+func (t *boltTx) Sequence() (uint64, error) {
+	return t.root.Bucket(poolBucket).Sequence(), nil
+}
+
+func (t *boltTx) SetSequence(seq uint64) error {
+	return t.root.Bucket(poolBucket).SetSequence(seq)
+}
+
+func (t *boltTx) PutLease(l *Lease) error {
+	if err := t.DeleteLease(l.KeyIndex); err != nil {
+		return err
+	}
+	if err := t.bucket(leaseBucket).Put(l.KeyIndex, newLeaseRecord(l)); err != nil {
+		return err
+	}
+	return t.root.Bucket(deadlineBucket).Put(deadlineKey(l.Deadline, l.KeyIndex), []byte{})
+}
+
+func (t *boltTx) GetLease(index uint64) (*Lease, error) {
+	var r leaseRecord
+	ok, err := t.bucket(leaseBucket).Get(index, &r)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return r.lease(), nil
+}
+
+func (t *boltTx) DeleteLease(index uint64) error {
+	l, err := t.GetLease(index)
+	if l == nil || err != nil {
+		return err
+	}
+	if err := t.root.Bucket(deadlineBucket).Delete(deadlineKey(l.Deadline, index)); err != nil {
+		return err
+	}
+	return t.bucket(leaseBucket).Delete(index)
+}
+
+func (t *boltTx) Leases() ([]*Lease, error) {
+	c := t.bucket(leaseBucket).Cursor()
+	var (
+		out []*Lease
+		k   uint64
+		err error
+	)
+	for {
+		var v leaseRecord
+		if len(out) == 0 {
+			err = c.First(&k, &v)
+		} else {
+			err = c.Next(&k, &v)
+		}
+		if err != nil {
+			break
+		}
+		out = append(out, v.lease())
+	}
+	if err != errEOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (t *boltTx) NextDeadline() (time.Time, bool, error) {
+	k, _ := t.root.Bucket(deadlineBucket).Cursor().First()
+	if k == nil {
+		return time.Time{}, false, nil
+	}
+	deadline, _, err := decodeDeadlineKey(k)
+	return deadline, err == nil, err
+}
+
+func (t *boltTx) ExpiredLeases(now time.Time) ([]*Lease, error) {
+	var out []*Lease
+	c := t.root.Bucket(deadlineBucket).Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		deadline, index, err := decodeDeadlineKey(k)
+		if err != nil {
+			return nil, err
+		}
+		if deadline.After(now) {
+			break
+		}
+		out = append(out, &Lease{KeyIndex: index, Deadline: deadline})
+	}
+	return out, nil
+}
+
+func (t *boltTx) PutQuarantined(q *Quarantined) error {
+	return t.bucket(quarantineBucket).Put(q.KeyIndex, newQuarantineRecord(q))
+}
+
+func (t *boltTx) GetQuarantined(index uint64) (*Quarantined, error) {
+	var r quarantineRecord
+	ok, err := t.bucket(quarantineBucket).Get(index, &r)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return r.quarantined(), nil
+}
+
+func (t *boltTx) DeleteQuarantined(index uint64) error {
+	return t.bucket(quarantineBucket).Delete(index)
+}
+
+func (t *boltTx) QuarantinedKeys() ([]*Quarantined, error) {
+	c := t.bucket(quarantineBucket).Cursor()
+	var (
+		out []*Quarantined
+		k   uint64
+		err error
+	)
+	for {
+		var v quarantineRecord
+		if len(out) == 0 {
+			err = c.First(&k, &v)
+		} else {
+			err = c.Next(&k, &v)
+		}
+		if err != nil {
+			break
+		}
+		out = append(out, v.quarantined())
+	}
+	if err != errEOF {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (t *boltTx) AppendAudit(r *AuditRecord) error {
+	b := t.bucket(auditBucket)
+	k, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+	return b.Put(k, newAuditRecord(r))
+}
+
+func (t *boltTx) PruneAudit(before time.Time) error {
+	c := t.bucket(auditBucket).Cursor()
+	var (
+		k   uint64
+		v   auditRecord
+		err error
+	)
+	for err = c.First(&k, &v); err == nil && v.Time.Before(before); err = c.First(&k, &v) {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	if err != nil && err != errEOF {
+		return err
+	}
+	return nil
+}
+
+func (t *boltTx) AuditLog(q *AuditQuery) ([]*AuditRecord, error) {
+	c := t.bucket(auditBucket).Cursor()
+	var (
+		out []*AuditRecord
+		k   uint64
+		v   auditRecord
+		err error
+	)
+	if q.Before != 0 {
+		err = c.Before(q.Before, &k, &v)
+	} else {
+		err = c.Last(&k, &v)
+	}
+	// records are in chronological order
+	for ; err == nil && !v.Time.Before(q.Since); err = c.Prev(&k, &v) {
+		if q.match(v.PKH) {
+			r := v.record()
+			r.ID = k
+			if out = append(out, r); len(out) == q.Limit {
+				break
+			}
+		}
+		// omitted fields must not carry over from the previous record
+		v = auditRecord{}
+	}
+	if err != nil && err != errEOF {
+		return nil, err
+	}
+	// oldest first
+	slices.Reverse(out)
+	return out, nil
+}
+
+func quotaKey(day, client string) []byte {
+	return []byte(day + "/" + client)
+}
+
+func (t *boltTx) GetQuotaUsage(day, client string) (*QuotaUsage, error) {
+	v := t.root.Bucket(quotaBucket).Get(quotaKey(day, client))
+	if v == nil {
+		return nil, nil
+	}
+	var r quotaRecord
+	if err := decodeValue(v, &r); err != nil {
+		return nil, err
+	}
+	return r.usage()
+}
+
+func (t *boltTx) PutQuotaUsage(day, client string, u *QuotaUsage) error {
+	v, err := encodeValue(newQuotaRecord(u))
+	if err != nil {
+		return err
+	}
+	return t.root.Bucket(quotaBucket).Put(quotaKey(day, client), v)
+}
+
+func (t *boltTx) PruneQuota(day string) error {
+	c := t.root.Bucket(quotaBucket).Cursor()
+	for k, _ := c.First(); k != nil && bytes.Compare(k, []byte(day)) < 0; k, _ = c.First() {
+		if err := c.Delete(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *boltTx) Chain() (*ChainInfo, error) {
+	return getChain(t.root)
+}
+
+func (t *boltTx) SetChain(info *ChainInfo) error {
+	return putChain(t.root, info)
+}
+
+func getChain(b *bolt.Bucket) (*ChainInfo, error) {
+	v := b.Get(chainKey)
+	if v == nil {
+		return nil, nil
+	}
+	var r chainRecord
+	if err := decodeValue(v, &r); err != nil {
+		return nil, err
+	}
+	return &ChainInfo{ChainID: r.ChainID, Genesis: r.Genesis}, nil
+}
+
+func putChain(b *bolt.Bucket, info *ChainInfo) error {
+	v, err := encodeValue(&chainRecord{ChainID: info.ChainID, Genesis: info.Genesis})
+	if err != nil {
+		return err
+	}
+	return b.Put(chainKey, v)
+}
+
+func (t *boltTx) Archive(name string) error {
+	arch, err := t.root.CreateBucketIfNotExists(archiveBucket)
+	if err != nil {
+		return err
+	}
+	dst, err := arch.CreateBucket([]byte(name))
+	if err != nil {
+		return err
+	}
+	if info, err := getChain(t.root); err != nil {
+		return err
+	} else if info != nil {
+		if err := putChain(dst, info); err != nil {
+			return err
+		}
+	}
+	for _, name := range [][]byte{poolBucket, leaseBucket, deadlineBucket, quarantineBucket} {
+		src := t.root.Bucket(name)
+		b, err := dst.CreateBucket(name)
+		if err != nil {
+			return err
+		}
+		err = src.ForEach(func(k, v []byte) error {
+			// the source pages are freed below
+			return b.Put(bytes.Clone(k), bytes.Clone(v))
+		})
+		if err != nil {
+			return err
+		}
+		if err := b.SetSequence(src.Sequence()); err != nil {
+			return err
+		}
+		if err := t.root.DeleteBucket(name); err != nil {
+			return err
+		}
+		if _, err := t.root.CreateBucket(name); err != nil {
+			return err
+		}
+	}
+	return t.root.Delete(queueLenKey)
+}
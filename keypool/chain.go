@@ -0,0 +1,60 @@
+package keypool
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ChainInfo identifies the chain the pool's keys were funded on
+type ChainInfo struct {
+	ChainID string
+	Genesis string
+}
+
+// Chain returns the chain the pool is bound to or nil if it's not known yet
+func (p *Pool) Chain() (*ChainInfo, error) {
+	var info *ChainInfo
+	err := p.view(func(tx Tx) (err error) {
+		info, err = tx.Chain()
+		return
+	})
+	return info, err
+}
+
+// SetChain binds the pool to the chain. If it was bound to a different one, e.g. after a testnet reset,
+// buffered keys and leases are moved to the archive and the pool starts empty. With keepSequence the
+// derivation sequence is continued so keys are never reused across chains. Returns true if the pool was reset.
+func (p *Pool) SetChain(info *ChainInfo, keepSequence bool) (reset bool, err error) {
+	err = p.update(func(tx Tx) error {
+		old, err := tx.Chain()
+		if err != nil {
+			return err
+		}
+		if old != nil {
+			if *old == *info {
+				return nil
+			}
+			seq, err := tx.Sequence()
+			if err != nil {
+				return err
+			}
+			if err := tx.Archive(old.ChainID + "@" + time.Now().UTC().Format(time.RFC3339)); err != nil {
+				return err
+			}
+			if keepSequence {
+				if err := tx.SetSequence(seq); err != nil {
+					return err
+				}
+			}
+			log.WithFields(log.Fields{
+				"bucket":       p.cfg().GetBucket(),
+				"old_chain_id": old.ChainID,
+				"chain_id":     info.ChainID,
+			}).Warn("Chain has changed, the pool is archived")
+			reset = true
+		}
+		return tx.SetChain(info)
+	})
+	return reset, err
+}
@@ -1,40 +1,86 @@
 package keypool
 
 import (
-	"bytes"
 	"encoding/binary"
-	"encoding/gob"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// Keys are big-endian uint64 so that cursors iterate in numeric order, except for the lease deadline
+// index, see deadlineKey. Values are either big-endian uint64 or JSON encoded records with explicit field
+// names, see record.go. Changing the layout requires
+// a new schema version and a migration, see migrate.go.
+
+func encodeKey(k uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, k)
+}
+
+func decodeKey(k []byte) (uint64, error) {
+	if len(k) != 8 {
+		return 0, fmt.Errorf("invalid key length %d", len(k))
+	}
+	return binary.BigEndian.Uint64(k), nil
+}
+
+// deadlineKey orders the lease deadline index by time and then by the key index. Seconds are offset
+// so that times before the epoch sort first.
+func deadlineKey(deadline time.Time, index uint64) []byte {
+	k := binary.BigEndian.AppendUint64(nil, uint64(deadline.Unix())^1<<63)
+	k = binary.BigEndian.AppendUint32(k, uint32(deadline.Nanosecond()))
+	return binary.BigEndian.AppendUint64(k, index)
+}
+
+func decodeDeadlineKey(k []byte) (time.Time, uint64, error) {
+	if len(k) != 20 {
+		return time.Time{}, 0, fmt.Errorf("invalid deadline key length %d", len(k))
+	}
+	sec := int64(binary.BigEndian.Uint64(k) ^ 1<<63)
+	nsec := int64(binary.BigEndian.Uint32(k[8:]))
+	return time.Unix(sec, nsec), binary.BigEndian.Uint64(k[12:]), nil
+}
+
+func encodeValue(value any) ([]byte, error) {
+	if v, ok := value.(*uint64); ok {
+		return encodeKey(*v), nil
+	}
+	return json.Marshal(value)
+}
+
+func decodeValue(data []byte, out any) error {
+	if v, ok := out.(*uint64); ok {
+		var err error
+		*v, err = decodeKey(data)
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
 type bucket struct {
 	*bolt.Bucket
 }
 
-func (b *bucket) Get(key any, out any) (bool, error) {
-	var k bytes.Buffer
-	if err := binary.Write(&k, binary.BigEndian, key); err != nil {
-		return false, err
-	}
-	v := b.Bucket.Get(k.Bytes())
+func (b *bucket) Get(key uint64, out any) (bool, error) {
+	v := b.Bucket.Get(encodeKey(key))
 	if v == nil {
 		return false, nil
 	}
-	return true, gob.NewDecoder(bytes.NewReader(v)).Decode(out)
+	return true, decodeValue(v, out)
 }
 
-func (b *bucket) Put(key, value any) error {
-	var k bytes.Buffer
-	if err := binary.Write(&k, binary.BigEndian, key); err != nil {
+func (b *bucket) Put(key uint64, value any) error {
+	v, err := encodeValue(value)
+	if err != nil {
 		return err
 	}
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(value); err != nil {
-		return err
-	}
-	return b.Bucket.Put(k.Bytes(), buf.Bytes())
+	return b.Bucket.Put(encodeKey(key), v)
+}
+
+func (b *bucket) Delete(key uint64) error {
+	return b.Bucket.Delete(encodeKey(key))
 }
 
 func (b *bucket) Cursor() *cursor {
@@ -47,24 +93,40 @@ type cursor struct {
 
 var errEOF = errors.New("EOF")
 
-func (c *cursor) First(key, val any) error {
-	k, v := c.Cursor.First()
+func decodePair(k, v []byte, key *uint64, val any) (err error) {
 	if k == nil {
 		return errEOF
 	}
-	if err := binary.Read(bytes.NewReader(k), binary.BigEndian, key); err != nil {
+	if *key, err = decodeKey(k); err != nil {
 		return err
 	}
-	return gob.NewDecoder(bytes.NewReader(v)).Decode(val)
+	return decodeValue(v, val)
 }
 
-func (c *cursor) Next(key, val any) error {
+func (c *cursor) First(key *uint64, val any) error {
+	k, v := c.Cursor.First()
+	return decodePair(k, v, key, val)
+}
+
+func (c *cursor) Next(key *uint64, val any) error {
 	k, v := c.Cursor.Next()
-	if k == nil {
-		return errEOF
-	}
-	if err := binary.Read(bytes.NewReader(k), binary.BigEndian, key); err != nil {
-		return err
+	return decodePair(k, v, key, val)
+}
+
+func (c *cursor) Last(key *uint64, val any) error {
+	k, v := c.Cursor.Last()
+	return decodePair(k, v, key, val)
+}
+
+func (c *cursor) Prev(key *uint64, val any) error {
+	k, v := c.Cursor.Prev()
+	return decodePair(k, v, key, val)
+}
+
+// Before positions the cursor at the last pair with the key less than seek
+func (c *cursor) Before(seek uint64, key *uint64, val any) error {
+	if k, _ := c.Cursor.Seek(encodeKey(seek)); k == nil {
+		return c.Last(key, val)
 	}
-	return gob.NewDecoder(bytes.NewReader(v)).Decode(val)
+	return c.Prev(key, val)
 }
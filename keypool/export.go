@@ -0,0 +1,199 @@
+package keypool
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrNotEmpty = errors.New("pool is not empty")
+
+// Snapshot is the portable state of a pool. Audit log and quota counters aren't included.
+type Snapshot struct {
+	Sequence uint64           `json:"sequence"`
+	Queue    []uint64         `json:"queue"`
+	Leases   []*SnapshotLease `json:"leases"`
+	// Quarantine was added later, so it's optional
+	Quarantine []*SnapshotQuarantined `json:"quarantine,omitempty"`
+	Chain      *SnapshotChain         `json:"chain,omitempty"`
+}
+
+type SnapshotLease struct {
+	KeyIndex uint64    `json:"id"`
+	Identity string    `json:"identity,omitempty"`
+	Deadline time.Time `json:"deadline"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type SnapshotQuarantined struct {
+	KeyIndex uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type SnapshotChain struct {
+	ChainID string `json:"chain_id"`
+	Genesis string `json:"genesis"`
+}
+
+func export(tx Tx) (*Snapshot, error) {
+	var (
+		s   Snapshot
+		err error
+	)
+	if s.Sequence, err = tx.Sequence(); err != nil {
+		return nil, err
+	}
+	if s.Queue, err = tx.Queue(); err != nil {
+		return nil, err
+	}
+	if s.Queue == nil {
+		s.Queue = []uint64{}
+	}
+	leases, err := tx.Leases()
+	if err != nil {
+		return nil, err
+	}
+	s.Leases = make([]*SnapshotLease, len(leases))
+	for i, l := range leases {
+		s.Leases[i] = &SnapshotLease{KeyIndex: l.KeyIndex, Identity: l.Identity, Deadline: l.Deadline, Failures: l.Failures, Error: l.Error}
+	}
+	quarantined, err := tx.QuarantinedKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, q := range quarantined {
+		s.Quarantine = append(s.Quarantine, &SnapshotQuarantined{KeyIndex: q.KeyIndex, Time: q.Time, Failures: q.Failures, Error: q.Error})
+	}
+	chain, err := tx.Chain()
+	if err != nil {
+		return nil, err
+	}
+	if chain != nil {
+		s.Chain = &SnapshotChain{ChainID: chain.ChainID, Genesis: chain.Genesis}
+	}
+	return &s, nil
+}
+
+// Export returns the pool's state as a single transaction
+func Export(store Store, pool string) (s *Snapshot, err error) {
+	err = store.View(pool, func(tx Tx) error {
+		s, err = export(tx)
+		return err
+	})
+	return
+}
+
+// Validate checks that every key index is within the sequence and is either queued, leased or
+// quarantined, not several of them
+func (s *Snapshot) Validate() error {
+	seen := make(map[uint64]string)
+	check := func(state string, index uint64) error {
+		if index > s.Sequence {
+			return fmt.Errorf("%s key %d is beyond the sequence %d", state, index, s.Sequence)
+		}
+		if prev, ok := seen[index]; ok {
+			if prev == state {
+				return fmt.Errorf("%s key %d is listed twice", state, index)
+			}
+			return fmt.Errorf("%s key %d is %s too", state, index, prev)
+		}
+		seen[index] = state
+		return nil
+	}
+	for _, index := range s.Queue {
+		if err := check("queued", index); err != nil {
+			return err
+		}
+	}
+	for _, l := range s.Leases {
+		if err := check("leased", l.KeyIndex); err != nil {
+			return err
+		}
+	}
+	for _, q := range s.Quarantine {
+		if err := check("quarantined", q.KeyIndex); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkEmpty(tx Tx) error {
+	n, err := tx.Len()
+	if err != nil {
+		return err
+	}
+	seq, err := tx.Sequence()
+	if err != nil {
+		return err
+	}
+	leases, err := tx.Leases()
+	if err != nil {
+		return err
+	}
+	quarantined, err := tx.QuarantinedKeys()
+	if err != nil {
+		return err
+	}
+	if n != 0 || seq != 0 || len(leases) != 0 || len(quarantined) != 0 {
+		return ErrNotEmpty
+	}
+	return nil
+}
+
+// CheckImport returns the error Import would fail with, if any, without writing anything
+func CheckImport(store Store, pool string, s *Snapshot) error {
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", pool, err)
+	}
+	err := store.View(pool, checkEmpty)
+	if err != nil && !errors.Is(err, ErrNoPool) {
+		return fmt.Errorf("%s: %w", pool, err)
+	}
+	return nil
+}
+
+// Import restores the state into the pool. The pool is created if necessary but must be empty.
+func Import(store Store, pool string, s *Snapshot) error {
+	if err := s.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", pool, err)
+	}
+	if err := store.Init(pool); err != nil {
+		return err
+	}
+	return store.Update(pool, func(tx Tx) error {
+		if err := checkEmpty(tx); err != nil {
+			return fmt.Errorf("%s: %w", pool, err)
+		}
+		for _, index := range s.Queue {
+			if err := tx.Push(index); err != nil {
+				return err
+			}
+		}
+		for _, l := range s.Leases {
+			if err := tx.PutLease(&Lease{KeyIndex: l.KeyIndex, Identity: l.Identity, Deadline: l.Deadline, Failures: l.Failures, Error: l.Error}); err != nil {
+				return err
+			}
+		}
+		for _, q := range s.Quarantine {
+			if err := tx.PutQuarantined(&Quarantined{KeyIndex: q.KeyIndex, Time: q.Time, Failures: q.Failures, Error: q.Error}); err != nil {
+				return err
+			}
+		}
+		if err := tx.SetSequence(s.Sequence); err != nil {
+			return err
+		}
+		if s.Chain != nil {
+			return tx.SetChain(&ChainInfo{ChainID: s.Chain.ChainID, Genesis: s.Chain.Genesis})
+		}
+		return nil
+	})
+}
+
+// Export returns the state of the running pool
+func (p *Pool) Export() (*Snapshot, error) {
+	return Export(p.store, p.cfg().GetBucket())
+}
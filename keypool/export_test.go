@@ -0,0 +1,125 @@
+package keypool_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImport(t *testing.T) {
+	src := newBoltStore(t)
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2, 3, 4}).Return(nil)
+
+	pool, err := keypool.New(src, &config{
+		bucket:       "test",
+		bufferLength: 4,
+	}, &charger, nil)
+	require.NoError(t, err)
+	_, err = pool.SetChain(&keypool.ChainInfo{ChainID: "A", Genesis: "a"}, false)
+	require.NoError(t, err)
+	_, err = pool.Get(context.Background())
+	require.NoError(t, err)
+	_, err = pool.Lease(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+
+	snapshot, err := pool.Export()
+	require.NoError(t, err)
+	require.NoError(t, pool.Stop(context.Background()))
+	assert.Equal(t, uint64(4), snapshot.Sequence)
+	assert.Equal(t, []uint64{3, 4}, snapshot.Queue)
+	require.Len(t, snapshot.Leases, 1)
+	assert.Equal(t, uint64(2), snapshot.Leases[0].KeyIndex)
+
+	exported, err := json.Marshal(snapshot)
+	require.NoError(t, err)
+
+	forEachStore(t, func(t *testing.T, dst keypool.Store) {
+		var s keypool.Snapshot
+		require.NoError(t, json.Unmarshal(exported, &s))
+		require.NoError(t, keypool.Import(dst, "test", &s))
+
+		// lossless
+		out, err := keypool.Export(dst, "test")
+		require.NoError(t, err)
+		imported, err := json.Marshal(out)
+		require.NoError(t, err)
+		assert.JSONEq(t, string(exported), string(imported))
+
+		require.ErrorIs(t, keypool.Import(dst, "test", &s), keypool.ErrNotEmpty)
+
+		// no refunding
+		pool, err := keypool.New(dst, &config{
+			bucket:       "test",
+			bufferLength: 4,
+		}, &ChargerMock{}, nil)
+		require.NoError(t, err)
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), idx)
+		require.NoError(t, pool.Stop(context.Background()))
+	})
+
+	charger.AssertExpectations(t)
+}
+
+func TestImportInvalid(t *testing.T) {
+	deadline := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		snapshot keypool.Snapshot
+		err      string
+	}{
+		{
+			name:     "beyond sequence",
+			snapshot: keypool.Snapshot{Sequence: 2, Queue: []uint64{1, 3}},
+			err:      "queued key 3 is beyond the sequence 2",
+		},
+		{
+			name:     "queued twice",
+			snapshot: keypool.Snapshot{Sequence: 2, Queue: []uint64{1, 2, 1}},
+			err:      "queued key 1 is listed twice",
+		},
+		{
+			name: "queued and leased",
+			snapshot: keypool.Snapshot{
+				Sequence: 2,
+				Queue:    []uint64{1, 2},
+				Leases:   []*keypool.SnapshotLease{{KeyIndex: 2, Deadline: deadline}},
+			},
+			err: "leased key 2 is queued too",
+		},
+		{
+			name: "leased and quarantined",
+			snapshot: keypool.Snapshot{
+				Sequence:   2,
+				Leases:     []*keypool.SnapshotLease{{KeyIndex: 1, Deadline: deadline}},
+				Quarantine: []*keypool.SnapshotQuarantined{{KeyIndex: 1, Time: deadline, Failures: 3}},
+			},
+			err: "quarantined key 1 is leased too",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store keypool.Store) {
+				require.ErrorContains(t, keypool.CheckImport(store, "test", &tt.snapshot), tt.err)
+				require.ErrorContains(t, keypool.Import(store, "test", &tt.snapshot), tt.err)
+				// nothing is written
+				_, err := keypool.Export(store, "test")
+				require.ErrorIs(t, err, keypool.ErrNoPool)
+			})
+		})
+	}
+
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		s := keypool.Snapshot{Sequence: 1, Queue: []uint64{1}}
+		require.NoError(t, keypool.CheckImport(store, "test", &s))
+		require.NoError(t, keypool.Import(store, "test", &s))
+		require.ErrorIs(t, keypool.CheckImport(store, "test", &s), keypool.ErrNotEmpty)
+	})
+}
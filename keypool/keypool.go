@@ -2,104 +2,229 @@ package keypool
 
 import (
 	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ecadlabs/go-tezos-keygen/events"
 	log "github.com/sirupsen/logrus"
-	bolt "go.etcd.io/bbolt"
 )
 
+// Batch is a group of keys funded by one operation
+type Batch struct {
+	Keys   []uint64
+	OpHash string
+	// Included is false if the operation was injected but its inclusion failed or wasn't confirmed
+	Included bool
+}
+
 type Charger interface {
-	ChargeKeys(ctx context.Context, keys []uint64) error
+	// ChargeKeys funds the keys in groups and returns the groups that were injected, also on failure.
+	// Only the last one may not be included. The pool publishes their events once it has committed them.
+	ChargeKeys(ctx context.Context, keys []uint64) ([]*Batch, error)
 	IsDrained(ctx context.Context, key uint64) (bool, error)
+	// Shortfall returns how much the key lacks to the funding amount, zero if nothing
+	Shortfall(ctx context.Context, key uint64) (*big.Int, error)
+	// TopUpKeys sends amounts[i] to keys[i] like ChargeKeys
+	TopUpKeys(ctx context.Context, keys []uint64, amounts []*big.Int) ([]*Batch, error)
+	// Inspect returns the recycling rules the key breaks out of the given ones
+	Inspect(ctx context.Context, key uint64, rules []string) ([]string, error)
+	// ResetKey brings the key's state in line with the broken rules. It returns false if they can't be
+	// fixed by a reset.
+	ResetKey(ctx context.Context, key uint64, broken []string) (bool, error)
 	Hash(key uint64) string
 }
 
+// Recycling policies
+const (
+	// RecycleKeep puts keys back with whatever balance they have unless they're drained
+	RecycleKeep = "keep"
+	// RecycleTopUp tops keys up to the funding amount before putting them back
+	RecycleTopUp = "topup"
+)
+
 type Config interface {
 	GetBucket() string
 	GetBufferLength() int
 	GetBufferThreshold() int
 	GetTimeout() time.Duration
+	GetAuditRetention() time.Duration
+	// GetRecycleRetries returns the number of failed recycling checks in a row after which a key is
+	// quarantined. 0 means never.
+	GetRecycleRetries() int
+	// GetRecycleBackoff returns the delay after the first failed check. It doubles with each failure.
+	GetRecycleBackoff() time.Duration
+	GetRecyclePolicy() string
+	// GetTopUpLimit returns the largest top-up as a percentage of the funding amount. Keys that lack
+	// more are discarded and a fresh index is funded instead.
+	GetTopUpLimit() int
+	GetAmount() *big.Int
+	// GetRecycleRules returns the rules a key must pass to be put back, see Charger.Inspect
+	GetRecycleRules() []string
+	// GetDirtyKeys returns what happens to keys that break the rules, DirtyDiscard or DirtyReset
+	GetDirtyKeys() string
 }
 
 var (
-	poolBucket  = []byte("keys")
-	leaseBucket = []byte("lease")
+	ErrNotLeased = errors.New("key is not leased")
+	ErrStopped   = errors.New("pool is stopped")
 )
 
+// Pool dispenses keys from the queue of funded ones. Requests are served in order by a single loop that
+// only touches the store. Funding and recycling run in their own goroutines and commit their results
+// in separate transactions, so their RPCs never hold the store or keep buffered keys from being handed out.
 type Pool struct {
-	db      *bolt.DB
+	store   Store
 	charger Charger
-	config  Config
+	events  *events.Bus
+	config  atomic.Pointer[configRef]
 
-	lease chan opLease
-	get   chan opGet
+	pop     chan opPop
+	release chan opRelease
+	// fill wakes the funder, filled returns the outcome to the loop
+	fill   chan struct{}
+	filled chan error
+	// leasesChanged wakes the recycler to reschedule the next deadline
+	leasesChanged chan struct{}
 
-	timeout *time.Timer
-	stop    chan struct{}
-	done    chan struct{}
+	// ctx lives as long as the pool and is cancelled by Stop to interrupt RPCs in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	done   chan struct{}
 }
 
-type opLease struct {
+type configRef struct {
+	Config
+}
+
+// opPop is a Get or a Lease. key is unbuffered, see deliver.
+type opPop struct {
+	ctx      context.Context
+	lease    bool
 	deadline time.Time
+	actor    actor
 	key      chan<- uint64
 	errCh    chan<- error
 }
 
-type opGet struct {
-	key   chan<- uint64
-	errCh chan<- error
-}
-
-type lease struct {
-	KeyIndex uint64
-	Deadline time.Time
+type opRelease struct {
+	keyIndex uint64
+	actor    actor
+	errCh    chan<- error
 }
 
-func New(db *bolt.DB, config Config, charger Charger) (*Pool, error) {
-	timeout := time.NewTimer(0)
-	if !timeout.Stop() {
-		select {
-		case <-timeout.C:
-		default:
-		}
+// New starts the pool. Key events are published to bus after they're committed, bus may be nil.
+func New(store Store, config Config, charger Charger, bus *events.Bus) (*Pool, error) {
+	if err := store.Init(config.GetBucket()); err != nil {
+		return nil, err
 	}
+	ctx, cancel := context.WithCancel(context.Background())
 	p := &Pool{
-		config:  config,
-		db:      db,
-		charger: charger,
-		lease:   make(chan opLease),
-		get:     make(chan opGet),
-		timeout: timeout,
-		done:    make(chan struct{}),
-		stop:    make(chan struct{}),
-	}
-
-	err := p.db.Update(func(tx *bolt.Tx) error {
-		root, err := tx.CreateBucketIfNotExists([]byte(p.config.GetBucket()))
-		if err != nil {
-			return err
-		}
-		if _, err := root.CreateBucketIfNotExists(poolBucket); err != nil {
-			return err
-		}
-		if _, err := root.CreateBucketIfNotExists(leaseBucket); err != nil {
-			return err
-		}
-		return p.schedule(tx)
-	})
-	if err != nil {
-		return nil, err
+		ctx:           ctx,
+		cancel:        cancel,
+		store:         store,
+		charger:       charger,
+		events:        bus,
+		pop:           make(chan opPop),
+		release:       make(chan opRelease),
+		fill:          make(chan struct{}, 1),
+		filled:        make(chan error),
+		leasesChanged: make(chan struct{}, 1),
+		done:          make(chan struct{}),
 	}
+	p.config.Store(&configRef{config})
 
+	p.wg.Add(4)
 	go p.loop()
+	go p.funder()
+	go p.recycler()
+	go p.pruner()
+	go func() {
+		p.wg.Wait()
+		close(p.done)
+	}()
 	return p, nil
 }
 
+// eventTypes maps audit operations to events
+var eventTypes = map[string]string{
+	AuditPop:        events.Popped,
+	AuditLease:      events.Leased,
+	AuditRelease:    events.Released,
+	AuditRecycle:    events.Recycled,
+	AuditDiscard:    events.Discarded,
+	AuditQuarantine: events.Quarantined,
+	AuditTopUp:      events.ToppedUp,
+}
+
+func (p *Pool) publish(op string, keyIndex uint64) {
+	p.events.Publish(&events.Event{
+		Type: eventTypes[op],
+		ID:   keyIndex,
+		PKH:  p.charger.Hash(keyIndex),
+	})
+}
+
+// publishBatch publishes the committed batch followed, for new keys, by Funded for each key
+func (p *Pool) publishBatch(b *Batch, funded bool) {
+	p.events.Publish(&events.Event{Type: events.BatchConfirmed, Keys: b.Keys, OpHash: b.OpHash})
+	if !funded {
+		return
+	}
+	for _, keyIndex := range b.Keys {
+		p.events.Publish(&events.Event{
+			Type:   events.Funded,
+			ID:     keyIndex,
+			PKH:    p.charger.Hash(keyIndex),
+			OpHash: b.OpHash,
+		})
+	}
+}
+
+func (p *Pool) cfg() Config {
+	return p.config.Load().Config
+}
+
+func (p *Pool) view(fn func(tx Tx) error) error {
+	return p.store.View(p.cfg().GetBucket(), fn)
+}
+
+func (p *Pool) update(fn func(tx Tx) error) error {
+	return p.store.Update(p.cfg().GetBucket(), fn)
+}
+
+// SetConfig applies new buffer, timeout and retention settings to the running pool.
+// The bucket name must stay the same.
+func (p *Pool) SetConfig(config Config) {
+	p.config.Store(&configRef{config})
+}
+
 func (p *Pool) Get(ctx context.Context) (uint64, error) {
-	key := make(chan uint64, 1)
+	return p.request(ctx, false, time.Time{})
+}
+
+func (p *Pool) Lease(ctx context.Context, deadline time.Time) (uint64, error) {
+	return p.request(ctx, true, deadline)
+}
+
+func (p *Pool) request(ctx context.Context, lease bool, deadline time.Time) (uint64, error) {
+	key := make(chan uint64)
 	errCh := make(chan error, 1)
+	req := opPop{
+		ctx:      ctx,
+		lease:    lease,
+		deadline: deadline,
+		actor:    actorFromContext(ctx),
+		key:      key,
+		errCh:    errCh,
+	}
 	select {
-	case p.get <- opGet{key: key, errCh: errCh}:
+	case p.pop <- req:
+	case <-p.ctx.Done():
+		return 0, ErrStopped
 	case <-ctx.Done():
 		return 0, ctx.Err()
 	}
@@ -108,45 +233,61 @@ func (p *Pool) Get(ctx context.Context) (uint64, error) {
 		return idx, nil
 	case err := <-errCh:
 		return 0, err
+	case <-p.ctx.Done():
+		return 0, ErrStopped
 	case <-ctx.Done():
 		return 0, ctx.Err()
 	}
 }
 
-func (p *Pool) Lease(ctx context.Context, deadline time.Time) (uint64, error) {
-	key := make(chan uint64, 1)
+// Release expires the lease on the key immediately. The key goes through
+// the same recycling check as one whose lease has run out.
+func (p *Pool) Release(ctx context.Context, keyIndex uint64) error {
 	errCh := make(chan error, 1)
 	select {
-	case p.lease <- opLease{key: key, errCh: errCh, deadline: deadline}:
+	case p.release <- opRelease{keyIndex: keyIndex, errCh: errCh, actor: actorFromContext(ctx)}:
+	case <-p.ctx.Done():
+		return ErrStopped
 	case <-ctx.Done():
-		return 0, ctx.Err()
+		return ctx.Err()
 	}
 	select {
-	case idx := <-key:
-		return idx, nil
 	case err := <-errCh:
-		return 0, err
+		return err
 	case <-ctx.Done():
-		return 0, ctx.Err()
+		return ctx.Err()
 	}
 }
 
+// Sign records a signature about to be made with the key. It fails with ErrNotLeased unless the key is
+// leased and its lease hasn't run out or been released, i.e. it's not going through recycling.
+func (p *Pool) Sign(ctx context.Context, keyIndex uint64) error {
+	return p.update(func(tx Tx) error {
+		l, err := tx.GetLease(keyIndex)
+		if err != nil {
+			return err
+		}
+		if l == nil || l.Failures != 0 || !l.Deadline.After(time.Now()) {
+			return ErrNotLeased
+		}
+		return p.audit(tx, AuditSign, keyIndex, actorFromContext(ctx))
+	})
+}
+
 func (p *Pool) Count() (int, error) {
 	var cnt int
-	err := p.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(p.config.GetBucket())).Bucket(poolBucket)
-		cnt = b.Stats().KeyN
-		return nil
+	err := p.view(func(tx Tx) (err error) {
+		cnt, err = tx.Len()
+		return
 	})
 	return cnt, err
 }
 
+// Stop interrupts funding and recycling in progress and waits for the pool to finish. Interrupted
+// transactions are rolled back: keys that weren't committed are funded again later, and expired leases
+// are checked on the next start.
 func (p *Pool) Stop(ctx context.Context) error {
-	select {
-	case p.stop <- struct{}{}:
-	case <-ctx.Done():
-		return ctx.Err()
-	}
+	p.cancel()
 	select {
 	case <-p.done:
 		return nil
@@ -155,175 +296,501 @@ func (p *Pool) Stop(ctx context.Context) error {
 	}
 }
 
+// stopped reports an operation interrupted by Stop as ErrStopped
+func (p *Pool) stopped(err error) error {
+	if p.ctx.Err() != nil {
+		return ErrStopped
+	}
+	return err
+}
+
+// rpcContext bounds a charger call by the pool's lifetime and the configured timeout
+func (p *Pool) rpcContext() (context.Context, context.CancelFunc) {
+	if t := p.cfg().GetTimeout(); t != 0 {
+		return context.WithTimeout(p.ctx, t)
+	}
+	return context.WithCancel(p.ctx)
+}
+
+// kick wakes up a worker without blocking. Wake-ups arriving while it's busy are merged into one.
+func kick(ch chan<- struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// take pops the first key for the request. ok is false if the queue is empty.
+// The funder is woken up once the queue is down to the threshold.
+func (p *Pool) take(req *opPop) (keyIndex uint64, ok bool, err error) {
+	var n int
+	err = p.update(func(tx Tx) (err error) {
+		if n, err = tx.Len(); err != nil || n == 0 {
+			return err
+		}
+		if keyIndex, ok, err = tx.Pop(); err != nil {
+			return err
+		}
+		op := AuditPop
+		if req.lease {
+			if err := tx.PutLease(&Lease{KeyIndex: keyIndex, Identity: req.actor.identity, Deadline: req.deadline}); err != nil {
+				return err
+			}
+			op = AuditLease
+		}
+		return p.audit(tx, op, keyIndex, req.actor)
+	})
+	if err != nil {
+		return 0, false, err
+	}
+	if n <= p.cfg().GetBufferThreshold() {
+		kick(p.fill)
+	}
+	return keyIndex, ok, nil
+}
+
+// serve hands out a key to the request. Returns false if the queue is empty.
+func (p *Pool) serve(req *opPop) bool {
+	if req.ctx.Err() != nil {
+		// the caller is gone
+		return true
+	}
+	keyIndex, ok, err := p.take(req)
+	if err != nil {
+		req.errCh <- p.stopped(err)
+		return true
+	}
+	if !ok {
+		return false
+	}
+	if req.lease {
+		kick(p.leasesChanged)
+	}
+	if p.deliver(req.ctx, req.key, keyIndex, req.lease, req.actor) {
+		op := AuditPop
+		if req.lease {
+			op = AuditLease
+		}
+		p.publish(op, keyIndex)
+	}
+	return true
+}
+
 func (p *Pool) loop() {
+	defer p.wg.Done()
+	// requests waiting for the queue to be refilled, in order of arrival
+	var waiting []*opPop
 	for {
 		select {
-		case req := <-p.get:
-			var keyIndex uint64
-			err := p.db.Update(func(tx *bolt.Tx) error {
-				b := bucket{tx.Bucket([]byte(p.config.GetBucket())).Bucket(poolBucket)}
-				if err := p.fill(tx); err != nil {
-					return err
-				}
-				// pop first
-				c := b.Cursor()
-				var k uint64
-				if err := c.First(&k, &keyIndex); err != nil {
-					if err == errEOF {
-						panic("empty bucket") // shouldn't happen
-					}
-					return err
-				}
-				return c.Delete()
-			})
-			if err != nil {
-				req.errCh <- err
+		case req := <-p.pop:
+			// don't overtake the waiting ones
+			if len(waiting) == 0 && p.serve(&req) {
 				break
 			}
-			req.key <- keyIndex
-
-		case req := <-p.lease:
-			var keyIndex uint64
-			err := p.db.Update(func(tx *bolt.Tx) error {
-				root := tx.Bucket([]byte(p.config.GetBucket()))
-				poolBkt := bucket{root.Bucket(poolBucket)}
-				if err := p.fill(tx); err != nil {
-					return err
-				}
-				// pop first
-				c := poolBkt.Cursor()
-				var k uint64
-				if err := c.First(&k, &keyIndex); err != nil {
-					if err == errEOF {
-						panic("empty bucket") // shouldn't happen
-					}
-					return err
-				}
-				if err := c.Delete(); err != nil {
-					return err
-				}
+			waiting = append(waiting, &req)
 
-				leaseBkt := bucket{root.Bucket(leaseBucket)}
-				rec := lease{
-					KeyIndex: keyIndex,
-					Deadline: req.deadline,
+		case err := <-p.filled:
+			if err != nil {
+				if len(waiting) == 0 {
+					log.Error(err)
 				}
-				if err := leaseBkt.Put(&k, &rec); err != nil {
-					return err
+				for _, req := range waiting {
+					req.errCh <- p.stopped(err)
 				}
-				return p.schedule(tx)
-			})
-			if err != nil {
-				req.errCh <- err
+				waiting = nil
 				break
 			}
-			req.key <- keyIndex
-
-		case now := <-p.timeout.C:
-			err := p.db.Update(func(tx *bolt.Tx) error {
-				root := tx.Bucket([]byte(p.config.GetBucket()))
-				poolBkt := bucket{root.Bucket(poolBucket)}
-				leaseBkt := bucket{root.Bucket(leaseBucket)}
-
-				c := leaseBkt.Cursor()
-				var (
-					k   uint64
-					v   lease
-					err error
-				)
-				for err = c.First(&k, &v); err == nil; err = c.Next(&k, &v) {
-					if v.Deadline.Before(now) || v.Deadline.Equal(now) {
-						ctx := context.Background()
-						var cancel context.CancelFunc
-						if p.config.GetTimeout() != 0 {
-							ctx, cancel = context.WithTimeout(ctx, p.config.GetTimeout())
-						}
-						drained, err := p.charger.IsDrained(ctx, v.KeyIndex)
-						if cancel != nil {
-							cancel()
-						}
-						if err != nil {
-							return err
-						}
-						if !drained {
-							k, _ := poolBkt.NextSequence()
-							// put back
-							log.WithField("pkh", p.charger.Hash(v.KeyIndex)).Info("Recycling")
-							if err := poolBkt.Put(&k, &v.KeyIndex); err != nil {
-								return err
-							}
-						}
-						if err := c.Delete(); err != nil {
-							return err
-						}
-					}
+			for len(waiting) != 0 && p.serve(waiting[0]) {
+				waiting = waiting[1:]
+			}
+
+		case req := <-p.release:
+			err := p.update(func(tx Tx) error {
+				l, err := tx.GetLease(req.keyIndex)
+				if err != nil {
+					return err
 				}
-				if err != nil && err != errEOF {
+				if l == nil {
+					return ErrNotLeased
+				}
+				l.Deadline = time.Now()
+				if err := tx.PutLease(l); err != nil {
 					return err
 				}
-				return p.schedule(tx)
+				return p.audit(tx, AuditRelease, l.KeyIndex, req.actor)
 			})
-			if err != nil {
-				log.Error(err)
+			req.errCh <- err
+			if err == nil {
+				kick(p.leasesChanged)
+				p.publish(AuditRelease, req.keyIndex)
 			}
 
-		case <-p.stop:
-			p.done <- struct{}{}
+		case <-p.ctx.Done():
+			for _, req := range waiting {
+				req.errCh <- ErrStopped
+			}
 			return
 		}
+		if len(waiting) != 0 {
+			kick(p.fill)
+		}
 	}
 }
 
-func (p *Pool) schedule(tx *bolt.Tx) error {
-	b := bucket{tx.Bucket([]byte(p.config.GetBucket())).Bucket(leaseBucket)}
-	c := b.Cursor()
+// deliver hands the committed key over to the caller. The channel is unbuffered, so the key is either
+// received or, if the caller has given up, put back into the queue. Returns true if delivered.
+func (p *Pool) deliver(ctx context.Context, key chan<- uint64, keyIndex uint64, leased bool, a actor) bool {
+	select {
+	case key <- keyIndex:
+		return true
+	case <-ctx.Done():
+	case <-p.ctx.Done():
+	}
+	err := p.update(func(tx Tx) error {
+		if leased {
+			if err := tx.DeleteLease(keyIndex); err != nil {
+				return err
+			}
+		}
+		if err := tx.Push(keyIndex); err != nil {
+			return err
+		}
+		return p.audit(tx, AuditCancel, keyIndex, a)
+	})
+	if err != nil {
+		// the key stays with the caller that never got it
+		log.WithField("pkh", p.charger.Hash(keyIndex)).Error(err)
+	}
+	if leased {
+		kick(p.leasesChanged)
+	}
+	return false
+}
+
+func (p *Pool) funder() {
+	defer p.wg.Done()
+	for {
+		select {
+		case <-p.fill:
+		case <-p.ctx.Done():
+			return
+		}
+		err := p.refill()
+		select {
+		case p.filled <- err:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+// refill funds new keys if the queue is down to the threshold. The indices are allocated before
+// funding, so they're never funded twice, and queued once funded. If funding fails the groups included
+// before the failure are queued. The remaining indices are given back if nothing was injected and no more
+// were allocated meanwhile, otherwise they're skipped as an injected group may still be included. Keys
+// funded for a chain the pool has been reset from are dropped.
+func (p *Pool) refill() error {
+	cfg := p.cfg()
 	var (
-		i            int
-		nextDeadline time.Time
-		k            uint64
-		v            lease
-		err          error
+		keys  []uint64
+		chain *ChainInfo
 	)
-	for err = c.First(&k, &v); err == nil; err = c.Next(&k, &v) {
-		if i == 0 || v.Deadline.Before(nextDeadline) {
-			nextDeadline = v.Deadline
+	err := p.update(func(tx Tx) error {
+		n, err := tx.Len()
+		if err != nil {
+			return err
+		}
+		if n > cfg.GetBufferThreshold() || n >= cfg.GetBufferLength() {
+			return nil
+		}
+		seq, err := tx.Sequence()
+		if err != nil {
+			return err
+		}
+		if chain, err = tx.Chain(); err != nil {
+			return err
+		}
+		keys = make([]uint64, cfg.GetBufferLength()-n)
+		for i := range keys {
+			keys[i] = seq + uint64(i) + 1
+		}
+		return tx.SetSequence(keys[len(keys)-1])
+	})
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+	first, last := keys[0], keys[len(keys)-1]
+
+	ctx, cancel := p.rpcContext()
+	batches, fundErr := p.charger.ChargeKeys(ctx, keys)
+	cancel()
+
+	var funded []uint64
+	for _, b := range batches {
+		if b.Included {
+			funded = append(funded, b.Keys...)
 		}
-		i++
 	}
-	if err != nil && err != errEOF {
+	var dropped, gaveBack bool
+	err = p.update(func(tx Tx) error {
+		s, err := tx.Sequence()
+		if err != nil {
+			return err
+		}
+		c, err := tx.Chain()
+		if err != nil {
+			return err
+		}
+		// a reset either changes the chain or, unless the sequence is kept, restarts the sequence
+		if s < last || chain != nil && (c == nil || *c != *chain) {
+			dropped = true
+			return nil
+		}
+		for _, k := range funded {
+			if err := tx.Push(k); err != nil {
+				return err
+			}
+		}
+		if fundErr != nil && len(batches) == 0 && s == last {
+			gaveBack = true
+			return tx.SetSequence(first - 1)
+		}
+		return nil
+	})
+	if err != nil {
+		if fundErr != nil {
+			return fundErr
+		}
 		return err
 	}
-	if i != 0 {
-		if !p.timeout.Stop() {
-			select {
-			case <-p.timeout.C:
-			default:
+
+	l := log.WithFields(log.Fields{"bucket": cfg.GetBucket(), "first": first, "last": last})
+	if dropped {
+		l.Warn("Pool was reset while funding, the funded keys are dropped")
+		return fundErr
+	}
+	for _, b := range batches {
+		if b.Included {
+			p.publishBatch(b, true)
+		}
+	}
+	if fundErr == nil {
+		return nil
+	}
+	if !gaveBack {
+		l.WithField("funded", len(funded)).Warn("Funding failed, the unfunded key indices are skipped")
+	}
+	if len(funded) != 0 {
+		// the waiting requests are served from the funded keys and the rest is funded again
+		log.Error(fundErr)
+		return nil
+	}
+	return fundErr
+}
+
+// recycler owns the lease timer
+func (p *Pool) recycler() {
+	defer p.wg.Done()
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	if !timer.Stop() {
+		<-timer.C
+	}
+
+	// failed attempts in a row are retried with the same backoff as failed checks
+	var failures int
+	retry := func(err error) {
+		failures++
+		delay := recycleDelay(p.cfg().GetRecycleBackoff(), failures)
+		log.WithField("retry_in", delay).Error(err)
+		resetTimer(timer, delay)
+	}
+
+	reschedule := true
+	for {
+		if reschedule {
+			if err := p.schedule(timer); err != nil {
+				retry(err)
 			}
+			reschedule = false
+		}
+		select {
+		case <-p.leasesChanged:
+			// while failing, the retry picks the change up
+			reschedule = failures == 0
+
+		case now := <-timer.C:
+			if err := p.recycle(now); err != nil {
+				if p.ctx.Err() == nil {
+					retry(err)
+				}
+				break
+			}
+			failures = 0
+			reschedule = true
+
+		case <-p.ctx.Done():
+			return
 		}
-		p.timeout.Reset(time.Until(nextDeadline))
 	}
-	return nil
 }
 
-func (p *Pool) fill(tx *bolt.Tx) error {
-	b := bucket{tx.Bucket([]byte(p.config.GetBucket())).Bucket(poolBucket)}
-	n := b.Stats().KeyN
-	if n > p.config.GetBufferThreshold() {
+// recycle puts expired keys that still have funds back into the queue and discards drained ones.
+// Each key is committed on its own so a slow check doesn't hold the store. A failed check is retried
+// later, see retryLater. With the top-up policy keys that lack funds are topped up together once
+// all of them have been checked.
+func (p *Pool) recycle(now time.Time) error {
+	var leases []*Lease
+	err := p.view(func(tx Tx) (err error) {
+		leases, err = tx.ExpiredLeases(now)
+		return
+	})
+	if err != nil {
+		return err
+	}
+	var (
+		topUp   []uint64
+		amounts []*big.Int
+	)
+	for _, l := range leases {
+		op, amount, checkErr := p.check(l.KeyIndex)
+		if checkErr != nil && p.ctx.Err() != nil {
+			// not the key's fault
+			return p.ctx.Err()
+		}
+		if op == AuditTopUp {
+			topUp = append(topUp, l.KeyIndex)
+			amounts = append(amounts, amount)
+			continue
+		}
+		if err := p.settle(l.KeyIndex, now, op, checkErr); err != nil {
+			return err
+		}
+	}
+	if len(topUp) == 0 {
 		return nil
 	}
-	keys := make([]uint64, p.config.GetBufferLength()-n)
-	for i := range keys {
-		k, _ := b.NextSequence()
-		keys[i] = k
-		if err := b.Put(&k, &k); err != nil {
+
+	log.WithField("keys", topUp).Info("Topping up")
+	ctx, cancel := p.rpcContext()
+	batches, topUpErr := p.charger.TopUpKeys(ctx, topUp, amounts)
+	cancel()
+	if topUpErr != nil && p.ctx.Err() != nil {
+		return p.ctx.Err()
+	}
+	// keys topped up before a failure are found to have enough on the next check
+	for _, idx := range topUp {
+		if err := p.settle(idx, now, AuditTopUp, topUpErr); err != nil {
 			return err
 		}
 	}
-	ctx := context.Background()
-	if p.config.GetTimeout() != 0 {
-		var cancel context.CancelFunc
-		ctx, cancel = context.WithTimeout(ctx, p.config.GetTimeout())
-		defer cancel()
+	for _, b := range batches {
+		if b.Included {
+			p.publishBatch(b, false)
+		}
+	}
+	return nil
+}
+
+// check decides the key's fate: AuditRecycle, AuditDiscard or AuditTopUp along with the amount to send
+func (p *Pool) check(keyIndex uint64) (string, *big.Int, error) {
+	cfg := p.cfg()
+	ctx, cancel := p.rpcContext()
+	defer cancel()
+	if clean, err := p.clean(ctx, keyIndex); err != nil || !clean {
+		return AuditDiscard, nil, err
+	}
+	if cfg.GetRecyclePolicy() != RecycleTopUp {
+		drained, err := p.charger.IsDrained(ctx, keyIndex)
+		if err != nil || drained {
+			return AuditDiscard, nil, err
+		}
+		return AuditRecycle, nil, nil
+	}
+
+	short, err := p.charger.Shortfall(ctx, keyIndex)
+	if err != nil {
+		return "", nil, err
+	}
+	if short.Sign() <= 0 {
+		return AuditRecycle, nil, nil
+	}
+	// short/amount > limit/100
+	limit := new(big.Int).Mul(cfg.GetAmount(), big.NewInt(int64(cfg.GetTopUpLimit())))
+	if new(big.Int).Mul(short, big.NewInt(100)).Cmp(limit) > 0 {
+		log.WithFields(log.Fields{
+			"pkh":             p.charger.Hash(keyIndex),
+			"shortfall_mutez": short,
+		}).Info("Not worth topping up")
+		return AuditDiscard, nil, nil
+	}
+	return AuditTopUp, short, nil
+}
+
+// settle commits the outcome of the key's check unless its lease has changed meanwhile
+func (p *Pool) settle(keyIndex uint64, now time.Time, op string, checkErr error) error {
+	err := p.update(func(tx Tx) error {
+		cur, err := tx.GetLease(keyIndex)
+		if err != nil || cur == nil || cur.Deadline.After(now) {
+			op = ""
+			return err
+		}
+		if checkErr != nil {
+			op, err = p.retryLater(tx, cur, checkErr)
+			return err
+		}
+		if op != AuditDiscard {
+			// put back
+			log.WithField("pkh", p.charger.Hash(keyIndex)).Info("Recycling")
+			if err := tx.Push(keyIndex); err != nil {
+				return err
+			}
+		}
+		if err := p.audit(tx, op, keyIndex, actor{}); err != nil {
+			return err
+		}
+		return tx.DeleteLease(keyIndex)
+	})
+	if err != nil {
+		return err
+	}
+	if op != "" {
+		p.publish(op, keyIndex)
+	}
+	return nil
+}
+
+// schedule sets the timer to the nearest lease deadline
+func (p *Pool) schedule(timer *time.Timer) error {
+	var (
+		next time.Time
+		ok   bool
+	)
+	err := p.view(func(tx Tx) (err error) {
+		next, ok, err = tx.NextDeadline()
+		return
+	})
+	if err != nil {
+		return err
+	}
+	if ok {
+		resetTimer(timer, time.Until(next))
+	} else if !timer.Stop() {
+		drainTimer(timer)
+	}
+	return nil
+}
+
+func drainTimer(timer *time.Timer) {
+	select {
+	case <-timer.C:
+	default:
+	}
+}
+
+func resetTimer(timer *time.Timer, d time.Duration) {
+	if !timer.Stop() {
+		drainTimer(timer)
 	}
-	return p.charger.ChargeKeys(ctx, keys)
+	timer.Reset(d)
 }
@@ -0,0 +1,424 @@
+package keypool
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errReadOnly = errors.New("read-only transaction")
+
+// MemStore keeps pools in memory. It's meant for tests and ephemeral instances.
+// Update works on the pool state in place and keeps an undo log, so a failed transaction leaves no trace
+// and a transaction costs only as much as it changes.
+type MemStore struct {
+	mtx   sync.RWMutex
+	pools map[string]*memPool
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{pools: make(map[string]*memPool)}
+}
+
+type memArchive struct {
+	chain      *ChainInfo
+	queue      []uint64
+	seq        uint64
+	leases     map[uint64]Lease
+	quarantine map[uint64]Quarantined
+}
+
+type memPool struct {
+	queue      []uint64
+	seq        uint64
+	leases     map[uint64]Lease
+	quarantine map[uint64]Quarantined
+	audit      []*AuditRecord
+	auditSeq   uint64
+	quota      map[string]QuotaUsage
+	chain      *ChainInfo
+	archive    map[string]*memArchive
+}
+
+func newMemPool() *memPool {
+	return &memPool{
+		leases:     make(map[uint64]Lease),
+		quarantine: make(map[uint64]Quarantined),
+		quota:      make(map[string]QuotaUsage),
+		archive:    make(map[string]*memArchive),
+	}
+}
+
+func (s *MemStore) Init(pool string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if _, ok := s.pools[pool]; !ok {
+		s.pools[pool] = newMemPool()
+	}
+	return nil
+}
+
+func (s *MemStore) View(pool string, fn func(tx Tx) error) error {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	p, ok := s.pools[pool]
+	if !ok {
+		return fmt.Errorf("%s: %w", pool, ErrNoPool)
+	}
+	return fn(&memTx{p: p})
+}
+
+func (s *MemStore) Update(pool string, fn func(tx Tx) error) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	p, ok := s.pools[pool]
+	if !ok {
+		return fmt.Errorf("%s: %w", pool, ErrNoPool)
+	}
+	tx := memTx{p: p, writable: true}
+	committed := false
+	defer func() {
+		if !committed {
+			tx.rollback()
+		}
+	}()
+	if err := fn(&tx); err != nil {
+		return err
+	}
+	committed = true
+	return nil
+}
+
+type memTx struct {
+	p        *memPool
+	writable bool
+	undo     []func()
+}
+
+// onRollback records how to revert a change
+func (t *memTx) onRollback(fn func()) {
+	t.undo = append(t.undo, fn)
+}
+
+func (t *memTx) rollback() {
+	for i := len(t.undo) - 1; i >= 0; i-- {
+		t.undo[i]()
+	}
+	t.undo = nil
+}
+
+// saveQueue records the queue before a change. Changes never write below the queue's length, so the
+// old slice stays intact.
+func (t *memTx) saveQueue() {
+	queue := t.p.queue
+	t.onRollback(func() { t.p.queue = queue })
+}
+
+func (t *memTx) saveSequence() {
+	seq := t.p.seq
+	t.onRollback(func() { t.p.seq = seq })
+}
+
+func saveEntry[K comparable, V any](t *memTx, m map[K]V, key K) {
+	old, ok := m[key]
+	t.onRollback(func() {
+		if ok {
+			m[key] = old
+		} else {
+			delete(m, key)
+		}
+	})
+}
+
+func (t *memTx) Push(index uint64) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	t.saveQueue()
+	t.p.queue = append(t.p.queue, index)
+	return nil
+}
+
+func (t *memTx) Pop() (uint64, bool, error) {
+	if !t.writable {
+		return 0, false, errReadOnly
+	}
+	if len(t.p.queue) == 0 {
+		return 0, false, nil
+	}
+	index := t.p.queue[0]
+	t.saveQueue()
+	t.p.queue = t.p.queue[1:]
+	return index, true, nil
+}
+
+func (t *memTx) Remove(index uint64) (bool, error) {
+	if !t.writable {
+		return false, errReadOnly
+	}
+	for i, v := range t.p.queue {
+		if v == index {
+			t.saveQueue()
+			t.p.queue = append(t.p.queue[:i:i], t.p.queue[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (t *memTx) Len() (int, error) { return len(t.p.queue), nil }
+
+func (t *memTx) Queue() ([]uint64, error) {
+	return append([]uint64(nil), t.p.queue...), nil
+}
+
+func (t *memTx) NextSequence() (uint64, error) {
+	if !t.writable {
+		return 0, errReadOnly
+	}
+	t.saveSequence()
+	t.p.seq++
+	return t.p.seq, nil
+}
+
+func (t *memTx) Sequence() (uint64, error) { return t.p.seq, nil }
+
+func (t *memTx) SetSequence(seq uint64) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	t.saveSequence()
+	t.p.seq = seq
+	return nil
+}
+
+func (t *memTx) PutLease(l *Lease) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	saveEntry(t, t.p.leases, l.KeyIndex)
+	t.p.leases[l.KeyIndex] = *l
+	return nil
+}
+
+func (t *memTx) GetLease(index uint64) (*Lease, error) {
+	if l, ok := t.p.leases[index]; ok {
+		return &l, nil
+	}
+	return nil, nil
+}
+
+func (t *memTx) DeleteLease(index uint64) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	saveEntry(t, t.p.leases, index)
+	delete(t.p.leases, index)
+	return nil
+}
+
+func (t *memTx) Leases() ([]*Lease, error) {
+	out := make([]*Lease, 0, len(t.p.leases))
+	for _, l := range t.p.leases {
+		l := l
+		out = append(out, &l)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].KeyIndex < out[j].KeyIndex })
+	return out, nil
+}
+
+func (t *memTx) NextDeadline() (time.Time, bool, error) {
+	var (
+		next time.Time
+		ok   bool
+	)
+	for _, l := range t.p.leases {
+		if !ok || l.Deadline.Before(next) {
+			next, ok = l.Deadline, true
+		}
+	}
+	return next, ok, nil
+}
+
+func (t *memTx) ExpiredLeases(now time.Time) ([]*Lease, error) {
+	var out []*Lease
+	for _, l := range t.p.leases {
+		if !l.Deadline.After(now) {
+			l := l
+			out = append(out, &l)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].Deadline.Equal(out[j].Deadline) {
+			return out[i].Deadline.Before(out[j].Deadline)
+		}
+		return out[i].KeyIndex < out[j].KeyIndex
+	})
+	return out, nil
+}
+
+func (t *memTx) PutQuarantined(q *Quarantined) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	saveEntry(t, t.p.quarantine, q.KeyIndex)
+	t.p.quarantine[q.KeyIndex] = *q
+	return nil
+}
+
+func (t *memTx) GetQuarantined(index uint64) (*Quarantined, error) {
+	if q, ok := t.p.quarantine[index]; ok {
+		return &q, nil
+	}
+	return nil, nil
+}
+
+func (t *memTx) DeleteQuarantined(index uint64) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	saveEntry(t, t.p.quarantine, index)
+	delete(t.p.quarantine, index)
+	return nil
+}
+
+func (t *memTx) QuarantinedKeys() ([]*Quarantined, error) {
+	out := make([]*Quarantined, 0, len(t.p.quarantine))
+	for _, q := range t.p.quarantine {
+		q := q
+		out = append(out, &q)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].KeyIndex < out[j].KeyIndex })
+	return out, nil
+}
+
+func (t *memTx) AppendAudit(r *AuditRecord) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	// the log is only appended to or cut from the front, so the old slice stays intact
+	audit, seq := t.p.audit, t.p.auditSeq
+	t.onRollback(func() { t.p.audit, t.p.auditSeq = audit, seq })
+	t.p.auditSeq++
+	rec := *r
+	rec.ID = t.p.auditSeq
+	t.p.audit = append(t.p.audit, &rec)
+	return nil
+}
+
+func (t *memTx) PruneAudit(before time.Time) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	i := sort.Search(len(t.p.audit), func(i int) bool { return !t.p.audit[i].Time.Before(before) })
+	audit := t.p.audit
+	t.onRollback(func() { t.p.audit = audit })
+	t.p.audit = t.p.audit[i:]
+	return nil
+}
+
+func (t *memTx) AuditLog(q *AuditQuery) ([]*AuditRecord, error) {
+	end := len(t.p.audit)
+	if q.Before != 0 {
+		end = sort.Search(end, func(i int) bool { return t.p.audit[i].ID >= q.Before })
+	}
+	var out []*AuditRecord
+	for i := end - 1; i >= 0 && !t.p.audit[i].Time.Before(q.Since); i-- {
+		if q.match(t.p.audit[i].PKH) {
+			rec := *t.p.audit[i]
+			if out = append(out, &rec); len(out) == q.Limit {
+				break
+			}
+		}
+	}
+	// oldest first
+	slices.Reverse(out)
+	return out, nil
+}
+
+func (t *memTx) GetQuotaUsage(day, client string) (*QuotaUsage, error) {
+	u, ok := t.p.quota[day+"/"+client]
+	if !ok {
+		return nil, nil
+	}
+	if u.Amount != nil {
+		u.Amount = new(big.Int).Set(u.Amount)
+	}
+	return &u, nil
+}
+
+func (t *memTx) PutQuotaUsage(day, client string, u *QuotaUsage) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	v := *u
+	if v.Amount != nil {
+		v.Amount = new(big.Int).Set(v.Amount)
+	}
+	saveEntry(t, t.p.quota, day+"/"+client)
+	t.p.quota[day+"/"+client] = v
+	return nil
+}
+
+func (t *memTx) PruneQuota(day string) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	for k := range t.p.quota {
+		if d, _, _ := strings.Cut(k, "/"); d < day {
+			saveEntry(t, t.p.quota, k)
+			delete(t.p.quota, k)
+		}
+	}
+	return nil
+}
+
+func (t *memTx) Chain() (*ChainInfo, error) {
+	if t.p.chain == nil {
+		return nil, nil
+	}
+	info := *t.p.chain
+	return &info, nil
+}
+
+func (t *memTx) SetChain(info *ChainInfo) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	old := t.p.chain
+	t.onRollback(func() { t.p.chain = old })
+	v := *info
+	t.p.chain = &v
+	return nil
+}
+
+func (t *memTx) Archive(name string) error {
+	if !t.writable {
+		return errReadOnly
+	}
+	if _, ok := t.p.archive[name]; ok {
+		return fmt.Errorf("archive %s already exists", name)
+	}
+	a := &memArchive{
+		chain:      t.p.chain,
+		queue:      t.p.queue,
+		seq:        t.p.seq,
+		leases:     t.p.leases,
+		quarantine: t.p.quarantine,
+	}
+	t.p.archive[name] = a
+	t.onRollback(func() {
+		delete(t.p.archive, name)
+		t.p.queue, t.p.seq, t.p.leases, t.p.quarantine = a.queue, a.seq, a.leases, a.quarantine
+	})
+	t.p.queue = nil
+	t.p.seq = 0
+	t.p.leases = make(map[uint64]Lease)
+	t.p.quarantine = make(map[uint64]Quarantined)
+	return nil
+}
@@ -0,0 +1,304 @@
+package keypool
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var schemaKey = []byte("schema")
+
+type migration struct {
+	description string
+	migrate     func(root *bolt.Bucket) error
+}
+
+// migrations[i] upgrades a pool from schema version i to i+1. Append only.
+var migrations = []migration{
+	{description: "stable record encoding, leases keyed by the key index", migrate: migrateV1},
+	{description: "lease deadline index", migrate: migrateV2},
+	{description: "recycling failures and quarantine", migrate: migrateV3},
+	{description: "queue length counter", migrate: migrateV4},
+}
+
+// SchemaVersion is the pool layout version written by this build
+var SchemaVersion = uint64(len(migrations))
+
+var errDryRun = errors.New("dry run")
+
+// schemaVersion returns 0 for pools created before the layout was versioned
+func schemaVersion(root *bolt.Bucket) (uint64, error) {
+	v := root.Get(schemaKey)
+	if v == nil {
+		return 0, nil
+	}
+	return decodeKey(v)
+}
+
+func setSchemaVersion(root *bolt.Bucket, version uint64) error {
+	return root.Put(schemaKey, encodeKey(version))
+}
+
+// Pools returns the names of the pools kept in the database
+func (s *BoltStore) Pools() ([]string, error) {
+	var out []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			out = append(out, string(name))
+			return nil
+		})
+	})
+	return out, err
+}
+
+// Migrate upgrades the pool to SchemaVersion and returns the descriptions of the applied migrations.
+// The database file is copied aside before the first migration made through the store. In dry-run
+// mode the migrations are run and rolled back, and no backup is made.
+func (s *BoltStore) Migrate(pool string, dryRun bool) ([]string, error) {
+	var version uint64
+	err := s.db.View(func(tx *bolt.Tx) (err error) {
+		if root := tx.Bucket([]byte(pool)); root != nil {
+			version, err = schemaVersion(root)
+		} else {
+			version = SchemaVersion
+		}
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	if version > SchemaVersion {
+		return nil, fmt.Errorf("%s: schema version %d is newer than supported version %d", pool, version, SchemaVersion)
+	}
+	if version == SchemaVersion {
+		return nil, nil
+	}
+	if !dryRun {
+		if err := s.backup(); err != nil {
+			return nil, err
+		}
+	}
+
+	var applied []string
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket([]byte(pool))
+		for v := version; v < SchemaVersion; v++ {
+			m := &migrations[v]
+			if err := m.migrate(root); err != nil {
+				return fmt.Errorf("%s: migration to version %d: %w", pool, v+1, err)
+			}
+			applied = append(applied, m.description)
+			log.WithFields(log.Fields{
+				"bucket":  pool,
+				"version": v + 1,
+				"dry_run": dryRun,
+			}).Info("Migrating: " + m.description)
+		}
+		if err := setSchemaVersion(root, SchemaVersion); err != nil {
+			return err
+		}
+		if dryRun {
+			return errDryRun
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func (s *BoltStore) backup() error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.backupFile != "" {
+		return nil
+	}
+	name := s.db.Path() + "." + time.Now().UTC().Format("20060102T150405Z") + ".bak"
+	if err := s.db.View(func(tx *bolt.Tx) error { return tx.CopyFile(name, 0600) }); err != nil {
+		return fmt.Errorf("backup: %w", err)
+	}
+	log.WithField("file", name).Info("Database is backed up before migration")
+	s.backupFile = name
+	return nil
+}
+
+// rewrite replaces every record of the bucket with the result of fn keeping the bucket's sequence.
+// Nested buckets are left alone.
+func rewrite(b *bolt.Bucket, fn func(k, v []byte) (nk, nv []byte, err error)) error {
+	if b == nil {
+		return nil
+	}
+	var old, keys, values [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+		nk, nv, err := fn(k, v)
+		if err != nil {
+			return fmt.Errorf("%x: %w", k, err)
+		}
+		old = append(old, bytes.Clone(k))
+		keys = append(keys, nk)
+		values = append(values, nv)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range old {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	for i, k := range keys {
+		if err := b.Put(k, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rewriteValue converts a gob encoded value into its stable encoding
+func rewriteValue[T any](k, v []byte, conv func(*T) any) ([]byte, []byte, error) {
+	var old T
+	if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&old); err != nil {
+		return nil, nil, err
+	}
+	nv, err := encodeValue(conv(&old))
+	return bytes.Clone(k), nv, err
+}
+
+// Version 0 layout: gob encoded values, leases keyed by the queue position
+
+type v0Lease struct {
+	KeyIndex uint64
+	Deadline time.Time
+}
+
+type v0Quota struct {
+	Keys   uint64
+	Amount *big.Int
+}
+
+func migrateV1(root *bolt.Bucket) error {
+	if err := migrateV1Pool(root); err != nil {
+		return err
+	}
+	err := rewrite(root.Bucket(auditBucket), func(k, v []byte) ([]byte, []byte, error) {
+		return rewriteValue(k, v, func(r *AuditRecord) any { return newAuditRecord(r) })
+	})
+	if err != nil {
+		return err
+	}
+	err = rewrite(root.Bucket(quotaBucket), func(k, v []byte) ([]byte, []byte, error) {
+		return rewriteValue(k, v, func(u *v0Quota) any { return newQuotaRecord(&QuotaUsage{Keys: u.Keys, Amount: u.Amount}) })
+	})
+	if err != nil {
+		return err
+	}
+	if arch := root.Bucket(archiveBucket); arch != nil {
+		return arch.ForEach(func(name, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return migrateV1Pool(arch.Bucket(name))
+		})
+	}
+	return nil
+}
+
+// migrateV1Pool converts the part of the layout that is moved to the archive on chain reset
+func migrateV1Pool(b *bolt.Bucket) error {
+	if v := b.Get(chainKey); v != nil {
+		_, nv, err := rewriteValue(chainKey, v, func(c *ChainInfo) any {
+			return &chainRecord{ChainID: c.ChainID, Genesis: c.Genesis}
+		})
+		if err != nil {
+			return fmt.Errorf("chain: %w", err)
+		}
+		if err := b.Put(chainKey, nv); err != nil {
+			return err
+		}
+	}
+	err := rewrite(b.Bucket(poolBucket), func(k, v []byte) ([]byte, []byte, error) {
+		return rewriteValue(k, v, func(index *uint64) any { return index })
+	})
+	if err != nil {
+		return fmt.Errorf("keys: %w", err)
+	}
+	err = rewrite(b.Bucket(leaseBucket), func(k, v []byte) ([]byte, []byte, error) {
+		var old v0Lease
+		if err := gob.NewDecoder(bytes.NewReader(v)).Decode(&old); err != nil {
+			return nil, nil, err
+		}
+		nv, err := encodeValue(&leaseRecord{KeyIndex: old.KeyIndex, Deadline: old.Deadline})
+		return encodeKey(old.KeyIndex), nv, err
+	})
+	if err != nil {
+		return fmt.Errorf("lease: %w", err)
+	}
+	return nil
+}
+
+// Version 1 layout: no lease deadline index
+
+func migrateV2(root *bolt.Bucket) error {
+	if err := migrateV2Pool(root); err != nil {
+		return err
+	}
+	if arch := root.Bucket(archiveBucket); arch != nil {
+		return arch.ForEach(func(name, v []byte) error {
+			if v != nil {
+				return nil
+			}
+			return migrateV2Pool(arch.Bucket(name))
+		})
+	}
+	return nil
+}
+
+func migrateV2Pool(b *bolt.Bucket) error {
+	leases := b.Bucket(leaseBucket)
+	if leases == nil {
+		return nil
+	}
+	index, err := b.CreateBucketIfNotExists(deadlineBucket)
+	if err != nil {
+		return err
+	}
+	return leases.ForEach(func(k, v []byte) error {
+		var r leaseRecord
+		if err := decodeValue(v, &r); err != nil {
+			return fmt.Errorf("lease %x: %w", k, err)
+		}
+		return index.Put(deadlineKey(r.Deadline, r.KeyIndex), []byte{})
+	})
+}
+
+// Version 2 layout: no quarantine bucket. Lease records without failures stay valid.
+
+func migrateV3(root *bolt.Bucket) error {
+	_, err := root.CreateBucketIfNotExists(quarantineBucket)
+	return err
+}
+
+// Version 3 layout: the queue length is counted by walking the queue
+
+func migrateV4(root *bolt.Bucket) error {
+	var n uint64
+	if keys := root.Bucket(poolBucket); keys != nil {
+		// Stats doesn't account for the changes made by the previous migrations
+		c := keys.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			n++
+		}
+	}
+	return root.Put(queueLenKey, encodeKey(n))
+}
@@ -0,0 +1,186 @@
+package keypool_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func gobValue(t *testing.T, v any) []byte {
+	var buf bytes.Buffer
+	require.NoError(t, gob.NewEncoder(&buf).Encode(v))
+	return buf.Bytes()
+}
+
+func u64(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// writeV0 creates a pool in the layout used before schema versioning
+func writeV0(t *testing.T, db *bolt.DB, deadline time.Time) {
+	type lease struct {
+		KeyIndex uint64
+		Deadline time.Time
+	}
+	type usage struct {
+		Keys   uint64
+		Amount *big.Int
+	}
+	today := time.Now().UTC().Format("2006-01-02")
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket([]byte("test"))
+		require.NoError(t, err)
+		require.NoError(t, root.Put([]byte("chain"), gobValue(t, &keypool.ChainInfo{ChainID: "A", Genesis: "a"})))
+
+		keys, err := root.CreateBucket([]byte("keys"))
+		require.NoError(t, err)
+		require.NoError(t, keys.SetSequence(6))
+		require.NoError(t, keys.Put(u64(5), gobValue(t, uint64(5))))
+		require.NoError(t, keys.Put(u64(6), gobValue(t, uint64(6))))
+
+		leases, err := root.CreateBucket([]byte("lease"))
+		require.NoError(t, err)
+		// keyed by the queue position
+		require.NoError(t, leases.Put(u64(2), gobValue(t, &lease{KeyIndex: 4, Deadline: deadline})))
+
+		audit, err := root.CreateBucket([]byte("audit"))
+		require.NoError(t, err)
+		require.NoError(t, audit.SetSequence(1))
+		require.NoError(t, audit.Put(u64(1), gobValue(t, &keypool.AuditRecord{Time: deadline.Add(-time.Hour), Op: keypool.AuditLease, KeyIndex: 4, PKH: "4"})))
+
+		quota, err := root.CreateBucket([]byte("quota"))
+		require.NoError(t, err)
+		require.NoError(t, quota.Put([]byte(today+"/a"), gobValue(t, &usage{Keys: 1, Amount: big.NewInt(100)})))
+
+		arch, err := root.CreateBucket([]byte("archive"))
+		require.NoError(t, err)
+		old, err := arch.CreateBucket([]byte("Z@2024-01-01T00:00:00Z"))
+		require.NoError(t, err)
+		require.NoError(t, old.Put([]byte("chain"), gobValue(t, &keypool.ChainInfo{ChainID: "Z", Genesis: "z"})))
+		oldKeys, err := old.CreateBucket([]byte("keys"))
+		require.NoError(t, err)
+		require.NoError(t, oldKeys.Put(u64(1), gobValue(t, uint64(1))))
+		_, err = old.CreateBucket([]byte("lease"))
+		return err
+	}))
+}
+
+func snapshot(t *testing.T, db *bolt.DB) map[string]string {
+	out := make(map[string]string)
+	var walk func(prefix string, b *bolt.Bucket) error
+	walk = func(prefix string, b *bolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return walk(prefix+string(k)+"/", b.Bucket(k))
+			}
+			out[prefix+string(k)] = string(v)
+			return nil
+		})
+	}
+	require.NoError(t, db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			return walk(string(name)+"/", b)
+		})
+	}))
+	return out
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	dbName := filepath.Join(dir, "keygen.db")
+	db, err := bolt.Open(dbName, 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	deadline := time.Now().Add(time.Hour).Round(0)
+	writeV0(t, db, deadline)
+	store := keypool.NewBoltStore(db)
+
+	// dry run leaves the database and the directory alone
+	before := snapshot(t, db)
+	applied, err := store.Migrate("test", true)
+	require.NoError(t, err)
+	assert.Len(t, applied, int(keypool.SchemaVersion))
+	assert.Equal(t, before, snapshot(t, db))
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	charger := ChargerMock{}
+	charger.On("IsDrained", uint64(4)).Return(true, nil).Maybe()
+	pool, err := keypool.New(store, &config{
+		bucket:       "test",
+		bufferLength: 2,
+	}, &charger, nil)
+	require.NoError(t, err)
+	defer pool.Stop(context.Background())
+
+	backups, err := filepath.Glob(dbName + ".*.bak")
+	require.NoError(t, err)
+	assert.Len(t, backups, 1)
+
+	// nothing left to do
+	applied, err = store.Migrate("test", true)
+	require.NoError(t, err)
+	assert.Empty(t, applied)
+
+	info, err := pool.Chain()
+	require.NoError(t, err)
+	assert.Equal(t, &keypool.ChainInfo{ChainID: "A", Genesis: "a"}, info)
+
+	// the lease is indexed by its deadline
+	require.NoError(t, store.View("test", func(tx keypool.Tx) error {
+		next, ok, err := tx.NextDeadline()
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.True(t, deadline.Equal(next))
+		return nil
+	}))
+
+	log, err := pool.AuditLog(&keypool.AuditQuery{})
+	require.NoError(t, err)
+	require.Len(t, log, 1)
+	assert.Equal(t, keypool.AuditLease, log[0].Op)
+	assert.Equal(t, uint64(4), log[0].KeyIndex)
+
+	// the stored usage counts against the quota
+	quota := keypool.Quota{Keys: 2}
+	require.NoError(t, pool.TakeQuota("a", &quota, big.NewInt(1)))
+	require.ErrorIs(t, pool.TakeQuota("a", &quota, big.NewInt(1)), keypool.ErrQuotaExceeded)
+
+	for _, expect := range []uint64{5, 6} {
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expect, idx)
+	}
+	// the lease is found by the key index
+	require.NoError(t, pool.Release(context.Background(), 4))
+}
+
+func TestMigrateNewerSchema(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "keygen.db"), 0600, nil)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket([]byte("test"))
+		if err != nil {
+			return err
+		}
+		return root.Put([]byte("schema"), u64(keypool.SchemaVersion+1))
+	}))
+	_, err = keypool.New(keypool.NewBoltStore(db), &config{bucket: "test", bufferLength: 1}, &ChargerMock{}, nil)
+	require.Error(t, err)
+}
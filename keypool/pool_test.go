@@ -2,29 +2,96 @@ package keypool_test
 
 import (
 	"context"
+	"errors"
+	"math/big"
+	"math/rand"
 	"os"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/identity"
 	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/requestid"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/require"
 	bolt "go.etcd.io/bbolt"
 )
 
+// ChargerMock answers the expected calls. chargeKeys and isDrained, if set, are called instead.
+// Keys are funded in a single batch unless the batches are returned along with the error.
 type ChargerMock struct {
 	mock.Mock
+	chargeKeys func(ctx context.Context, keys []uint64) error
+	isDrained  func(ctx context.Context, key uint64) (bool, error)
 }
 
-func (c *ChargerMock) ChargeKeys(ctx context.Context, keys []uint64) error {
+// opHash is the hash of every batch funded by ChargerMock
+const opHash = "oo"
+
+func fundedBatch(keys []uint64, err error) ([]*keypool.Batch, error) {
+	if err != nil {
+		return nil, err
+	}
+	return []*keypool.Batch{{Keys: keys, OpHash: opHash, Included: true}}, nil
+}
+
+func (c *ChargerMock) ChargeKeys(ctx context.Context, keys []uint64) ([]*keypool.Batch, error) {
+	if c.chargeKeys != nil {
+		return fundedBatch(keys, c.chargeKeys(ctx, keys))
+	}
 	args := c.Called(keys)
-	return args.Error(0)
+	if len(args) == 2 {
+		batches, _ := args.Get(0).([]*keypool.Batch)
+		return batches, args.Error(1)
+	}
+	return fundedBatch(keys, args.Error(0))
 }
 
 func (c *ChargerMock) IsDrained(ctx context.Context, key uint64) (bool, error) {
+	if c.isDrained != nil {
+		return c.isDrained(ctx, key)
+	}
+	args := c.Called(key)
+	return args.Bool(0), args.Error(1)
+}
+
+// fundAfter funds keys after the delay unless interrupted
+func fundAfter(delay func() time.Duration) func(ctx context.Context, keys []uint64) error {
+	return func(ctx context.Context, keys []uint64) error {
+		select {
+		case <-time.After(delay()):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *ChargerMock) Shortfall(ctx context.Context, key uint64) (*big.Int, error) {
 	args := c.Called(key)
+	short, _ := args.Get(0).(*big.Int)
+	return short, args.Error(1)
+}
+
+func (c *ChargerMock) TopUpKeys(ctx context.Context, keys []uint64, amounts []*big.Int) ([]*keypool.Batch, error) {
+	args := c.Called(keys, amounts)
+	return fundedBatch(keys, args.Error(0))
+}
+
+func (c *ChargerMock) Inspect(ctx context.Context, key uint64, rules []string) ([]string, error) {
+	args := c.Called(key, rules)
+	broken, _ := args.Get(0).([]string)
+	return broken, args.Error(1)
+}
+
+func (c *ChargerMock) ResetKey(ctx context.Context, key uint64, broken []string) (bool, error) {
+	args := c.Called(key, broken)
 	return args.Bool(0), args.Error(1)
 }
 
@@ -37,12 +104,47 @@ type config struct {
 	bufferLength    int
 	bufferThreshold int
 	timeout         time.Duration
+	auditRetention  time.Duration
+	recycleRetries  int
+	recycleBackoff  time.Duration
+	recyclePolicy   string
+	topUpLimit      int
+	amount          *big.Int
+	recycleRules    []string
+	dirtyKeys       string
+}
+
+func (n *config) GetBucket() string                { return n.bucket }
+func (n *config) GetBufferLength() int             { return n.bufferLength }
+func (n *config) GetBufferThreshold() int          { return n.bufferThreshold }
+func (n *config) GetTimeout() time.Duration        { return n.timeout }
+func (n *config) GetAuditRetention() time.Duration { return n.auditRetention }
+func (n *config) GetRecycleRetries() int           { return n.recycleRetries }
+func (n *config) GetRecycleBackoff() time.Duration { return n.recycleBackoff }
+func (n *config) GetRecyclePolicy() string         { return n.recyclePolicy }
+func (n *config) GetTopUpLimit() int               { return n.topUpLimit }
+func (n *config) GetAmount() *big.Int              { return n.amount }
+func (n *config) GetRecycleRules() []string        { return n.recycleRules }
+func (n *config) GetDirtyKeys() string             { return n.dirtyKeys }
+
+func newBoltStore(t *testing.T) keypool.Store {
+	fd, err := os.CreateTemp("", "bolt")
+	require.NoError(t, err)
+	dbName := fd.Name()
+	fd.Close()
+	t.Cleanup(func() { os.Remove(dbName) })
+
+	db, err := bolt.Open(dbName, 0600, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return keypool.NewBoltStore(db)
 }
 
-func (n *config) GetBucket() string         { return n.bucket }
-func (n *config) GetBufferLength() int      { return n.bufferLength }
-func (n *config) GetBufferThreshold() int   { return n.bufferThreshold }
-func (n *config) GetTimeout() time.Duration { return n.timeout }
+// forEachStore runs the test against every backend
+func forEachStore(t *testing.T, fn func(t *testing.T, store keypool.Store)) {
+	t.Run("bolt", func(t *testing.T) { fn(t, newBoltStore(t)) })
+	t.Run("memory", func(t *testing.T) { fn(t, keypool.NewMemStore()) })
+}
 
 func TestPool(t *testing.T) {
 	fd, err := os.CreateTemp("", "bolt")
@@ -61,12 +163,59 @@ func TestPool(t *testing.T) {
 	charger.On("ChargeKeys", []uint64{21, 22, 23, 24, 25, 26, 27, 28, 29, 30}).Return(nil)
 	charger.On("IsDrained", uint64(21)).Return(false, nil)
 
-	pool, err := keypool.New(db, &config{
+	pool, err := keypool.New(keypool.NewBoltStore(db), &config{
+		bucket:          "test",
+		bufferLength:    10,
+		bufferThreshold: 0,
+		timeout:         0,
+	}, &charger, nil)
+	require.NoError(t, err)
+
+	// test get
+	for n := 0; n < 20; n++ {
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(n+1), idx)
+	}
+
+	// test lease
+	idx, err := pool.Lease(context.Background(), time.Now().Add(time.Second/2))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(21), idx)
+	<-time.After(time.Second)
+
+	for n := 0; n < 9; n++ {
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(n+22), idx)
+	}
+	// 21 comes last
+	idx, err = pool.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(21), idx)
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+// TestPoolStores runs the scenario of TestPool against every backend
+func TestPoolStores(t *testing.T) {
+	forEachStore(t, testPool)
+}
+
+func testPool(t *testing.T, store keypool.Store) {
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}).Return(nil)
+	charger.On("ChargeKeys", []uint64{11, 12, 13, 14, 15, 16, 17, 18, 19, 20}).Return(nil)
+	charger.On("ChargeKeys", []uint64{21, 22, 23, 24, 25, 26, 27, 28, 29, 30}).Return(nil)
+	charger.On("IsDrained", uint64(21)).Return(false, nil)
+
+	pool, err := keypool.New(store, &config{
 		bucket:          "test",
 		bufferLength:    10,
 		bufferThreshold: 0,
 		timeout:         0,
-	}, &charger)
+	}, &charger, nil)
 	require.NoError(t, err)
 
 	// test get
@@ -95,3 +244,1317 @@ func TestPool(t *testing.T) {
 	charger.AssertExpectations(t)
 	require.NoError(t, pool.Stop(context.Background()))
 }
+
+func TestRelease(t *testing.T) {
+	forEachStore(t, testRelease)
+}
+
+func testRelease(t *testing.T, store keypool.Store) {
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2}).Return(nil)
+	charger.On("IsDrained", uint64(1)).Return(false, nil)
+
+	pool, err := keypool.New(store, &config{
+		bucket:          "test",
+		bufferLength:    2,
+		bufferThreshold: 0,
+	}, &charger, nil)
+	require.NoError(t, err)
+
+	idx, err := pool.Lease(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), idx)
+
+	require.ErrorIs(t, pool.Release(context.Background(), 2), keypool.ErrNotLeased)
+	require.NoError(t, pool.Release(context.Background(), 1))
+
+	// recycled key goes after the buffered one
+	require.Eventually(t, func() bool {
+		cnt, err := pool.Count()
+		return err == nil && cnt == 2
+	}, time.Second, 10*time.Millisecond)
+	for _, expect := range []uint64{2, 1} {
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expect, idx)
+	}
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestQuota(t *testing.T) {
+	forEachStore(t, testQuota)
+}
+
+func testQuota(t *testing.T, store keypool.Store) {
+	pool, err := keypool.New(store, &config{
+		bucket:       "test",
+		bufferLength: 1,
+	}, &ChargerMock{}, nil)
+	require.NoError(t, err)
+
+	quota := keypool.Quota{Keys: 3, Amount: big.NewInt(250)}
+	require.NoError(t, pool.TakeQuota("a", &quota, big.NewInt(100)))
+	require.NoError(t, pool.TakeQuota("a", &quota, big.NewInt(100)))
+	// amount exceeded
+	require.ErrorIs(t, pool.TakeQuota("a", &quota, big.NewInt(100)), keypool.ErrQuotaExceeded)
+	// other client
+	require.NoError(t, pool.TakeQuota("b", &quota, big.NewInt(100)))
+
+	require.NoError(t, pool.ReturnQuota("a", big.NewInt(100)))
+	require.NoError(t, pool.TakeQuota("a", &quota, big.NewInt(10)))
+	require.NoError(t, pool.TakeQuota("a", &quota, big.NewInt(10)))
+	// keys exceeded
+	require.ErrorIs(t, pool.TakeQuota("a", &quota, big.NewInt(10)), keypool.ErrQuotaExceeded)
+
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestAudit(t *testing.T) {
+	forEachStore(t, testAudit)
+}
+
+func testAudit(t *testing.T, store keypool.Store) {
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2, 3}).Return(nil)
+	charger.On("IsDrained", uint64(2)).Return(true, nil)
+
+	pool, err := keypool.New(store, &config{
+		bucket:       "test",
+		bufferLength: 3,
+	}, &charger, nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	ctx := identity.NewContext(context.Background(), &identity.Identity{Name: "ci", Method: identity.MethodToken})
+	ctx = requestid.NewContext(ctx, "req")
+
+	_, err = pool.Get(ctx)
+	require.NoError(t, err)
+	_, err = pool.Lease(ctx, time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	snapshot, err := pool.Export()
+	require.NoError(t, err)
+	require.Len(t, snapshot.Leases, 1)
+	assert.Equal(t, "token:ci", snapshot.Leases[0].Identity)
+
+	require.NoError(t, pool.Sign(ctx, 2))
+	// popped, not leased
+	require.ErrorIs(t, pool.Sign(ctx, 1), keypool.ErrNotLeased)
+	require.NoError(t, pool.Release(ctx, 2))
+	require.ErrorIs(t, pool.Sign(ctx, 2), keypool.ErrNotLeased)
+
+	var log []*keypool.AuditRecord
+	require.Eventually(t, func() bool {
+		log, err = pool.AuditLog(&keypool.AuditQuery{Since: start})
+		require.NoError(t, err)
+		return len(log) == 5
+	}, time.Second, 10*time.Millisecond)
+
+	ops := make([]string, len(log))
+	for i, r := range log {
+		ops[i] = r.Op
+	}
+	assert.Equal(t, []string{keypool.AuditPop, keypool.AuditLease, keypool.AuditSign, keypool.AuditRelease, keypool.AuditDiscard}, ops)
+	assert.Equal(t, "token:ci", log[0].Identity)
+	assert.Equal(t, "req", log[0].RequestID)
+	assert.Equal(t, "", log[4].Identity)
+
+	log, err = pool.AuditLog(&keypool.AuditQuery{Since: start, PKH: "2"})
+	require.NoError(t, err)
+	assert.Len(t, log, 4)
+
+	log, err = pool.AuditLog(&keypool.AuditQuery{Since: time.Now().Add(time.Minute)})
+	require.NoError(t, err)
+	assert.Empty(t, log)
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestAuditLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		start := time.Now().Round(0)
+		require.NoError(t, store.Init("test"))
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			for i := 0; i < 6; i++ {
+				require.NoError(t, tx.AppendAudit(&keypool.AuditRecord{
+					Time:     start.Add(time.Duration(i) * time.Minute),
+					Op:       keypool.AuditPop,
+					KeyIndex: uint64(i),
+					PKH:      strconv.Itoa(i % 2),
+				}))
+			}
+			return nil
+		}))
+
+		query := func(q keypool.AuditQuery) (indices, ids []uint64) {
+			require.NoError(t, store.View("test", func(tx keypool.Tx) error {
+				log, err := tx.AuditLog(&q)
+				require.NoError(t, err)
+				for _, r := range log {
+					indices = append(indices, r.KeyIndex)
+					ids = append(ids, r.ID)
+				}
+				return nil
+			}))
+			return
+		}
+
+		indices, ids := query(keypool.AuditQuery{})
+		assert.Equal(t, []uint64{0, 1, 2, 3, 4, 5}, indices)
+		assert.Equal(t, []uint64{1, 2, 3, 4, 5, 6}, ids)
+
+		indices, _ = query(keypool.AuditQuery{Since: start.Add(2 * time.Minute)})
+		assert.Equal(t, []uint64{2, 3, 4, 5}, indices)
+
+		// the most recent ones first, then page back
+		indices, ids = query(keypool.AuditQuery{PKH: "1", Limit: 2})
+		assert.Equal(t, []uint64{3, 5}, indices)
+		indices, _ = query(keypool.AuditQuery{PKH: "1", Limit: 2, Before: ids[0]})
+		assert.Equal(t, []uint64{1}, indices)
+
+		indices, _ = query(keypool.AuditQuery{Since: start.Add(time.Minute), Before: 4, Limit: 5})
+		assert.Equal(t, []uint64{1, 2}, indices)
+		indices, _ = query(keypool.AuditQuery{Before: 100, Limit: 1})
+		assert.Equal(t, []uint64{5}, indices)
+		indices, _ = query(keypool.AuditQuery{Before: 1})
+		assert.Empty(t, indices)
+	})
+}
+
+func TestAuditPrune(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		now := time.Now()
+		require.NoError(t, store.Init("test"))
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			require.NoError(t, tx.AppendAudit(&keypool.AuditRecord{Time: now.Add(-2 * time.Hour), Op: keypool.AuditPop, KeyIndex: 1}))
+			return tx.AppendAudit(&keypool.AuditRecord{Time: now, Op: keypool.AuditPop, KeyIndex: 2})
+		}))
+
+		pool, err := keypool.New(store, &config{
+			bucket:         "test",
+			bufferLength:   1,
+			auditRetention: time.Hour,
+		}, &ChargerMock{}, nil)
+		require.NoError(t, err)
+
+		// pruned once the pool starts, not by the next audited operation
+		require.Eventually(t, func() bool {
+			log, err := pool.AuditLog(&keypool.AuditQuery{})
+			require.NoError(t, err)
+			return len(log) == 1 && log[0].KeyIndex == 2
+		}, time.Second, 10*time.Millisecond)
+
+		require.NoError(t, pool.Stop(context.Background()))
+	})
+}
+
+func TestSetChain(t *testing.T) {
+	forEachStore(t, testSetChain)
+}
+
+func testSetChain(t *testing.T, store keypool.Store) {
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2}).Return(nil)
+	charger.On("ChargeKeys", []uint64{3, 4}).Return(nil)
+
+	pool, err := keypool.New(store, &config{
+		bucket:       "test",
+		bufferLength: 2,
+	}, &charger, nil)
+	require.NoError(t, err)
+
+	a := keypool.ChainInfo{ChainID: "A", Genesis: "a"}
+	reset, err := pool.SetChain(&a, true)
+	require.NoError(t, err)
+	assert.False(t, reset)
+	info, err := pool.Chain()
+	require.NoError(t, err)
+	assert.Equal(t, &a, info)
+
+	idx, err := pool.Lease(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), idx)
+
+	reset, err = pool.SetChain(&a, true)
+	require.NoError(t, err)
+	assert.False(t, reset)
+
+	// the sequence is continued
+	reset, err = pool.SetChain(&keypool.ChainInfo{ChainID: "B", Genesis: "b"}, true)
+	require.NoError(t, err)
+	assert.True(t, reset)
+	cnt, err := pool.Count()
+	require.NoError(t, err)
+	assert.Equal(t, 0, cnt)
+	require.ErrorIs(t, pool.Release(context.Background(), 1), keypool.ErrNotLeased)
+	idx, err = pool.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), idx)
+
+	// the sequence starts over
+	reset, err = pool.SetChain(&keypool.ChainInfo{ChainID: "C", Genesis: "c"}, false)
+	require.NoError(t, err)
+	assert.True(t, reset)
+	idx, err = pool.Get(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), idx)
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestResetWhileFunding(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		// the hook of a call, if any, runs while funding
+		var (
+			mtx    sync.Mutex
+			funded [][]uint64
+			hooks  []func() error
+		)
+		charger := ChargerMock{chargeKeys: func(ctx context.Context, keys []uint64) error {
+			mtx.Lock()
+			call := len(funded)
+			funded = append(funded, keys)
+			mtx.Unlock()
+			if call < len(hooks) {
+				return hooks[call]()
+			}
+			return nil
+		}}
+		pool, err := keypool.New(store, &config{
+			bucket:       "test",
+			bufferLength: 2,
+		}, &charger, nil)
+		require.NoError(t, err)
+		_, err = pool.SetChain(&keypool.ChainInfo{ChainID: "A", Genesis: "a"}, true)
+		require.NoError(t, err)
+
+		errFailed := errors.New("failed")
+		hooks = []func() error{
+			// given back
+			func() error { return errFailed },
+			func() error {
+				_, err := pool.SetChain(&keypool.ChainInfo{ChainID: "B", Genesis: "b"}, true)
+				return err
+			},
+		}
+		_, err = pool.Get(context.Background())
+		require.ErrorIs(t, err, errFailed)
+		// the keys funded for A are dropped and not funded again
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), idx)
+		require.NoError(t, pool.Stop(context.Background()))
+
+		assert.Equal(t, [][]uint64{{1, 2}, {1, 2}, {3, 4}}, funded)
+		s, err := keypool.Export(store, "test")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(4), s.Sequence)
+		assert.Equal(t, []uint64{4}, s.Queue)
+	})
+}
+
+func TestFundingFailure(t *testing.T) {
+	errFailed := errors.New("failed")
+	tests := []struct {
+		name    string
+		batches []*keypool.Batch
+		// served from the funded keys
+		served   bool
+		queue    []uint64
+		sequence uint64
+	}{
+		{
+			name: "funded prefix",
+			batches: []*keypool.Batch{
+				{Keys: []uint64{1, 2}, OpHash: "o1", Included: true},
+				{Keys: []uint64{3}, OpHash: "o2"},
+			},
+			served:   true,
+			queue:    []uint64{2},
+			sequence: 4,
+		},
+		{
+			name:     "injected",
+			batches:  []*keypool.Batch{{Keys: []uint64{1, 2}, OpHash: "o1"}},
+			sequence: 4,
+		},
+		{
+			name: "given back",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store keypool.Store) {
+				charger := ChargerMock{}
+				charger.On("ChargeKeys", []uint64{1, 2, 3, 4}).Return(tt.batches, errFailed).Once()
+				// the failed request may have woken the funder twice
+				charger.On("ChargeKeys", mock.Anything).Return(errFailed).Maybe()
+				bus := events.NewBus()
+				ch, unsubscribe := bus.Subscribe(events.DefaultBuffer)
+				defer unsubscribe()
+
+				pool, err := keypool.New(store, &config{
+					bucket:       "test",
+					bufferLength: 4,
+				}, &charger, bus)
+				require.NoError(t, err)
+				idx, err := pool.Get(context.Background())
+				if tt.served {
+					require.NoError(t, err)
+					assert.Equal(t, uint64(1), idx)
+				} else {
+					require.ErrorIs(t, err, errFailed)
+				}
+				require.NoError(t, pool.Stop(context.Background()))
+
+				s, err := keypool.Export(store, "test")
+				require.NoError(t, err)
+				assert.ElementsMatch(t, tt.queue, s.Queue)
+				assert.Equal(t, tt.sequence, s.Sequence)
+
+				var confirmed [][]uint64
+				for len(ch) != 0 {
+					if e := <-ch; e.Type == events.BatchConfirmed {
+						confirmed = append(confirmed, e.Keys)
+					}
+				}
+				if tt.served {
+					assert.Equal(t, [][]uint64{{1, 2}}, confirmed)
+				} else {
+					assert.Empty(t, confirmed)
+				}
+				charger.AssertExpectations(t)
+			})
+		})
+	}
+}
+
+func TestStoreRemove(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		require.NoError(t, store.Init("test"))
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			for _, index := range []uint64{1, 2, 3} {
+				if err := tx.Push(index); err != nil {
+					return err
+				}
+			}
+			return nil
+		}))
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			ok, err := tx.Remove(2)
+			require.NoError(t, err)
+			assert.True(t, ok)
+			ok, err = tx.Remove(4)
+			require.NoError(t, err)
+			assert.False(t, ok)
+			return nil
+		}))
+		require.NoError(t, store.View("test", func(tx keypool.Tx) error {
+			queue, err := tx.Queue()
+			require.NoError(t, err)
+			assert.Equal(t, []uint64{1, 3}, queue)
+			n, err := tx.Len()
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+			return nil
+		}))
+	})
+}
+
+// storeState reads everything a transaction can change
+func storeState(t *testing.T, store keypool.Store) (snapshot *keypool.Snapshot, audit []*keypool.AuditRecord, quota *keypool.QuotaUsage) {
+	require.NoError(t, store.View("test", func(tx keypool.Tx) (err error) {
+		if audit, err = tx.AuditLog(&keypool.AuditQuery{}); err != nil {
+			return err
+		}
+		quota, err = tx.GetQuotaUsage("2024-01-01", "client")
+		return err
+	}))
+	snapshot, err := keypool.Export(store, "test")
+	require.NoError(t, err)
+	return snapshot, audit, quota
+}
+
+func TestStoreRollback(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		deadline := time.Now().Add(time.Hour).Round(0)
+		require.NoError(t, store.Init("test"))
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			for _, index := range []uint64{1, 2, 3} {
+				if err := tx.Push(index); err != nil {
+					return err
+				}
+			}
+			if err := tx.SetSequence(5); err != nil {
+				return err
+			}
+			if err := tx.PutLease(&keypool.Lease{KeyIndex: 4, Deadline: deadline}); err != nil {
+				return err
+			}
+			if err := tx.PutQuarantined(&keypool.Quarantined{KeyIndex: 5, Time: deadline, Failures: 1}); err != nil {
+				return err
+			}
+			if err := tx.AppendAudit(&keypool.AuditRecord{Time: deadline, Op: keypool.AuditPop, KeyIndex: 1}); err != nil {
+				return err
+			}
+			if err := tx.PutQuotaUsage("2024-01-01", "client", &keypool.QuotaUsage{Keys: 1, Amount: big.NewInt(10)}); err != nil {
+				return err
+			}
+			return tx.SetChain(&keypool.ChainInfo{ChainID: "a", Genesis: "a"})
+		}))
+		snapshot, audit, quota := storeState(t, store)
+
+		errFailed := errors.New("failed")
+		changeAll := func(tx keypool.Tx) error {
+			_, _, err := tx.Pop()
+			require.NoError(t, err)
+			require.NoError(t, tx.Push(6))
+			_, err = tx.Remove(2)
+			require.NoError(t, err)
+			_, err = tx.NextSequence()
+			require.NoError(t, err)
+			require.NoError(t, tx.PutLease(&keypool.Lease{KeyIndex: 4, Deadline: deadline, Failures: 2}))
+			require.NoError(t, tx.PutLease(&keypool.Lease{KeyIndex: 7, Deadline: deadline}))
+			require.NoError(t, tx.DeleteQuarantined(5))
+			require.NoError(t, tx.PutQuarantined(&keypool.Quarantined{KeyIndex: 8, Time: deadline}))
+			require.NoError(t, tx.AppendAudit(&keypool.AuditRecord{Time: deadline, Op: keypool.AuditPop, KeyIndex: 3}))
+			require.NoError(t, tx.PruneAudit(deadline.Add(time.Hour)))
+			require.NoError(t, tx.PutQuotaUsage("2024-01-01", "client", &keypool.QuotaUsage{Keys: 2, Amount: big.NewInt(20)}))
+			require.NoError(t, tx.PruneQuota("2024-01-02"))
+			require.NoError(t, tx.Archive("old"))
+			require.NoError(t, tx.SetChain(&keypool.ChainInfo{ChainID: "b", Genesis: "b"}))
+			require.NoError(t, tx.Push(9))
+			require.NoError(t, tx.DeleteLease(7))
+			return nil
+		}
+
+		require.ErrorIs(t, store.Update("test", func(tx keypool.Tx) error {
+			changeAll(tx)
+			return errFailed
+		}), errFailed)
+		s, a, q := storeState(t, store)
+		assert.Equal(t, snapshot, s)
+		assert.Equal(t, audit, a)
+		assert.Equal(t, quota, q)
+
+		assert.Panics(t, func() {
+			store.Update("test", func(tx keypool.Tx) error {
+				changeAll(tx)
+				panic(errFailed)
+			})
+		})
+		s, a, q = storeState(t, store)
+		assert.Equal(t, snapshot, s)
+		assert.Equal(t, audit, a)
+		assert.Equal(t, quota, q)
+
+		// the archive was rolled back too
+		require.NoError(t, store.Update("test", changeAll))
+		s, _, _ = storeState(t, store)
+		assert.Equal(t, []uint64{9}, s.Queue)
+		assert.Equal(t, "b", s.Chain.ChainID)
+	})
+}
+
+func TestLeaseDeadlines(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		require.NoError(t, store.Init("test"))
+		now := time.Now().Round(0)
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			for index, d := range []time.Duration{3 * time.Minute, -time.Minute, time.Minute, -time.Minute, -2 * time.Minute} {
+				if err := tx.PutLease(&keypool.Lease{KeyIndex: uint64(index + 1), Deadline: now.Add(d)}); err != nil {
+					return err
+				}
+			}
+			// moved earlier as on release
+			if err := tx.PutLease(&keypool.Lease{KeyIndex: 1, Deadline: now}); err != nil {
+				return err
+			}
+			return tx.DeleteLease(3)
+		}))
+
+		require.NoError(t, store.View("test", func(tx keypool.Tx) error {
+			next, ok, err := tx.NextDeadline()
+			require.NoError(t, err)
+			assert.True(t, ok)
+			assert.True(t, now.Add(-2*time.Minute).Equal(next))
+
+			expired, err := tx.ExpiredLeases(now)
+			require.NoError(t, err)
+			indices := make([]uint64, len(expired))
+			for i, l := range expired {
+				indices[i] = l.KeyIndex
+			}
+			// earliest first, ties in key order
+			assert.Equal(t, []uint64{5, 2, 4, 1}, indices)
+			return nil
+		}))
+
+		require.NoError(t, store.Update("test", func(tx keypool.Tx) error {
+			for _, index := range []uint64{1, 2, 4, 5} {
+				if err := tx.DeleteLease(index); err != nil {
+					return err
+				}
+			}
+			_, ok, err := tx.NextDeadline()
+			require.NoError(t, err)
+			assert.False(t, ok)
+			return nil
+		}))
+	})
+}
+
+// flakyStore fails the next read or write when told to
+type flakyStore struct {
+	keypool.Store
+	failView   atomic.Bool
+	failUpdate atomic.Bool
+}
+
+var errFlaky = errors.New("flaky")
+
+func (s *flakyStore) View(pool string, fn func(tx keypool.Tx) error) error {
+	if s.failView.CompareAndSwap(true, false) {
+		return errFlaky
+	}
+	return s.Store.View(pool, fn)
+}
+
+func (s *flakyStore) Update(pool string, fn func(tx keypool.Tx) error) error {
+	if s.failUpdate.CompareAndSwap(true, false) {
+		return errFlaky
+	}
+	return s.Store.Update(pool, fn)
+}
+
+func TestRecycleRetry(t *testing.T) {
+	for name, fail := range map[string]func(s *flakyStore){
+		"view":   func(s *flakyStore) { s.failView.Store(true) },
+		"update": func(s *flakyStore) { s.failUpdate.Store(true) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			forEachStore(t, func(t *testing.T, store keypool.Store) {
+				charger := ChargerMock{}
+				charger.On("ChargeKeys", []uint64{1, 2, 3}).Return(nil)
+				charger.On("IsDrained", uint64(1)).Return(false, nil)
+
+				flaky := &flakyStore{Store: store}
+				pool, err := keypool.New(flaky, &config{
+					bucket:         "test",
+					bufferLength:   3,
+					recycleBackoff: 20 * time.Millisecond,
+				}, &charger, nil)
+				require.NoError(t, err)
+
+				idx, err := pool.Lease(context.Background(), time.Now().Add(50*time.Millisecond))
+				require.NoError(t, err)
+				assert.Equal(t, uint64(1), idx)
+				fail(flaky)
+
+				// nothing else happens in the pool
+				require.Eventually(t, func() bool {
+					s, err := keypool.Export(store, "test")
+					return err == nil && len(s.Leases) == 0 && len(s.Queue) == 3
+				}, 2*time.Second, 10*time.Millisecond)
+				assert.False(t, flaky.failView.Load() || flaky.failUpdate.Load())
+				require.NoError(t, pool.Stop(context.Background()))
+			})
+		})
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	forEachStore(t, testQuarantine)
+}
+
+func testQuarantine(t *testing.T, store keypool.Store) {
+	rpcErr := errors.New("rpc")
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2, 3}).Return(nil)
+	charger.On("IsDrained", uint64(1)).Return(false, rpcErr).Times(3)
+	charger.On("IsDrained", uint64(1)).Return(false, nil).Once()
+	charger.On("IsDrained", uint64(2)).Return(false, rpcErr).Times(3)
+
+	bus := events.NewBus()
+	ch, unsubscribe := bus.Subscribe(events.DefaultBuffer)
+	defer unsubscribe()
+
+	pool, err := keypool.New(store, &config{
+		bucket:         "test",
+		bufferLength:   3,
+		recycleRetries: 3,
+		recycleBackoff: 50 * time.Millisecond,
+	}, &charger, bus)
+	require.NoError(t, err)
+
+	for _, expect := range []uint64{1, 2} {
+		idx, err := pool.Lease(context.Background(), time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, expect, idx)
+	}
+
+	// failures are recorded on the lease while it's retried
+	require.Eventually(t, func() bool {
+		s, err := pool.Export()
+		require.NoError(t, err)
+		return len(s.Leases) == 2 && s.Leases[0].Failures != 0 && s.Leases[0].Error == "rpc"
+	}, time.Second, 5*time.Millisecond)
+
+	var quarantined []*keypool.Quarantined
+	require.Eventually(t, func() bool {
+		quarantined, err = pool.Quarantined()
+		require.NoError(t, err)
+		return len(quarantined) == 2
+	}, 2*time.Second, 10*time.Millisecond)
+	for i, q := range quarantined {
+		assert.Equal(t, uint64(i+1), q.KeyIndex)
+		assert.Equal(t, 3, q.Failures)
+		assert.Equal(t, "rpc", q.Error)
+	}
+	s, err := pool.Export()
+	require.NoError(t, err)
+	assert.Empty(t, s.Leases)
+
+	// released keys are checked again
+	require.NoError(t, pool.ReleaseQuarantined(context.Background(), 1))
+	require.Eventually(t, func() bool {
+		cnt, err := pool.Count()
+		return err == nil && cnt == 2
+	}, time.Second, 10*time.Millisecond)
+	require.NoError(t, pool.DiscardQuarantined(context.Background(), 2))
+	require.ErrorIs(t, pool.DiscardQuarantined(context.Background(), 2), keypool.ErrNotQuarantined)
+	require.ErrorIs(t, pool.ReleaseQuarantined(context.Background(), 3), keypool.ErrNotQuarantined)
+
+	quarantined, err = pool.Quarantined()
+	require.NoError(t, err)
+	assert.Empty(t, quarantined)
+	for _, expect := range []uint64{3, 1} {
+		idx, err := pool.Get(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, expect, idx)
+	}
+
+	var got []string
+	for len(got) < 8 {
+		select {
+		case e := <-ch:
+			if e.Type != events.BatchConfirmed && e.Type != events.Funded {
+				got = append(got, e.Type)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	assert.Equal(t, []string{
+		events.Leased, events.Leased,
+		events.Quarantined, events.Quarantined,
+		events.Released, events.Recycled, events.Discarded,
+		events.Popped,
+	}, got)
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestEvents(t *testing.T) {
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2}).Return(nil)
+	charger.On("IsDrained", uint64(2)).Return(true, nil)
+
+	bus := events.NewBus()
+	ch, unsubscribe := bus.Subscribe(events.DefaultBuffer)
+	defer unsubscribe()
+
+	pool, err := keypool.New(keypool.NewMemStore(), &config{
+		bucket:       "test",
+		bufferLength: 2,
+	}, &charger, bus)
+	require.NoError(t, err)
+
+	_, err = pool.Get(context.Background())
+	require.NoError(t, err)
+	_, err = pool.Lease(context.Background(), time.Now().Add(time.Hour))
+	require.NoError(t, err)
+	// not published on failure
+	require.ErrorIs(t, pool.Release(context.Background(), 1), keypool.ErrNotLeased)
+	require.NoError(t, pool.Release(context.Background(), 2))
+
+	expect := []events.Event{
+		{Type: events.BatchConfirmed, Keys: []uint64{1, 2}, OpHash: opHash},
+		{Type: events.Funded, ID: 1, PKH: "1", OpHash: opHash},
+		{Type: events.Funded, ID: 2, PKH: "2", OpHash: opHash},
+		{Type: events.Popped, ID: 1, PKH: "1"},
+		{Type: events.Leased, ID: 2, PKH: "2"},
+		{Type: events.Released, ID: 2, PKH: "2"},
+		{Type: events.Discarded, ID: 2, PKH: "2"},
+	}
+	for _, x := range expect {
+		select {
+		case e := <-ch:
+			assert.Equal(t, x.Type, e.Type)
+			assert.Equal(t, x.ID, e.ID)
+			assert.Equal(t, x.PKH, e.PKH)
+			assert.Equal(t, x.Keys, e.Keys)
+			assert.Equal(t, x.OpHash, e.OpHash)
+		case <-time.After(time.Second):
+			t.Fatalf("%s: timeout", x.Type)
+		}
+	}
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestTopUp(t *testing.T) {
+	forEachStore(t, testTopUp)
+}
+
+func testTopUp(t *testing.T, store keypool.Store) {
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2, 3, 4}).Return(nil)
+	charger.On("Shortfall", uint64(1)).Return(new(big.Int), nil).Once()
+	charger.On("Shortfall", uint64(2)).Return(big.NewInt(30), nil).Twice()
+	// over the limit
+	charger.On("Shortfall", uint64(3)).Return(big.NewInt(80), nil).Once()
+	charger.On("Shortfall", uint64(4)).Return(big.NewInt(10), nil).Twice()
+	charger.On("TopUpKeys", []uint64{2, 4}, []*big.Int{big.NewInt(30), big.NewInt(10)}).Return(errors.New("rpc")).Once()
+	// retries are due one by one
+	charger.On("TopUpKeys", []uint64{2}, []*big.Int{big.NewInt(30)}).Return(nil).Once()
+	charger.On("TopUpKeys", []uint64{4}, []*big.Int{big.NewInt(10)}).Return(nil).Once()
+
+	bus := events.NewBus()
+	ch, unsubscribe := bus.Subscribe(events.DefaultBuffer)
+	defer unsubscribe()
+
+	pool, err := keypool.New(store, &config{
+		bucket:         "test",
+		bufferLength:   4,
+		recycleRetries: 3,
+		recycleBackoff: 50 * time.Millisecond,
+		recyclePolicy:  keypool.RecycleTopUp,
+		topUpLimit:     50,
+		amount:         big.NewInt(100),
+	}, &charger, bus)
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(100 * time.Millisecond)
+	for expect := uint64(1); expect <= 4; expect++ {
+		idx, err := pool.Lease(context.Background(), deadline)
+		require.NoError(t, err)
+		assert.Equal(t, expect, idx)
+	}
+
+	counts := make(map[string]int)
+	// one funding batch and the two top-ups that went through
+	for counts[events.ToppedUp] < 2 || counts[events.BatchConfirmed] < 3 {
+		select {
+		case e := <-ch:
+			counts[e.Type]++
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	assert.Equal(t, 1, counts[events.Recycled])
+	assert.Equal(t, 1, counts[events.Discarded])
+	// top-ups don't fund new keys
+	assert.Equal(t, 4, counts[events.Funded])
+
+	s, err := pool.Export()
+	require.NoError(t, err)
+	assert.Empty(t, s.Leases)
+	assert.ElementsMatch(t, []uint64{1, 2, 4}, s.Queue)
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestRecycleRules(t *testing.T) {
+	forEachStore(t, testRecycleRules)
+}
+
+func testRecycleRules(t *testing.T, store keypool.Store) {
+	rules := []string{"no-delegate", "no-pending-ops"}
+	charger := ChargerMock{}
+	charger.On("ChargeKeys", []uint64{1, 2, 3, 4, 5}).Return(nil)
+	charger.On("Inspect", uint64(1), rules).Return(nil, nil).Once()
+	charger.On("IsDrained", uint64(1)).Return(false, nil).Once()
+	charger.On("Inspect", uint64(2), rules).Return([]string{"no-delegate"}, nil).Once()
+	charger.On("ResetKey", uint64(2), []string{"no-delegate"}).Return(true, nil).Once()
+	charger.On("Inspect", uint64(2), rules).Return(nil, nil).Once()
+	charger.On("IsDrained", uint64(2)).Return(false, nil).Once()
+	// can't be reset
+	charger.On("Inspect", uint64(3), rules).Return([]string{"no-pending-ops"}, nil).Once()
+	charger.On("ResetKey", uint64(3), []string{"no-pending-ops"}).Return(false, nil).Once()
+	// retried
+	charger.On("Inspect", uint64(4), rules).Return(nil, errors.New("rpc")).Once()
+	charger.On("Inspect", uint64(4), rules).Return(nil, nil).Once()
+	charger.On("IsDrained", uint64(4)).Return(false, nil).Once()
+	// the reset didn't help
+	charger.On("Inspect", uint64(5), rules).Return([]string{"no-delegate"}, nil).Once()
+	charger.On("ResetKey", uint64(5), []string{"no-delegate"}).Return(true, nil).Once()
+	charger.On("Inspect", uint64(5), rules).Return([]string{"no-delegate"}, nil).Once()
+
+	bus := events.NewBus()
+	ch, unsubscribe := bus.Subscribe(events.DefaultBuffer)
+	defer unsubscribe()
+
+	pool, err := keypool.New(store, &config{
+		bucket:         "test",
+		bufferLength:   5,
+		recycleRetries: 3,
+		recycleBackoff: 50 * time.Millisecond,
+		recycleRules:   rules,
+		dirtyKeys:      keypool.DirtyReset,
+	}, &charger, bus)
+	require.NoError(t, err)
+
+	deadline := time.Now().Add(50 * time.Millisecond)
+	for expect := uint64(1); expect <= 5; expect++ {
+		idx, err := pool.Lease(context.Background(), deadline)
+		require.NoError(t, err)
+		assert.Equal(t, expect, idx)
+	}
+
+	outcome := make(map[uint64]string)
+	for len(outcome) < 5 {
+		select {
+		case e := <-ch:
+			if e.Type == events.Recycled || e.Type == events.Discarded {
+				outcome[e.ID] = e.Type
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	assert.Equal(t, map[uint64]string{
+		1: events.Recycled,
+		2: events.Recycled,
+		3: events.Discarded,
+		4: events.Recycled,
+		5: events.Discarded,
+	}, outcome)
+
+	s, err := pool.Export()
+	require.NoError(t, err)
+	assert.Empty(t, s.Leases)
+	assert.Equal(t, []uint64{1, 2, 4}, s.Queue)
+
+	charger.AssertExpectations(t)
+	require.NoError(t, pool.Stop(context.Background()))
+}
+
+func TestStopInterruptsFunding(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		// funds nothing until the context is done
+		started := make(chan struct{})
+		charger := ChargerMock{chargeKeys: func(ctx context.Context, keys []uint64) error {
+			close(started)
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+		pool, err := keypool.New(store, &config{
+			bucket:       "test",
+			bufferLength: 2,
+		}, &charger, nil)
+		require.NoError(t, err)
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := pool.Get(context.Background())
+			errCh <- err
+		}()
+		<-started
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		require.NoError(t, pool.Stop(ctx))
+		require.ErrorIs(t, <-errCh, keypool.ErrStopped)
+
+		// rolled back
+		s, err := keypool.Export(store, "test")
+		require.NoError(t, err)
+		assert.Equal(t, uint64(0), s.Sequence)
+		assert.Empty(t, s.Queue)
+	})
+}
+
+// commitHookStore calls onCommit with the audit records of every committed transaction
+type commitHookStore struct {
+	keypool.Store
+	onCommit func(records []*keypool.AuditRecord)
+}
+
+type auditRecorder struct {
+	keypool.Tx
+	records []*keypool.AuditRecord
+}
+
+func (t *auditRecorder) AppendAudit(r *keypool.AuditRecord) error {
+	t.records = append(t.records, r)
+	return t.Tx.AppendAudit(r)
+}
+
+func (s *commitHookStore) Update(pool string, fn func(tx keypool.Tx) error) error {
+	var tx auditRecorder
+	err := s.Store.Update(pool, func(t keypool.Tx) error {
+		tx = auditRecorder{Tx: t}
+		return fn(&tx)
+	})
+	if err == nil {
+		s.onCommit(tx.records)
+	}
+	return err
+}
+
+// Ways a caller gives up
+const (
+	cancelNever = iota
+	cancelBefore
+	cancelTimeout
+	// once the key is committed to the caller and is being handed over
+	cancelDelivering
+	cancelModes
+)
+
+func TestCancelledCallers(t *testing.T) {
+	const seed = 1
+	rnd := rand.New(rand.NewSource(seed))
+
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		const callers = 3000
+		var (
+			cancels = make(map[string]context.CancelFunc, callers)
+			ctxs    = make([]context.Context, callers)
+			modes   = make([]int, callers)
+			// closed once the caller has returned
+			returned   = make([]chan struct{}, callers)
+			delivering int
+		)
+		for i := range ctxs {
+			returned[i] = make(chan struct{})
+			modes[i] = rnd.Intn(cancelModes)
+			ctx := requestid.NewContext(context.Background(), strconv.Itoa(i))
+			var cancel context.CancelFunc
+			switch modes[i] {
+			case cancelTimeout:
+				ctx, cancel = context.WithTimeout(ctx, time.Duration(rnd.Intn(3000))*time.Microsecond)
+			default:
+				ctx, cancel = context.WithCancel(ctx)
+			}
+			if modes[i] == cancelBefore {
+				cancel()
+			}
+			if modes[i] == cancelDelivering {
+				delivering++
+			}
+			t.Cleanup(cancel)
+			ctxs[i], cancels[strconv.Itoa(i)] = ctx, cancel
+		}
+		// the fixed seed gives every mode some callers
+		require.NotZero(t, delivering)
+
+		// the key is committed to the caller, which gives up and returns before the pool hands it over
+		hooked := &commitHookStore{Store: store, onCommit: func(records []*keypool.AuditRecord) {
+			for _, r := range records {
+				i, _ := strconv.Atoi(r.RequestID)
+				if (r.Op == keypool.AuditPop || r.Op == keypool.AuditLease) && modes[i] == cancelDelivering {
+					cancels[r.RequestID]()
+					<-returned[i]
+				}
+			}
+		}}
+		var calls, inFlight atomic.Int32
+		var funded atomic.Int64
+		// only the funder draws from it
+		jitter := rand.New(rand.NewSource(seed))
+		fund := fundAfter(func() time.Duration { return time.Duration(jitter.Intn(200)) * time.Microsecond })
+		charger := ChargerMock{chargeKeys: func(ctx context.Context, keys []uint64) error {
+			calls.Add(1)
+			inFlight.Add(1)
+			defer inFlight.Add(-1)
+			if err := fund(ctx, keys); err != nil {
+				return err
+			}
+			funded.Add(int64(len(keys)))
+			return nil
+		}}
+		pool, err := keypool.New(hooked, &config{
+			bucket:       "test",
+			bufferLength: 10,
+		}, &charger, nil)
+		require.NoError(t, err)
+
+		var (
+			wg     sync.WaitGroup
+			mtx    sync.Mutex
+			got    = make(map[uint64]int)
+			popped int
+			leased = make(map[uint64]bool)
+		)
+		for i, ctx := range ctxs {
+			wg.Add(1)
+			go func(i int, ctx context.Context, lease bool) {
+				defer wg.Done()
+				defer close(returned[i])
+				var (
+					idx uint64
+					err error
+				)
+				if lease {
+					idx, err = pool.Lease(ctx, time.Now().Add(time.Hour))
+				} else {
+					idx, err = pool.Get(ctx)
+				}
+				if err != nil {
+					assert.True(t, errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled), err)
+					return
+				}
+				mtx.Lock()
+				defer mtx.Unlock()
+				got[idx]++
+				if lease {
+					leased[idx] = true
+				} else {
+					popped++
+				}
+			}(i, ctx, i%2 == 0)
+		}
+		wg.Wait()
+
+		// let funding settle so nothing is rolled back by Stop
+		require.Eventually(t, func() bool {
+			n := calls.Load()
+			time.Sleep(20 * time.Millisecond)
+			return inFlight.Load() == 0 && calls.Load() == n
+		}, 10*time.Second, time.Millisecond)
+		require.NoError(t, pool.Stop(context.Background()))
+
+		s, err := keypool.Export(store, "test")
+		require.NoError(t, err)
+		// nothing is lost or handed out twice
+		assert.Equal(t, funded.Load(), int64(s.Sequence))
+		assert.Equal(t, int(s.Sequence), len(s.Queue)+len(s.Leases)+popped)
+		for _, idx := range s.Queue {
+			got[idx]++
+		}
+		stored := make(map[uint64]bool)
+		for _, l := range s.Leases {
+			stored[l.KeyIndex] = true
+		}
+		assert.Equal(t, leased, stored)
+		require.Len(t, got, int(s.Sequence))
+		for idx := uint64(1); idx <= s.Sequence; idx++ {
+			assert.Equal(t, 1, got[idx], idx)
+		}
+
+		// every key committed to a caller that gave up during the handover was taken back.
+		// Timed out callers may have given up then too.
+		var cancelled int
+		require.NoError(t, store.View("test", func(tx keypool.Tx) error {
+			log, err := tx.AuditLog(&keypool.AuditQuery{})
+			for _, r := range log {
+				i, _ := strconv.Atoi(r.RequestID)
+				if r.Op == keypool.AuditCancel && modes[i] == cancelDelivering {
+					cancelled++
+				}
+			}
+			return err
+		}))
+		assert.Equal(t, delivering, cancelled)
+	})
+}
+
+func TestDispenseWhileBusy(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store keypool.Store) {
+		// the first batch is funded, then funding waits for the gate as does every drain check
+		var batches atomic.Int32
+		gate := make(chan struct{})
+		charger := ChargerMock{
+			chargeKeys: func(ctx context.Context, keys []uint64) error {
+				if batches.Add(1) != 1 {
+					<-gate
+				}
+				return nil
+			},
+			isDrained: func(ctx context.Context, key uint64) (bool, error) {
+				<-gate
+				return false, nil
+			},
+		}
+		pool, err := keypool.New(store, &config{
+			bucket:          "test",
+			bufferLength:    4,
+			bufferThreshold: 2,
+		}, &charger, nil)
+		require.NoError(t, err)
+
+		// hangs in recycling
+		_, err = pool.Lease(context.Background(), time.Now())
+		require.NoError(t, err)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		for _, expect := range []uint64{2, 3} {
+			idx, err := pool.Get(ctx)
+			require.NoError(t, err)
+			assert.Equal(t, expect, idx)
+		}
+		// the second batch hangs too
+		require.Eventually(t, func() bool { return batches.Load() == 2 }, time.Second, 10*time.Millisecond)
+		idx, err := pool.Get(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(4), idx)
+
+		close(gate)
+		var s *keypool.Snapshot
+		require.Eventually(t, func() bool {
+			s, err = keypool.Export(store, "test")
+			require.NoError(t, err)
+			return len(s.Leases) == 0 && len(s.Queue) >= 3
+		}, time.Second, 10*time.Millisecond)
+		// the recycled key may come before or after the new batch
+		assert.Contains(t, s.Queue, uint64(1))
+		assert.Subset(t, s.Queue, []uint64{5, 6})
+		require.NoError(t, pool.Stop(context.Background()))
+	})
+}
+
+// slowCharger takes delay to fund a batch and never drains
+func slowCharger(delay time.Duration) *ChargerMock {
+	return &ChargerMock{
+		chargeKeys: fundAfter(func() time.Duration { return delay }),
+		isDrained:  func(ctx context.Context, key uint64) (bool, error) { return false, nil },
+	}
+}
+
+func benchmarkPool(b *testing.B, delay time.Duration, lease bool) {
+	stores := map[string]func() keypool.Store{
+		"memory": func() keypool.Store { return keypool.NewMemStore() },
+		"bolt": func() keypool.Store {
+			dir := b.TempDir()
+			db, err := bolt.Open(dir+"/keygen.db", 0600, &bolt.Options{NoSync: true})
+			require.NoError(b, err)
+			b.Cleanup(func() { db.Close() })
+			return keypool.NewBoltStore(db)
+		},
+	}
+	// recycling is logged per key
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.WarnLevel)
+	defer logrus.SetLevel(level)
+
+	for _, name := range []string{"memory", "bolt"} {
+		b.Run(name, func(b *testing.B) {
+			pool, err := keypool.New(stores[name](), &config{
+				bucket:          "test",
+				bufferLength:    1000,
+				bufferThreshold: 900,
+			}, slowCharger(delay), nil)
+			require.NoError(b, err)
+			defer pool.Stop(context.Background())
+
+			b.SetParallelism(8)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					var err error
+					if lease {
+						_, err = pool.Lease(context.Background(), time.Now().Add(time.Millisecond))
+					} else {
+						_, err = pool.Get(context.Background())
+					}
+					if err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmarkPool(b, 0, false)
+}
+
+// BenchmarkGetSlowFunding takes 10ms to refill the buffer in the background
+func BenchmarkGetSlowFunding(b *testing.B) {
+	benchmarkPool(b, 10*time.Millisecond, false)
+}
+
+// BenchmarkLease recycles the leases while they're being handed out
+func BenchmarkLease(b *testing.B) {
+	benchmarkPool(b, 0, true)
+}
+
+// BenchmarkLeases100k leases keys while 100k leases are outstanding
+func BenchmarkLeases100k(b *testing.B) {
+	db, err := bolt.Open(b.TempDir()+"/keygen.db", 0600, &bolt.Options{NoSync: true})
+	require.NoError(b, err)
+	defer db.Close()
+	store := keypool.NewBoltStore(db)
+	require.NoError(b, store.Init("test"))
+
+	const leases = 100000
+	deadline := time.Now().Add(time.Hour)
+	for i := 0; i < leases; i += 10000 {
+		require.NoError(b, store.Update("test", func(tx keypool.Tx) error {
+			for index := uint64(i + 1); index <= uint64(i+10000); index++ {
+				if err := tx.PutLease(&keypool.Lease{KeyIndex: index, Deadline: deadline.Add(time.Duration(index) * time.Millisecond)}); err != nil {
+					return err
+				}
+			}
+			return tx.SetSequence(uint64(i + 10000))
+		}))
+	}
+
+	b.Run("schedule", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, store.View("test", func(tx keypool.Tx) error {
+				_, _, err := tx.NextDeadline()
+				return err
+			}))
+		}
+	})
+
+	// the full scan the index replaces, for reference
+	b.Run("scan", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, store.View("test", func(tx keypool.Tx) error {
+				_, err := tx.Leases()
+				return err
+			}))
+		}
+	})
+
+	b.Run("expired", func(b *testing.B) {
+		// a few out of 100k
+		now := deadline.Add(10 * time.Millisecond)
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, store.View("test", func(tx keypool.Tx) error {
+				_, err := tx.ExpiredLeases(now)
+				return err
+			}))
+		}
+	})
+
+	b.Run("lease", func(b *testing.B) {
+		pool, err := keypool.New(store, &config{
+			bucket:          "test",
+			bufferLength:    1000,
+			bufferThreshold: 900,
+		}, slowCharger(0), nil)
+		require.NoError(b, err)
+		defer pool.Stop(context.Background())
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := pool.Lease(context.Background(), deadline); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
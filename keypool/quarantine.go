@@ -0,0 +1,128 @@
+package keypool
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrNotQuarantined = errors.New("key is not quarantined")
+
+// Quarantined is a leased key set aside after its recycling check kept failing. It's neither
+// recycled nor discarded until an operator decides, see ReleaseQuarantined and DiscardQuarantined.
+type Quarantined struct {
+	KeyIndex uint64
+	// Time the key was quarantined
+	Time     time.Time
+	Failures int
+	// Error is the last check error
+	Error string
+}
+
+// maxRecycleBackoff caps the delay between recycling checks unless the initial one is longer
+const maxRecycleBackoff = 10 * time.Minute
+
+func recycleDelay(backoff time.Duration, failures int) time.Duration {
+	d := backoff
+	for i := 1; i < failures && d < maxRecycleBackoff; i++ {
+		d *= 2
+	}
+	return max(backoff, min(d, maxRecycleBackoff))
+}
+
+// retryLater records the failed check on the lease and moves its deadline to the next attempt, or
+// quarantines the key once the retries are used up. Returns the audit operation if the key was moved.
+func (p *Pool) retryLater(tx Tx, l *Lease, checkErr error) (string, error) {
+	cfg := p.cfg()
+	failures := l.Failures + 1
+	entry := log.WithFields(log.Fields{
+		"pkh":      p.charger.Hash(l.KeyIndex),
+		"failures": failures,
+		"error":    checkErr,
+	})
+	if retries := cfg.GetRecycleRetries(); retries > 0 && failures >= retries {
+		if err := tx.DeleteLease(l.KeyIndex); err != nil {
+			return "", err
+		}
+		err := tx.PutQuarantined(&Quarantined{
+			KeyIndex: l.KeyIndex,
+			Time:     time.Now(),
+			Failures: failures,
+			Error:    checkErr.Error(),
+		})
+		if err != nil {
+			return "", err
+		}
+		if err := p.audit(tx, AuditQuarantine, l.KeyIndex, actor{}); err != nil {
+			return "", err
+		}
+		entry.Error("Recycling check failed, the key is quarantined")
+		return AuditQuarantine, nil
+	}
+
+	l.Failures = failures
+	l.Error = checkErr.Error()
+	l.Deadline = time.Now().Add(recycleDelay(cfg.GetRecycleBackoff(), failures))
+	entry.WithField("retry", l.Deadline).Warn("Recycling check failed")
+	return "", tx.PutLease(l)
+}
+
+// Quarantined returns the quarantined keys ordered by the key index
+func (p *Pool) Quarantined() ([]*Quarantined, error) {
+	var out []*Quarantined
+	err := p.view(func(tx Tx) (err error) {
+		out, err = tx.QuarantinedKeys()
+		return
+	})
+	return out, err
+}
+
+// ReleaseQuarantined hands the key back to recycling with a clean record. It's checked right away.
+func (p *Pool) ReleaseQuarantined(ctx context.Context, keyIndex uint64) error {
+	err := p.update(func(tx Tx) error {
+		q, err := tx.GetQuarantined(keyIndex)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return ErrNotQuarantined
+		}
+		if err := tx.DeleteQuarantined(keyIndex); err != nil {
+			return err
+		}
+		if err := tx.PutLease(&Lease{KeyIndex: keyIndex, Deadline: time.Now()}); err != nil {
+			return err
+		}
+		return p.audit(tx, AuditRelease, keyIndex, actorFromContext(ctx))
+	})
+	if err != nil {
+		return err
+	}
+	kick(p.leasesChanged)
+	p.publish(AuditRelease, keyIndex)
+	return nil
+}
+
+// DiscardQuarantined drops the key for good. Its funds, if any, stay on the account.
+func (p *Pool) DiscardQuarantined(ctx context.Context, keyIndex uint64) error {
+	err := p.update(func(tx Tx) error {
+		q, err := tx.GetQuarantined(keyIndex)
+		if err != nil {
+			return err
+		}
+		if q == nil {
+			return ErrNotQuarantined
+		}
+		if err := tx.DeleteQuarantined(keyIndex); err != nil {
+			return err
+		}
+		return p.audit(tx, AuditDiscard, keyIndex, actorFromContext(ctx))
+	})
+	if err != nil {
+		return err
+	}
+	p.publish(AuditDiscard, keyIndex)
+	return nil
+}
@@ -0,0 +1,70 @@
+package keypool
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+var ErrQuotaExceeded = errors.New("daily quota exceeded")
+
+// Quota limits the number of keys and the funded amount a single client can get per UTC day.
+// Zero or nil values mean no limit.
+type Quota struct {
+	Keys   uint64
+	Amount *big.Int
+}
+
+const quotaDayFormat = "2006-01-02"
+
+func (p *Pool) updateQuota(client string, now time.Time, fn func(u *QuotaUsage) error) error {
+	return p.update(func(tx Tx) error {
+		today := now.UTC().Format(quotaDayFormat)
+		// drop counters of previous days
+		if err := tx.PruneQuota(today); err != nil {
+			return err
+		}
+		u, err := tx.GetQuotaUsage(today, client)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			u = &QuotaUsage{}
+		}
+		if u.Amount == nil {
+			u.Amount = new(big.Int)
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+		return tx.PutQuotaUsage(today, client, u)
+	})
+}
+
+// TakeQuota accounts one key funded with amount to the client or returns ErrQuotaExceeded
+func (p *Pool) TakeQuota(client string, quota *Quota, amount *big.Int) error {
+	return p.updateQuota(client, time.Now(), func(u *QuotaUsage) error {
+		newAmount := new(big.Int).Add(u.Amount, amount)
+		if quota.Keys != 0 && u.Keys+1 > quota.Keys ||
+			quota.Amount != nil && quota.Amount.Sign() != 0 && newAmount.Cmp(quota.Amount) > 0 {
+			return ErrQuotaExceeded
+		}
+		u.Keys++
+		u.Amount = newAmount
+		return nil
+	})
+}
+
+// ReturnQuota reverts TakeQuota if the key hasn't been delivered
+func (p *Pool) ReturnQuota(client string, amount *big.Int) error {
+	return p.updateQuota(client, time.Now(), func(u *QuotaUsage) error {
+		if u.Keys != 0 {
+			u.Keys--
+		}
+		u.Amount.Sub(u.Amount, amount)
+		if u.Amount.Sign() < 0 {
+			u.Amount.SetInt64(0)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,99 @@
+package keypool
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// On-disk records. They are kept apart from the API types so that changing the latter doesn't
+// affect existing databases.
+
+type leaseRecord struct {
+	KeyIndex uint64    `json:"index"`
+	Identity string    `json:"identity,omitempty"`
+	Deadline time.Time `json:"deadline"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newLeaseRecord(l *Lease) *leaseRecord {
+	return &leaseRecord{KeyIndex: l.KeyIndex, Identity: l.Identity, Deadline: l.Deadline, Failures: l.Failures, Error: l.Error}
+}
+
+func (r *leaseRecord) lease() *Lease {
+	return &Lease{KeyIndex: r.KeyIndex, Identity: r.Identity, Deadline: r.Deadline, Failures: r.Failures, Error: r.Error}
+}
+
+type quarantineRecord struct {
+	KeyIndex uint64    `json:"index"`
+	Time     time.Time `json:"time"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func newQuarantineRecord(q *Quarantined) *quarantineRecord {
+	return &quarantineRecord{KeyIndex: q.KeyIndex, Time: q.Time, Failures: q.Failures, Error: q.Error}
+}
+
+func (r *quarantineRecord) quarantined() *Quarantined {
+	return &Quarantined{KeyIndex: r.KeyIndex, Time: r.Time, Failures: r.Failures, Error: r.Error}
+}
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	KeyIndex  uint64    `json:"index"`
+	PKH       string    `json:"pkh,omitempty"`
+	Identity  string    `json:"identity,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func newAuditRecord(r *AuditRecord) *auditRecord {
+	return &auditRecord{
+		Time:      r.Time,
+		Op:        r.Op,
+		KeyIndex:  r.KeyIndex,
+		PKH:       r.PKH,
+		Identity:  r.Identity,
+		RequestID: r.RequestID,
+	}
+}
+
+func (r *auditRecord) record() *AuditRecord {
+	return &AuditRecord{
+		Time:      r.Time,
+		Op:        r.Op,
+		KeyIndex:  r.KeyIndex,
+		PKH:       r.PKH,
+		Identity:  r.Identity,
+		RequestID: r.RequestID,
+	}
+}
+
+// quotaRecord keeps the amount as a decimal string
+type quotaRecord struct {
+	Keys   uint64 `json:"keys"`
+	Amount string `json:"amount"`
+}
+
+func newQuotaRecord(u *QuotaUsage) *quotaRecord {
+	r := quotaRecord{Keys: u.Keys, Amount: "0"}
+	if u.Amount != nil {
+		r.Amount = u.Amount.String()
+	}
+	return &r
+}
+
+func (r *quotaRecord) usage() (*QuotaUsage, error) {
+	amount, ok := new(big.Int).SetString(r.Amount, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid quota amount %q", r.Amount)
+	}
+	return &QuotaUsage{Keys: r.Keys, Amount: amount}, nil
+}
+
+type chainRecord struct {
+	ChainID string `json:"chain_id"`
+	Genesis string `json:"genesis"`
+}
@@ -0,0 +1,50 @@
+package keypool
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// What happens to recycled keys that break the rules
+const (
+	// DirtyDiscard throws them away
+	DirtyDiscard = "discard"
+	// DirtyReset resets them if possible and discards the rest
+	DirtyReset = "reset"
+)
+
+// clean checks the key against the recycling rules and resets it if allowed. A reset key is checked
+// again. It returns false if the key is to be discarded. A failed reset is retried with the check.
+func (p *Pool) clean(ctx context.Context, keyIndex uint64) (bool, error) {
+	cfg := p.cfg()
+	rules := cfg.GetRecycleRules()
+	if len(rules) == 0 {
+		return true, nil
+	}
+	broken, err := p.charger.Inspect(ctx, keyIndex, rules)
+	if err != nil || len(broken) == 0 {
+		return err == nil, err
+	}
+	entry := log.WithFields(log.Fields{
+		"pkh":   p.charger.Hash(keyIndex),
+		"rules": broken,
+	})
+	if cfg.GetDirtyKeys() == DirtyReset {
+		ok, err := p.charger.ResetKey(ctx, keyIndex, broken)
+		if err != nil {
+			return false, err
+		}
+		if ok {
+			entry.Info("Key is reset")
+			if broken, err = p.charger.Inspect(ctx, keyIndex, rules); err != nil || len(broken) == 0 {
+				return err == nil, err
+			}
+			entry = entry.WithField("rules", broken)
+			entry.Info("Key is still dirty after the reset")
+			return false, nil
+		}
+	}
+	entry.Info("Key breaks recycling rules")
+	return false, nil
+}
@@ -0,0 +1,90 @@
+package keypool
+
+import (
+	"errors"
+	"math/big"
+	"time"
+)
+
+var ErrNoPool = errors.New("pool doesn't exist")
+
+// Store persists the state of pools. A pool is identified by its bucket name.
+// Changes made by a failed Update must not be visible.
+type Store interface {
+	// Init creates the pool's state if it doesn't exist yet
+	Init(pool string) error
+	View(pool string, fn func(tx Tx) error) error
+	Update(pool string, fn func(tx Tx) error) error
+}
+
+// Tx gives access to the state of a single pool within a transaction
+type Tx interface {
+	// Push appends the key index to the queue of funded keys
+	Push(index uint64) error
+	// Pop removes the first key index from the queue. ok is false if the queue is empty.
+	Pop() (index uint64, ok bool, err error)
+	// Remove deletes the key index from the queue. ok is false if it isn't queued.
+	Remove(index uint64) (ok bool, err error)
+	Len() (int, error)
+	// Queue returns the queued key indices in order
+	Queue() ([]uint64, error)
+
+	// NextSequence allocates a new key index
+	NextSequence() (uint64, error)
+	// Sequence returns the last allocated key index
+	Sequence() (uint64, error)
+	SetSequence(seq uint64) error
+
+	PutLease(l *Lease) error
+	// GetLease returns nil if the key isn't leased
+	GetLease(index uint64) (*Lease, error)
+	DeleteLease(index uint64) error
+	// Leases returns all leases ordered by the key index
+	Leases() ([]*Lease, error)
+	// NextDeadline returns the earliest lease deadline. ok is false if there are no leases.
+	NextDeadline() (deadline time.Time, ok bool, err error)
+	// ExpiredLeases returns leases with deadlines not after now, earliest first
+	ExpiredLeases(now time.Time) ([]*Lease, error)
+
+	PutQuarantined(q *Quarantined) error
+	// GetQuarantined returns nil if the key isn't quarantined
+	GetQuarantined(index uint64) (*Quarantined, error)
+	DeleteQuarantined(index uint64) error
+	// QuarantinedKeys returns the quarantined keys ordered by the key index
+	QuarantinedKeys() ([]*Quarantined, error)
+
+	AppendAudit(r *AuditRecord) error
+	// PruneAudit deletes records older than before
+	PruneAudit(before time.Time) error
+	// AuditLog returns the most recent records matching q, oldest first
+	AuditLog(q *AuditQuery) ([]*AuditRecord, error)
+
+	// GetQuotaUsage returns nil if there is no record
+	GetQuotaUsage(day, client string) (*QuotaUsage, error)
+	PutQuotaUsage(day, client string, u *QuotaUsage) error
+	// PruneQuota deletes records of days before the given one. Days are formatted as YYYY-MM-DD.
+	PruneQuota(day string) error
+
+	// Chain returns nil if the pool isn't bound to a chain yet
+	Chain() (*ChainInfo, error)
+	SetChain(info *ChainInfo) error
+	// Archive moves the queue, the leases, the quarantined keys and the sequence to the archive
+	// under the given name and leaves them empty
+	Archive(name string) error
+}
+
+type Lease struct {
+	KeyIndex uint64
+	// Identity is the client the key was leased to
+	Identity string
+	// Deadline is moved to the next attempt if the recycling check fails
+	Deadline time.Time
+	// Failures counts failed recycling checks in a row, Error holds the last one
+	Failures int
+	Error    string
+}
+
+type QuotaUsage struct {
+	Keys   uint64
+	Amount *big.Int
+}
@@ -1,46 +1,73 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
 	"syscall"
+	"time"
 
 	"crypto/rand"
 
-	"github.com/ecadlabs/go-tezos-keygen/charger"
 	"github.com/ecadlabs/go-tezos-keygen/config"
 	"github.com/ecadlabs/go-tezos-keygen/keypool"
 	"github.com/ecadlabs/go-tezos-keygen/server"
 	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
 	"github.com/ecadlabs/go-tezos-keygen/service"
 	"github.com/ecadlabs/go-tezos-keygen/utils"
-	"github.com/ecadlabs/gotez/v2/client"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
 )
 
+// memoryDatabase selects the in-memory store, meant for development
+const memoryDatabase = ":memory:"
+
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
+	config.Prompt = promptPassphrase
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd.run(os.Args[2:]); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var (
 		networksFile string
 		databaseFile string
 		address      string
 		level        string
 		genSeed      bool
+		genToken     bool
+		tlsCert      string
+		tlsKey       string
+		tlsClientCA  string
+		shutdown     time.Duration
 	)
 	flag.StringVar(&networksFile, "n", "", "Networks configuration file")
-	flag.StringVar(&databaseFile, "d", "", "Database")
+	flag.StringVar(&databaseFile, "d", "", "Database. Use "+memoryDatabase+" to keep the state in memory")
 	flag.StringVar(&address, "a", ":3000", "Address")
 	flag.StringVar(&level, "l", "info", "Level [panic,fatal,error,warn,info,debug,trace]")
 	flag.BoolVar(&genSeed, "seed", false, "Generate 512 bit seed and exit")
+	flag.BoolVar(&genToken, "token", false, "Generate API token, print it along with its hash and exit")
+	flag.StringVar(&tlsCert, "tls-cert", "", "TLS certificate file. The file is reloaded on change")
+	flag.StringVar(&tlsKey, "tls-key", "", "TLS key file. The file is reloaded on change")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "CA file used to verify client certificates")
+	flag.DurationVar(&shutdown, "shutdown-timeout", defaultShutdownTimeout, "Time given to requests in progress on shutdown before they're cancelled")
+	flag.Usage = usage
 	flag.Parse()
 
 	l, err := log.ParseLevel(level)
@@ -58,6 +85,17 @@ func main() {
 		return
 	}
 
+	if genToken {
+		var token [32]byte
+		if _, err := rand.Read(token[:]); err != nil {
+			log.Fatal(err)
+		}
+		t := base64.RawURLEncoding.EncodeToString(token[:])
+		h := middleware.HashToken(t)
+		fmt.Printf("token:  %s\nsha256: %s\n", t, hex.EncodeToString(h[:]))
+		return
+	}
+
 	if networksFile == "" {
 		networksFile = os.Getenv("KEYGEN_NETWORKS")
 	}
@@ -66,88 +104,167 @@ func main() {
 		databaseFile = os.Getenv("KEYGEN_DB")
 	}
 
-	var rd io.Reader
-	if x := os.Getenv("KEYGEN_NETWORKS_DATA"); x != "" {
-		rd = bytes.NewReader([]byte(x))
-	} else {
-		fd, err := os.Open(networksFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer fd.Close()
-		rd = bufio.NewReader(fd)
+	if tlsCert == "" {
+		tlsCert = os.Getenv("KEYGEN_TLS_CERT")
 	}
-	cfg, err := config.New(rd)
-	if err != nil {
-		log.Fatal(err)
+
+	if tlsKey == "" {
+		tlsKey = os.Getenv("KEYGEN_TLS_KEY")
 	}
 
-	log.Infof("Database file: %s", databaseFile)
+	if tlsClientCA == "" {
+		tlsClientCA = os.Getenv("KEYGEN_TLS_CLIENT_CA")
+	}
 
-	db, err := bolt.Open(databaseFile, 0600, nil)
+	cfg, err := readConfig(networksFile)
 	if err != nil {
 		log.Fatal(err)
 	}
+	// a prompt on reload would block the signal loop
+	config.Prompt = nil
 
-	nets := make(map[string]*service.Network, len(cfg))
-	for name, net := range cfg {
-		client := &client.Client{
-			URL:         net.GetURL(),
-			DebugLogger: (*utils.DebugLogger)(log.StandardLogger()),
-		}
-		charger := charger.New(net, client)
-		pool, err := keypool.New(db, net, charger)
-		if err != nil {
+	var (
+		store keypool.Store
+		db    *bolt.DB
+	)
+	if databaseFile == memoryDatabase {
+		log.Warn("The state is kept in memory and will be lost on exit")
+		store = keypool.NewMemStore()
+	} else {
+		log.Infof("Database file: %s", databaseFile)
+		if db, err = bolt.Open(databaseFile, 0600, nil); err != nil {
 			log.Fatal(err)
 		}
-		nets[name] = &service.Network{
-			Pool:    pool,
-			Charger: charger,
-			Config:  net,
-		}
+		store = keypool.NewBoltStore(db)
 	}
 
-	service := service.Service{Networks: nets}
-	server := server.Server{Service: &service}
-	handler := server.Router()
+	kg := keygen{
+		store:     store,
+		service:   service.New(nil),
+		auth:      &middleware.Auth{Scope: server.Scope},
+		rateLimit: &middleware.RateLimit{Scope: server.Scope},
+		clientCA:  tlsClientCA != "",
+	}
+	if err := kg.apply(cfg); err != nil {
+		log.Fatal(err)
+	}
+
+	api := server.Server{Service: kg.service}
+	handler := api.Router()
 
 	logger := middleware.Logging{}
 	handler.Use(logger.Handler)
+	handler.Use(kg.auth.Handler)
+	// also attributes anonymous requests to client addresses
+	handler.Use(kg.rateLimit.Handler)
 
+	// cancelled if requests outlive the shutdown timeout
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	defer cancelRequests()
 	srv := &http.Server{
-		Handler: handler,
-		Addr:    address,
+		Handler:     handler,
+		Addr:        address,
+		BaseContext: func(net.Listener) context.Context { return baseCtx },
+	}
+	// event streams never complete on their own
+	srv.RegisterOnShutdown(api.CloseStreams)
+
+	if tlsCert != "" || tlsKey != "" {
+		certs, err := utils.NewCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv.TLSConfig = &tls.Config{
+			GetCertificate: certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		if tlsClientCA != "" {
+			pool, err := utils.LoadCertPool(tlsClientCA)
+			if err != nil {
+				log.Fatal(err)
+			}
+			srv.TLSConfig.ClientCAs = pool
+			// clients may still authenticate with tokens
+			srv.TLSConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	} else if tlsClientCA != "" {
+		log.Fatal("client CA requires TLS")
 	}
 
 	errCh := make(chan error)
 	go func() {
-		log.Printf("HTTP server is listening for connections on %s", srv.Addr)
-		errCh <- srv.ListenAndServe()
+		if srv.TLSConfig != nil {
+			log.Printf("HTTPS server is listening for connections on %s", srv.Addr)
+			errCh <- srv.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("HTTP server is listening for connections on %s", srv.Addr)
+			errCh <- srv.ListenAndServe()
+		}
 	}()
 
 	signalCh := make(chan os.Signal, 1)
 	signal.Notify(signalCh, syscall.SIGINT, syscall.SIGTERM)
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
 
-	select {
-	case <-signalCh:
-	case <-errCh:
-		log.Fatal(err) // happened before shutdown
+loop:
+	for {
+		select {
+		case <-hupCh:
+			log.Info("Reloading configuration...")
+			if err := kg.reload(networksFile); err != nil {
+				log.Errorf("Keeping the previous configuration: %v", err)
+			} else {
+				log.Info("Configuration reloaded")
+			}
+		case <-signalCh:
+			break loop
+		case err := <-errCh:
+			log.Fatal(err) // happened before shutdown
+		}
 	}
 
 	log.Info("Shutting down...")
-	if err := srv.Shutdown(context.Background()); err != nil {
-		log.Fatal(err)
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		// the pools roll back interrupted operations
+		log.Warnf("Cancelling requests in progress: %v", err)
+		cancelRequests()
+		srv.Close()
 	}
 	if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
 		log.Error(err)
 	}
-	for _, n := range nets {
-		if err := n.Pool.Stop(context.Background()); err != nil {
-			log.Error(err)
+	// the requests may have used up the shutdown timeout
+	pctx, pcancel := context.WithTimeout(context.Background(), poolStopTimeout)
+	defer pcancel()
+	if err := kg.stop(pctx); err != nil {
+		// a running pool still needs the database to roll back
+		log.Errorf("Leaving the database open: %v", err)
+	} else if db != nil {
+		if err := db.Close(); err != nil {
+			log.Fatal(err)
 		}
 	}
-	if err := db.Close(); err != nil {
-		log.Fatal(err)
-	}
 	log.Info("Bye")
 }
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage of %s:\n", os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nCommands:\n")
+	for _, name := range sortedNames(commands) {
+		fmt.Fprintf(out, "  %s\n    \t%s\n", name, commands[name].usage)
+	}
+}
+
+func sortedNames[T any](m map[string]T) []string {
+	names := make([]string, 0, len(m))
+	for n := range m {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
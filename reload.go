@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/balancer"
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
+	"github.com/ecadlabs/go-tezos-keygen/service"
+	"github.com/ecadlabs/go-tezos-keygen/utils"
+	"github.com/ecadlabs/gotez/v2/client"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	poolStopTimeout  = 30 * time.Second
+	endpointInterval = 10 * time.Second
+)
+
+// startupCheckTimeout bounds the chain check of a new network. It's shorter than rpc-timeout as
+// the network starts anyway and its chain watcher retries.
+var startupCheckTimeout = 10 * time.Second
+
+// readConfig reads KEYGEN_NETWORKS_DATA or the networks file
+func readConfig(networksFile string) (*config.Config, error) {
+	var rd io.Reader
+	if x := os.Getenv("KEYGEN_NETWORKS_DATA"); x != "" {
+		rd = bytes.NewReader([]byte(x))
+	} else {
+		fd, err := os.Open(networksFile)
+		if err != nil {
+			return nil, err
+		}
+		defer fd.Close()
+		rd = bufio.NewReader(fd)
+	}
+	return config.New(rd)
+}
+
+func newClient(rpc *balancer.Balancer) *client.Client {
+	return &client.Client{
+		URL:         balancer.BaseURL,
+		Client:      &http.Client{Transport: rpc},
+		DebugLogger: (*utils.DebugLogger)(log.StandardLogger()),
+	}
+}
+
+// keygen holds the part of the running state that follows the configuration
+type keygen struct {
+	store     keypool.Store
+	service   *service.Service
+	auth      *middleware.Auth
+	rateLimit *middleware.RateLimit
+	clientCA  bool
+	// chain watchers keyed by network name
+	watchers map[string]context.CancelFunc
+}
+
+// apply starts, stops and updates networks and server settings to match cfg. Everything
+// that can fail is checked before the running state is touched, so on error the previous
+// configuration stays in effect.
+func (k *keygen) apply(cfg *config.Config) error {
+	principals, err := cfg.Server.Principals()
+	if err != nil {
+		return err
+	}
+	certPrincipals, err := cfg.Server.CertificatePrincipals()
+	if err != nil {
+		return err
+	}
+	if len(certPrincipals) != 0 && !k.clientCA {
+		return errors.New("client certificates are configured but no client CA is given")
+	}
+	limits, err := cfg.Server.RateLimits()
+	if err != nil {
+		return err
+	}
+
+	current := k.service.Networks()
+	for name, net := range cfg.Networks {
+		if old, ok := current[name]; ok && !bytes.Equal(old.Config.GetSeed(), net.GetSeed()) {
+			return fmt.Errorf("%s: seed can't be changed on a running network, restart required", name)
+		}
+	}
+
+	// start new networks. The chain is checked before the pool is started, so a pool never runs
+	// against a node on the wrong chain.
+	type newNetwork struct {
+		name string
+		cfg  *config.NetworkConfig
+		net  *service.Network
+		info *charger.ChainInfo
+		err  error
+	}
+	var added []*newNetwork
+	for name, net := range cfg.Networks {
+		if _, ok := current[name]; ok {
+			continue
+		}
+		rpc, err := balancer.New(net.GetEndpoints(), net.GetMaxHeadLag())
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		bus := events.NewBus()
+		added = append(added, &newNetwork{
+			name: name,
+			cfg:  net,
+			net: &service.Network{
+				Charger: charger.New(net, newClient(rpc), bus),
+				RPC:     rpc,
+				Events:  bus,
+				Config:  net,
+			},
+		})
+	}
+
+	// a dead node mustn't hold up the other networks
+	var wg sync.WaitGroup
+	for _, n := range added {
+		wg.Add(1)
+		go func(n *newNetwork) {
+			defer wg.Done()
+			n.info, n.err = checkChain(n.net.Charger)
+		}(n)
+	}
+	wg.Wait()
+
+	var started []*newNetwork
+	for _, n := range added {
+		if errors.Is(n.err, charger.ErrChainMismatch) {
+			log.WithField("network", n.name).Errorf("Network not started: %v", n.err)
+			continue
+		}
+		pool, err := keypool.New(k.store, n.cfg, n.net.Charger, n.net.Events)
+		if err != nil {
+			for _, n := range started {
+				stopPool(n.net.Pool)
+			}
+			return fmt.Errorf("%s: %w", n.name, err)
+		}
+		n.net.Pool = pool
+		started = append(started, n)
+	}
+
+	nets := make(map[string]*service.Network, len(cfg.Networks))
+	for _, n := range started {
+		err := n.err
+		if err == nil {
+			err = n.net.BindChain(n.info)
+		}
+		if err != nil {
+			// the watcher will retry
+			log.WithField("network", n.name).Warn(err)
+		}
+		nets[n.name] = n.net
+		log.WithField("network", n.name).Info("Network started")
+	}
+
+	// update running ones
+	for name, net := range cfg.Networks {
+		old, ok := current[name]
+		if !ok {
+			continue
+		}
+		old.Pool.SetConfig(net)
+		// the endpoints are validated already
+		if err := old.RPC.Set(net.GetEndpoints(), net.GetMaxHeadLag()); err != nil {
+			log.WithField("network", name).Error(err)
+		}
+		old.Charger.Set(net, newClient(old.RPC))
+		nets[name] = &service.Network{
+			Pool:    old.Pool,
+			Charger: old.Charger,
+			RPC:     old.RPC,
+			Events:  old.Events,
+			Config:  net,
+		}
+	}
+	k.service.SetNetworks(nets)
+
+	if k.watchers == nil {
+		k.watchers = make(map[string]context.CancelFunc)
+	}
+	for name, n := range nets {
+		if _, ok := k.watchers[name]; !ok {
+			ctx, cancel := context.WithCancel(context.Background())
+			go k.service.WatchChain(ctx, name)
+			go n.RPC.Run(ctx, endpointInterval)
+			k.watchers[name] = cancel
+		}
+	}
+
+	// stop removed ones
+	for name, net := range current {
+		if _, ok := nets[name]; !ok {
+			k.watchers[name]()
+			delete(k.watchers, name)
+			stopPool(net.Pool)
+			log.WithField("network", name).Info("Network stopped")
+		}
+	}
+
+	k.auth.SetTokens(principals)
+	k.auth.SetCertificates(certPrincipals)
+	if !k.auth.Enabled() {
+		log.Warn("No API tokens or client certificates configured, authentication is disabled")
+	}
+	k.rateLimit.SetLimits(limits)
+	return nil
+}
+
+// reload reads the networks file and applies it. On error the running configuration is kept.
+func (k *keygen) reload(networksFile string) error {
+	cfg, err := readConfig(networksFile)
+	if err != nil {
+		return err
+	}
+	return k.apply(cfg)
+}
+
+// checkChain verifies the node's chain or discovers it if no chain ID is configured
+func checkChain(ch *charger.Charger) (*charger.ChainInfo, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), startupCheckTimeout)
+	defer cancel()
+	return ch.CheckChain(ctx)
+}
+
+func stopPool(p *keypool.Pool) {
+	ctx, cancel := context.WithTimeout(context.Background(), poolStopTimeout)
+	defer cancel()
+	if err := p.Stop(ctx); err != nil {
+		log.Error(err)
+	}
+}
+
+// stop stops the networks. Pools are interrupted and given until ctx is done to roll back. An error
+// means some pool is still running and may write to the store.
+func (k *keygen) stop(ctx context.Context) error {
+	for _, cancel := range k.watchers {
+		cancel()
+	}
+	var (
+		wg   sync.WaitGroup
+		mtx  sync.Mutex
+		errs []error
+	)
+	for name, n := range k.service.Networks() {
+		wg.Add(1)
+		go func(name string, p *keypool.Pool) {
+			defer wg.Done()
+			if err := p.Stop(ctx); err != nil {
+				mtx.Lock()
+				errs = append(errs, fmt.Errorf("%s: %w", name, err))
+				mtx.Unlock()
+			}
+		}(name, n.Pool)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
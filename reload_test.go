@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
+	"github.com/ecadlabs/go-tezos-keygen/service"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+// nodeMock serves the chain ID, the genesis hash and the head header
+type nodeMock struct {
+	*httptest.Server
+	chainID atomic.Pointer[tz.ChainID]
+	genesis atomic.Pointer[tz.BlockHash]
+}
+
+func newNodeMock(t *testing.T, chainID *tz.ChainID, genesis *tz.BlockHash) *nodeMock {
+	n := &nodeMock{}
+	n.chainID.Store(chainID)
+	n.genesis.Store(genesis)
+	n.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any
+		switch r.URL.Path {
+		case "/chains/main/chain_id":
+			v = n.chainID.Load().String()
+		case "/chains/main/blocks/genesis/hash":
+			v = n.genesis.Load().String()
+		case "/chains/main/blocks/head/header":
+			v = map[string]int64{"level": 1}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	t.Cleanup(n.Close)
+	return n
+}
+
+var (
+	testChainID = &tz.ChainID{1, 2, 3, 4}
+	testGenesis = &tz.BlockHash{1}
+)
+
+const (
+	testSeed  = "f7353829d316c20922f8ff2ed696090801d9c775977df6423cd68a737c628b844b13c951de7cb7cd01cd62430edeefbc219885b388f06cb5d1e496f63bc9c0d5"
+	otherSeed = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+)
+
+// networkYAML describes a network on url
+func networkYAML(name, url, seed string, amount int) string {
+	return fmt.Sprintf(`
+%s:
+  url: %s
+  seed: %s
+  private-key: edsk2mgqWz5tUQQPK2LCg4Ae2G9bdd8RGzJP9oR3S7cKgASndbnRjE
+  amount: %d
+`, name, url, seed, amount)
+}
+
+func newTestKeygen(t *testing.T) *keygen {
+	kg := &keygen{
+		store:     keypool.NewMemStore(),
+		service:   service.New(nil),
+		auth:      &middleware.Auth{Scope: server.Scope},
+		rateLimit: &middleware.RateLimit{Scope: server.Scope},
+	}
+	t.Cleanup(func() { require.NoError(t, kg.stop(context.Background())) })
+	return kg
+}
+
+func TestApply(t *testing.T) {
+	// takes precedence over the file
+	t.Setenv("KEYGEN_NETWORKS_DATA", "")
+	node := newNodeMock(t, testChainID, testGenesis)
+	a := networkYAML("a", node.URL, testSeed, 1000)
+	b := networkYAML("b", node.URL, testSeed, 1000)
+
+	type step struct {
+		src      string
+		err      string
+		networks []string
+		// amounts of the running networks
+		amounts map[string]int64
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "add",
+			steps: []step{
+				{src: a, networks: []string{"a"}},
+				{src: a + b, networks: []string{"a", "b"}},
+			},
+		},
+		{
+			name: "remove",
+			steps: []step{
+				{src: a + b, networks: []string{"a", "b"}},
+				{src: b, networks: []string{"b"}},
+			},
+		},
+		{
+			name: "change",
+			steps: []step{
+				{src: a, networks: []string{"a"}, amounts: map[string]int64{"a": 1000}},
+				{src: networkYAML("a", node.URL, testSeed, 2000), networks: []string{"a"}, amounts: map[string]int64{"a": 2000}},
+			},
+		},
+		{
+			name: "seed change refused",
+			steps: []step{
+				{src: a, networks: []string{"a"}},
+				{
+					src:      networkYAML("a", node.URL, otherSeed, 2000) + b,
+					err:      "a: seed can't be changed",
+					networks: []string{"a"},
+					amounts:  map[string]int64{"a": 1000},
+				},
+			},
+		},
+		{
+			name: "invalid file",
+			steps: []step{
+				{src: a, networks: []string{"a"}},
+				{
+					src:      networkYAML("a", node.URL, testSeed, 2000) + b + "  amount: -1\n",
+					err:      "amount",
+					networks: []string{"a"},
+					amounts:  map[string]int64{"a": 1000},
+				},
+			},
+		},
+		{
+			name: "invalid server settings",
+			steps: []step{
+				{src: a, networks: []string{"a"}},
+				{
+					src: networkYAML("a", node.URL, testSeed, 2000) + b + `
+server:
+  certificates:
+    - subject: CN=client
+      scopes:
+        pop: [a]
+`,
+					err:      "no client CA",
+					networks: []string{"a"},
+					amounts:  map[string]int64{"a": 1000},
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kg := newTestKeygen(t)
+			file := filepath.Join(t.TempDir(), "networks.yaml")
+			for i, s := range tt.steps {
+				before := kg.service.Networks()
+				require.NoError(t, os.WriteFile(file, []byte(s.src), 0600))
+				err := kg.reload(file)
+				if s.err != "" {
+					require.ErrorContains(t, err, s.err, i)
+				} else {
+					require.NoError(t, err, i)
+				}
+
+				after := kg.service.Networks()
+				names := make([]string, 0, len(after))
+				for name := range after {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+				assert.Equal(t, s.networks, names, i)
+				for name, amount := range s.amounts {
+					assert.Equal(t, amount, after[name].Config.GetAmount().Int64(), name)
+				}
+
+				for name, old := range before {
+					if n, ok := after[name]; ok {
+						// running networks are updated in place
+						assert.Same(t, old.Pool, n.Pool, name)
+						assert.Same(t, old.Charger, n.Charger, name)
+					} else {
+						_, err := old.Pool.Get(context.Background())
+						assert.ErrorIs(t, err, keypool.ErrStopped, name)
+					}
+				}
+				assert.Len(t, kg.watchers, len(after))
+			}
+		})
+	}
+}
+
+// hangingNode accepts connections and never responds
+func hangingNode(t *testing.T) *httptest.Server {
+	quit := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-quit:
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(quit) })
+	return srv
+}
+
+func TestStartupChecks(t *testing.T) {
+	t.Setenv("KEYGEN_NETWORKS_DATA", "")
+	timeout := startupCheckTimeout
+	startupCheckTimeout = 300 * time.Millisecond
+	t.Cleanup(func() { startupCheckTimeout = timeout })
+
+	node := newNodeMock(t, testChainID, testGenesis)
+	src := networkYAML("a", node.URL, testSeed, 1000) +
+		networkYAML("mismatch", node.URL, testSeed, 1000) + "  chain-id: " + (&tz.ChainID{5, 6, 7, 8}).String() + "\n"
+	for _, name := range []string{"dead1", "dead2", "dead3"} {
+		src += networkYAML(name, hangingNode(t).URL, testSeed, 1000)
+	}
+	file := filepath.Join(t.TempDir(), "networks.yaml")
+	require.NoError(t, os.WriteFile(file, []byte(src), 0600))
+
+	kg := newTestKeygen(t)
+	start := time.Now()
+	require.NoError(t, kg.reload(file))
+	// the dead nodes are checked concurrently
+	assert.Less(t, time.Since(start), 3*startupCheckTimeout)
+
+	nets := kg.service.Networks()
+	names := make([]string, 0, len(nets))
+	for name := range nets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// unreachable networks start anyway, the watcher retries
+	assert.Equal(t, []string{"a", "dead1", "dead2", "dead3"}, names)
+	assert.Equal(t, testChainID, nets["a"].Charger.ChainID())
+	assert.Nil(t, nets["dead1"].Charger.ChainID())
+	info, err := nets["a"].Pool.Chain()
+	require.NoError(t, err)
+	assert.Equal(t, testChainID.String(), info.ChainID)
+
+	// the pool of the mismatched network is never started
+	_, err = keypool.Export(kg.store, "mismatch")
+	assert.ErrorIs(t, err, keypool.ErrNoPool)
+}
+
+// stubbornCharger blocks in ChargeKeys until released, whatever the context
+type stubbornCharger struct {
+	keypool.Charger
+	once    sync.Once
+	started chan struct{}
+	release chan struct{}
+}
+
+func (c *stubbornCharger) ChargeKeys(ctx context.Context, keys []uint64) ([]*keypool.Batch, error) {
+	c.once.Do(func() { close(c.started) })
+	<-c.release
+	return nil, ctx.Err()
+}
+
+func TestStopWaitsForPools(t *testing.T) {
+	cfg, err := config.New(strings.NewReader(testNetworks))
+	require.NoError(t, err)
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "test.db"), 0600, nil)
+	require.NoError(t, err)
+	store := keypool.NewBoltStore(db)
+
+	charger := &stubbornCharger{started: make(chan struct{}), release: make(chan struct{})}
+	net := cfg.Networks["testnet"]
+	pool, err := keypool.New(store, net, charger, nil)
+	require.NoError(t, err)
+	kg := &keygen{service: service.New(map[string]*service.Network{"testnet": {Pool: pool, Config: net}})}
+
+	go pool.Get(context.Background())
+	<-charger.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = kg.stop(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "testnet")
+
+	close(charger.release)
+	require.NoError(t, kg.stop(context.Background()))
+	require.NoError(t, db.Close())
+}
@@ -0,0 +1,64 @@
+package server_test
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type eventsService struct {
+	server.Service
+	bus *events.Bus
+}
+
+func (s *eventsService) Events(ctx context.Context, network string) (<-chan *events.Event, func(), error) {
+	if network != "test" {
+		return nil, nil, server.ErrUnknownNetwork
+	}
+	ch, unsubscribe := s.bus.Subscribe(events.DefaultBuffer)
+	return ch, unsubscribe, nil
+}
+
+func TestEvents(t *testing.T) {
+	bus := events.NewBus()
+	srv := server.Server{Service: &eventsService{bus: bus}}
+	ts := httptest.NewServer(srv.Router())
+	defer ts.Close()
+
+	res, err := http.Get(ts.URL + "/unknown/events")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(ts.URL + "/test/events")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, "text/event-stream", res.Header.Get("Content-Type"))
+
+	// the headers are flushed once subscribed
+	bus.Publish(&events.Event{Type: events.Funded, ID: 1, PKH: "tz1", OpHash: "oo"})
+	rd := bufio.NewReader(res.Body)
+	line, err := rd.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "event: funded\n", line)
+	line, err = rd.ReadString('\n')
+	require.NoError(t, err)
+	assert.Contains(t, line, `"id":1,"pkh":"tz1","op_hash":"oo"`)
+
+	// ended on shutdown
+	srv.CloseStreams()
+	_, err = io.ReadAll(rd)
+	require.NoError(t, err)
+	res, err = http.Get(ts.URL + "/test/events")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
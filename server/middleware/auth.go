@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+)
+
+const (
+	ScopePop    = "pop"
+	ScopeLease  = "lease"
+	ScopeSign   = "sign"
+	ScopeStatus = "status"
+	ScopeAdmin  = "admin"
+)
+
+// AnyNetwork grants the scope on every network
+const AnyNetwork = "*"
+
+// Principal is an authenticated client along with its permissions
+type Principal struct {
+	Identity identity.Identity
+	// Scopes maps a scope to the list of networks it is granted for
+	Scopes map[string][]string
+}
+
+func (p *Principal) Allowed(scope, network string) bool {
+	for _, n := range p.Scopes[scope] {
+		if n == AnyNetwork || n == network {
+			return true
+		}
+	}
+	return false
+}
+
+type TokenHash [sha256.Size]byte
+
+func HashToken(token string) TokenHash {
+	return sha256.Sum256([]byte(token))
+}
+
+// Auth is a bearer token and client certificate authentication and authorization middleware
+type Auth struct {
+	// Scope returns the scope required by the request and the network it refers to.
+	// An empty scope means the request is public.
+	Scope func(r *http.Request) (scope, network string)
+
+	mtx          sync.RWMutex
+	tokens       map[TokenHash]*Principal
+	certificates map[string]*Principal
+}
+
+// SetCertificates replaces the set of accepted client certificates keyed by their subjects.
+// The chain must be verified by the TLS layer.
+func (a *Auth) SetCertificates(certificates map[string]*Principal) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.certificates = certificates
+}
+
+func (a *Auth) lookupCert(r *http.Request) *Principal {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	subject := r.TLS.VerifiedChains[0][0].Subject.String()
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return a.certificates[subject]
+}
+
+// SetTokens replaces the set of accepted tokens
+func (a *Auth) SetTokens(tokens map[TokenHash]*Principal) {
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	a.tokens = tokens
+}
+
+func (a *Auth) lookup(token string) *Principal {
+	// only hashes are compared so the lookup time doesn't tell anything about the token
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return a.tokens[HashToken(token)]
+}
+
+func authError(w http.ResponseWriter, status int, msg string) {
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	jsonError(w, status, msg)
+}
+
+// Enabled reports whether any tokens or certificates are configured. Otherwise all requests are let through.
+func (a *Auth) Enabled() bool {
+	a.mtx.RLock()
+	defer a.mtx.RUnlock()
+	return len(a.tokens) != 0 || len(a.certificates) != 0
+}
+
+// Handler wraps provided http.Handler with middleware
+func (a *Auth) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope, network := a.Scope(r)
+		if scope == "" || !a.Enabled() {
+			h.ServeHTTP(w, r)
+			return
+		}
+		p := a.lookupCert(r)
+		if p == nil {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || token == "" {
+				authError(w, http.StatusUnauthorized, "missing bearer token or client certificate")
+				return
+			}
+			if p = a.lookup(token); p == nil {
+				authError(w, http.StatusUnauthorized, "invalid token")
+				return
+			}
+		}
+		ctx := identity.NewContext(r.Context(), &p.Identity)
+		if !p.Allowed(scope, network) {
+			authError(w, http.StatusForbidden, "scope "+scope+" is not granted for network "+network)
+			return
+		}
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
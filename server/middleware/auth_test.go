@@ -0,0 +1,101 @@
+package middleware_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuth(t *testing.T) {
+	auth := middleware.Auth{
+		Scope: func(r *http.Request) (string, string) {
+			return r.URL.Query().Get("scope"), r.URL.Query().Get("net")
+		},
+	}
+	auth.SetTokens(map[middleware.TokenHash]*middleware.Principal{
+		middleware.HashToken("secret"): {
+			Identity: identity.Identity{Name: "ci", Method: identity.MethodToken},
+			Scopes: map[string][]string{
+				middleware.ScopePop:    {"testnet"},
+				middleware.ScopeStatus: {middleware.AnyNetwork},
+			},
+		},
+	})
+
+	var got *identity.Identity
+	h := auth.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = identity.FromContext(r.Context())
+	}))
+
+	cases := []struct {
+		token  string
+		query  string
+		status int
+	}{
+		{"", "", http.StatusOK},
+		{"", "scope=pop&net=testnet", http.StatusUnauthorized},
+		{"wrong", "scope=pop&net=testnet", http.StatusUnauthorized},
+		{"secret", "scope=pop&net=testnet", http.StatusOK},
+		{"secret", "scope=pop&net=mainnet", http.StatusForbidden},
+		{"secret", "scope=status&net=mainnet", http.StatusOK},
+		{"secret", "scope=admin&net=testnet", http.StatusForbidden},
+	}
+	for _, c := range cases {
+		got = nil
+		req := httptest.NewRequest(http.MethodGet, "/?"+c.query, nil)
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, c.query)
+		if c.status == http.StatusOK && c.token != "" {
+			if assert.NotNil(t, got) {
+				assert.Equal(t, "token:ci", got.String())
+			}
+		}
+	}
+}
+
+func TestAuthCertificate(t *testing.T) {
+	auth := middleware.Auth{
+		Scope: func(r *http.Request) (string, string) { return middleware.ScopeLease, "testnet" },
+	}
+	auth.SetCertificates(map[string]*middleware.Principal{
+		"CN=ci": {
+			Identity: identity.Identity{Name: "ci", Method: identity.MethodCert},
+			Scopes:   map[string][]string{middleware.ScopeLease: {"testnet"}},
+		},
+	})
+
+	var got *identity.Identity
+	h := auth.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = identity.FromContext(r.Context())
+	}))
+
+	for _, c := range []struct {
+		cn     string
+		status int
+	}{
+		{"ci", http.StatusOK},
+		{"other", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/", nil)
+		req.TLS = &tls.ConnectionState{
+			VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: c.cn}}}},
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code)
+	}
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "cert:ci", got.String())
+	}
+}
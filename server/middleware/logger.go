@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+	"github.com/ecadlabs/go-tezos-keygen/requestid"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -13,6 +15,11 @@ func (rw *responseWriter) Status() int {
 	return rw.status
 }
 
+// Unwrap gives http.ResponseController access to the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) WriteHeader(s int) {
 	rw.status = s
 	rw.ResponseWriter.WriteHeader(s)
@@ -78,7 +85,14 @@ func (l *Logging) Handler(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		timestamp := time.Now()
 
+		reqID := r.Header.Get(requestid.Header)
+		if reqID == "" || len(reqID) > 128 {
+			reqID = requestid.New()
+		}
+		w.Header().Set(requestid.Header, reqID)
+
 		rw := newResponseStatusWriter(w)
+		r = r.WithContext(requestid.NewContext(identity.WithSlot(r.Context()), reqID))
 		h.ServeHTTP(rw, r)
 
 		fields := log.Fields{
@@ -88,6 +102,10 @@ func (l *Logging) Handler(h http.Handler) http.Handler {
 			"hostname":   r.Host,
 			"method":     r.Method,
 			"path":       r.URL.Path,
+			"request_id": reqID,
+		}
+		if id := identity.FromContext(r.Context()); id != nil {
+			fields["identity"] = id.String()
 		}
 
 		l.log().WithFields(fields).Println(r.Method + " " + r.URL.Path)
@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit limits the number of requests per minute per client and scope. Clients are
+// identified by the identity attached by Auth or by their IP address otherwise, in which
+// case the address becomes the request identity.
+type RateLimit struct {
+	// Scope returns the scope required by the request and the network it refers to.
+	Scope func(r *http.Request) (scope, network string)
+
+	mtx       sync.Mutex
+	limits    map[string]int
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// SetLimits replaces the per minute limits keyed by scope. Scopes not present are unlimited.
+func (l *RateLimit) SetLimits(limits map[string]int) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	l.limits = limits
+}
+
+// allow implements a token bucket refilled at limit per minute, holding at most limit tokens
+func (l *RateLimit) allow(key, scope string, now time.Time) (ok bool, retry time.Duration) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	limit := l.limits[scope]
+	if limit <= 0 {
+		return true, 0
+	}
+	if l.buckets == nil {
+		l.buckets = make(map[string]*tokenBucket)
+	}
+	rate := float64(limit) / float64(time.Minute)
+	if now.Sub(l.lastSweep) > time.Minute {
+		// forget idle clients, their buckets are full anyway
+		for k, b := range l.buckets {
+			if now.Sub(b.last) > time.Minute {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	k := key + "/" + scope
+	b, found := l.buckets[k]
+	if !found {
+		b = &tokenBucket{tokens: float64(limit), last: now}
+		l.buckets[k] = b
+	}
+	b.tokens += float64(now.Sub(b.last)) * rate
+	if b.tokens > float64(limit) {
+		b.tokens = float64(limit)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / rate)
+	}
+	b.tokens--
+	return true, 0
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// Handler wraps provided http.Handler with middleware
+func (l *RateLimit) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := identity.FromContext(r.Context())
+		if id == nil {
+			id = &identity.Identity{Name: remoteIP(r), Method: identity.MethodIP}
+			r = r.WithContext(identity.NewContext(r.Context(), id))
+		}
+		scope, _ := l.Scope(r)
+		if ok, retry := l.allow(id.String(), scope, time.Now()); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)+1))
+			jsonError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,41 @@
+package middleware_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/identity"
+	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimit(t *testing.T) {
+	limit := middleware.RateLimit{
+		Scope: func(r *http.Request) (string, string) { return r.URL.Query().Get("scope"), "testnet" },
+	}
+	limit.SetLimits(map[string]int{middleware.ScopePop: 2})
+
+	var got *identity.Identity
+	h := limit.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = identity.FromContext(r.Context())
+	}))
+
+	do := func(addr, scope string) int {
+		req := httptest.NewRequest(http.MethodPost, "/?scope="+scope, nil)
+		req.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do("10.0.0.1:1000", "pop"))
+	if assert.NotNil(t, got) {
+		assert.Equal(t, "ip:10.0.0.1", got.String())
+	}
+	assert.Equal(t, http.StatusOK, do("10.0.0.1:1001", "pop"))
+	assert.Equal(t, http.StatusTooManyRequests, do("10.0.0.1:1002", "pop"))
+	// other scopes and clients are not affected
+	assert.Equal(t, http.StatusOK, do("10.0.0.1:1003", "sign"))
+	assert.Equal(t, http.StatusOK, do("10.0.0.2:1000", "pop"))
+}
@@ -0,0 +1,13 @@
+package middleware
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// jsonError replies in the same format as the server itself
+func jsonError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg})
+}
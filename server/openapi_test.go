@@ -0,0 +1,58 @@
+package server_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var varPattern = regexp.MustCompile(`\{([^:}]+)(:[^}]+)?\}`)
+
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	require.NoError(t, json.Unmarshal(server.OpenAPISpec(), &spec))
+
+	srv := server.Server{}
+	var n int
+	err := srv.Router().Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return err
+		}
+		path := varPattern.ReplaceAllString(tpl, "{$1}")
+		item, ok := spec.Paths[path]
+		if !assert.True(t, ok, "path %s is missing from the spec", path) {
+			return nil
+		}
+		for _, m := range methods {
+			_, ok := item[strings.ToLower(m)]
+			assert.True(t, ok, "%s %s is missing from the spec", m, path)
+			n++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.NotZero(t, n)
+}
+
+func TestOpenAPISpecServed(t *testing.T) {
+	srv := server.Server{}
+	rec := httptest.NewRecorder()
+	srv.Router().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, string(server.OpenAPISpec()), rec.Body.String())
+}
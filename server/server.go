@@ -2,21 +2,48 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"math/big"
 	"net/http"
 	"strconv"
+	"sync"
+	"time"
 
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/server/middleware"
 	tz "github.com/ecadlabs/gotez/v2"
 	"github.com/gorilla/mux"
 )
 
-var ErrUnknownNetwork = errors.New("unknown network")
+var (
+	ErrUnknownNetwork = errors.New("unknown network")
+	ErrUnknownLease   = errors.New("unknown lease")
+	ErrQuotaExceeded  = errors.New("daily quota exceeded")
+	ErrUnhealthy      = errors.New("network is unhealthy")
+	ErrNotQuarantined = errors.New("key is not quarantined")
+)
 
 type NetworkStatus struct {
 	Balance *big.Int `json:"balance"`
 	Count   int      `json:"count"`
+	ChainID string   `json:"chain_id,omitempty"`
+	Healthy bool     `json:"healthy"`
+	// Error holds the reason the network is unhealthy
+	Error     string            `json:"error,omitempty"`
+	Endpoints []*EndpointStatus `json:"endpoints,omitempty"`
+}
+
+type EndpointStatus struct {
+	URL       string `json:"url"`
+	Priority  int    `json:"priority"`
+	Healthy   bool   `json:"healthy"`
+	Level     int64  `json:"level"`
+	Lag       int64  `json:"lag"`
+	Errors    int    `json:"errors"`
+	LastError string `json:"last_error,omitempty"`
 }
 
 type Lease struct {
@@ -24,22 +51,114 @@ type Lease struct {
 	PKH tz.PublicKeyHash `json:"pkh"`
 }
 
+type AuditRecord struct {
+	// Seq is the position of the record in the log, pass it as the before parameter to read older records
+	Seq       uint64    `json:"seq"`
+	Time      time.Time `json:"time"`
+	Op        string    `json:"op"`
+	ID        uint64    `json:"id"`
+	PKH       string    `json:"pkh"`
+	Identity  string    `json:"identity,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+// AuditQuery selects the most recent audit records matching it
+type AuditQuery struct {
+	Since time.Time
+	// Before skips the record with this sequence number and newer ones. 0 means none.
+	Before uint64
+	PKH    string
+	Limit  int
+}
+
+// Audit log page size
+const (
+	DefaultAuditLimit = 100
+	MaxAuditLimit     = 1000
+)
+
+// QuarantinedKey is a leased key set aside after its recycling check kept failing
+type QuarantinedKey struct {
+	ID       uint64    `json:"id"`
+	PKH      string    `json:"pkh"`
+	Time     time.Time `json:"time"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// PoolSnapshot is the portable state of a network's pool
+type PoolSnapshot struct {
+	Sequence   uint64                 `json:"sequence"`
+	Queue      []uint64               `json:"queue"`
+	Leases     []*SnapshotLease       `json:"leases"`
+	Quarantine []*SnapshotQuarantined `json:"quarantine,omitempty"`
+	Chain      *SnapshotChain         `json:"chain,omitempty"`
+}
+
+type SnapshotLease struct {
+	ID       uint64    `json:"id"`
+	Deadline time.Time `json:"deadline"`
+	Failures int       `json:"failures,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type SnapshotQuarantined struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Failures int       `json:"failures"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type SnapshotChain struct {
+	ChainID string `json:"chain_id"`
+	Genesis string `json:"genesis"`
+}
+
 type Service interface {
 	Pop(ctx context.Context, network string) (tz.PrivateKey, error)
 	Status(ctx context.Context, network string) (*NetworkStatus, error)
 	Lease(ctx context.Context, network string) (*Lease, error)
+	Release(ctx context.Context, network string, id uint64) error
 	Pub(ctx context.Context, network string, id uint64) (tz.PublicKey, error)
 	Sign(ctx context.Context, network string, id uint64, r io.Reader) (tz.Signature, error)
+	// Audit returns the most recent records matching q, oldest first
+	Audit(ctx context.Context, network string, q *AuditQuery) ([]*AuditRecord, error)
+	Export(ctx context.Context, network string) (*PoolSnapshot, error)
+	Quarantine(ctx context.Context, network string) ([]*QuarantinedKey, error)
+	// ReleaseQuarantined hands the key back to recycling
+	ReleaseQuarantined(ctx context.Context, network string, id uint64) error
+	DiscardQuarantined(ctx context.Context, network string, id uint64) error
+	// Events subscribes to the network's events. The channel is closed if the subscriber falls behind.
+	Events(ctx context.Context, network string) (<-chan *events.Event, func(), error)
 }
 
 type Server struct {
 	Service Service
+
+	streamsOnce  sync.Once
+	streamsDone  chan struct{}
+	closeStreams sync.Once
+}
+
+func (s *Server) streamsClosed() chan struct{} {
+	s.streamsOnce.Do(func() { s.streamsDone = make(chan struct{}) })
+	return s.streamsDone
+}
+
+// CloseStreams ends event streams in progress and refuses new ones. Call it on shutdown
+// as http.Server.Shutdown waits for them otherwise.
+func (s *Server) CloseStreams() {
+	s.closeStreams.Do(func() { close(s.streamsClosed()) })
 }
 
 func serviceError(w http.ResponseWriter, err error) {
 	var status int
-	if errors.Is(err, ErrUnknownNetwork) {
+	if errors.Is(err, ErrUnknownNetwork) || errors.Is(err, ErrUnknownLease) || errors.Is(err, ErrNotQuarantined) {
 		status = http.StatusNotFound
+	} else if errors.Is(err, ErrQuotaExceeded) {
+		status = http.StatusTooManyRequests
+	} else if errors.Is(err, ErrUnhealthy) {
+		status = http.StatusServiceUnavailable
 	} else {
 		status = http.StatusInternalServerError
 	}
@@ -76,6 +195,16 @@ func (s *Server) leaseHandler(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, 200, lease)
 }
 
+func (s *Server) releaseHandler(w http.ResponseWriter, r *http.Request) {
+	net := mux.Vars(r)["net"]
+	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err := s.Service.Release(r.Context(), net, id); err != nil {
+		serviceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
 func (s *Server) pkHandler(w http.ResponseWriter, r *http.Request) {
 	net := mux.Vars(r)["net"]
 	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
@@ -104,12 +233,181 @@ func (s *Server) signHandler(w http.ResponseWriter, r *http.Request) {
 	jsonResponse(w, 200, &response{Signature: sig})
 }
 
+// route name to the scope required to access it
+var routeScopes = map[string]string{
+	"pop":     middleware.ScopePop,
+	"status":  middleware.ScopeStatus,
+	"lease":   middleware.ScopeLease,
+	"release": middleware.ScopeLease,
+	"pub":     middleware.ScopeSign,
+	"sign":    middleware.ScopeSign,
+	"audit":   middleware.ScopeAdmin,
+	"export":  middleware.ScopeAdmin,
+	"events":  middleware.ScopeStatus,
+
+	"quarantine":         middleware.ScopeAdmin,
+	"quarantine-release": middleware.ScopeAdmin,
+	"quarantine-discard": middleware.ScopeAdmin,
+}
+
+// Scope returns the scope required by the request matched by Router and the network it refers to
+func Scope(r *http.Request) (scope, network string) {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "", ""
+	}
+	return routeScopes[route.GetName()], mux.Vars(r)["net"]
+}
+
+func (s *Server) auditHandler(w http.ResponseWriter, r *http.Request) {
+	net := mux.Vars(r)["net"]
+	query := r.URL.Query()
+	q := AuditQuery{
+		PKH:   query.Get("pkh"),
+		Limit: DefaultAuditLimit,
+	}
+	if v := query.Get("since"); v != "" {
+		var err error
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			jsonError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("before"); v != "" {
+		var err error
+		if q.Before, err = strconv.ParseUint(v, 10, 64); err != nil {
+			jsonError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		var err error
+		if q.Limit, err = strconv.Atoi(v); err != nil {
+			jsonError(w, err, http.StatusBadRequest)
+			return
+		}
+		if q.Limit <= 0 || q.Limit > MaxAuditLimit {
+			jsonError(w, fmt.Errorf("limit must be between 1 and %d", MaxAuditLimit), http.StatusBadRequest)
+			return
+		}
+	}
+	records, err := s.Service.Audit(r.Context(), net, &q)
+	if err != nil {
+		serviceError(w, err)
+		return
+	}
+	jsonResponse(w, 200, records)
+}
+
+func (s *Server) exportHandler(w http.ResponseWriter, r *http.Request) {
+	snapshot, err := s.Service.Export(r.Context(), mux.Vars(r)["net"])
+	if err != nil {
+		serviceError(w, err)
+		return
+	}
+	jsonResponse(w, 200, snapshot)
+}
+
+func (s *Server) quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := s.Service.Quarantine(r.Context(), mux.Vars(r)["net"])
+	if err != nil {
+		serviceError(w, err)
+		return
+	}
+	jsonResponse(w, 200, keys)
+}
+
+func (s *Server) quarantineReleaseHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err := s.Service.ReleaseQuarantined(r.Context(), mux.Vars(r)["net"], id); err != nil {
+		serviceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) quarantineDiscardHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	if err := s.Service.DiscardQuarantined(r.Context(), mux.Vars(r)["net"], id); err != nil {
+		serviceError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// eventsKeepAlive keeps proxies from closing an idle stream
+const eventsKeepAlive = 15 * time.Second
+
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	closed := s.streamsClosed()
+	select {
+	case <-closed:
+		jsonError(w, errors.New("server is shutting down"), http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	ch, unsubscribe, err := s.Service.Events(r.Context(), mux.Vars(r)["net"])
+	if err != nil {
+		serviceError(w, err)
+		return
+	}
+	defer unsubscribe()
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case e, ok := <-ch:
+			if !ok {
+				// fell behind, the client is expected to reconnect
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(w, ": keep-alive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-closed:
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
 func (s *Server) Router() *mux.Router {
 	r := mux.NewRouter()
-	r.Methods("POST").Path("/{net}").HandlerFunc(s.popHandler)
-	r.Methods("GET").Path("/{net}").HandlerFunc(s.countHandler)
-	r.Methods("POST").Path("/{net}/ephemeral").HandlerFunc(s.leaseHandler)
-	r.Methods("GET").Path("/{net}/ephemeral/{id:[0-9]+}/keys/{key}").HandlerFunc(s.pkHandler)
-	r.Methods("POST").Path("/{net}/ephemeral/{id:[0-9]+}/keys/{key}").HandlerFunc(s.signHandler)
+	// must go before /{net}
+	r.Methods("GET").Path("/openapi.json").HandlerFunc(openAPIHandler)
+	r.Methods("POST").Path("/{net}").HandlerFunc(s.popHandler).Name("pop")
+	r.Methods("GET").Path("/{net}").HandlerFunc(s.countHandler).Name("status")
+	r.Methods("POST").Path("/{net}/ephemeral").HandlerFunc(s.leaseHandler).Name("lease")
+	r.Methods("DELETE").Path("/{net}/ephemeral/{id:[0-9]+}").HandlerFunc(s.releaseHandler).Name("release")
+	r.Methods("GET").Path("/{net}/ephemeral/{id:[0-9]+}/keys/{key}").HandlerFunc(s.pkHandler).Name("pub")
+	r.Methods("POST").Path("/{net}/ephemeral/{id:[0-9]+}/keys/{key}").HandlerFunc(s.signHandler).Name("sign")
+	r.Methods("GET").Path("/{net}/audit").HandlerFunc(s.auditHandler).Name("audit")
+	r.Methods("GET").Path("/{net}/export").HandlerFunc(s.exportHandler).Name("export")
+	r.Methods("GET").Path("/{net}/events").HandlerFunc(s.eventsHandler).Name("events")
+	r.Methods("GET").Path("/{net}/quarantine").HandlerFunc(s.quarantineHandler).Name("quarantine")
+	r.Methods("POST").Path("/{net}/quarantine/{id:[0-9]+}/release").HandlerFunc(s.quarantineReleaseHandler).Name("quarantine-release")
+	r.Methods("DELETE").Path("/{net}/quarantine/{id:[0-9]+}").HandlerFunc(s.quarantineDiscardHandler).Name("quarantine-discard")
 	return r
 }
@@ -4,10 +4,15 @@ import (
 	"context"
 	"errors"
 	"io"
+	"math/big"
+	"sync"
 	"time"
 
 	"github.com/davecgh/go-spew/spew"
+	"github.com/ecadlabs/go-tezos-keygen/balancer"
 	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/identity"
 	"github.com/ecadlabs/go-tezos-keygen/keypool"
 	"github.com/ecadlabs/go-tezos-keygen/server"
 	tz "github.com/ecadlabs/gotez/v2"
@@ -19,16 +24,92 @@ import (
 type NetworkConfig interface {
 	GetSeed() charger.Seed
 	GetLeaseTime() time.Duration
+	GetAmount() *big.Int
+	GetQuota() *keypool.Quota
+	GetTimeout() time.Duration
+	GetChainCheck() time.Duration
+	GetKeepSequence() bool
 }
 
 type Network struct {
 	Pool    *keypool.Pool
 	Charger *charger.Charger
+	RPC     *balancer.Balancer
+	Events  *events.Bus
 	Config  NetworkConfig
 }
 
+// CheckChain verifies or discovers the node's chain and resets the pool if the chain has changed
+func (n *Network) CheckChain(ctx context.Context) error {
+	info, err := n.Charger.CheckChain(ctx)
+	if err != nil {
+		return err
+	}
+	return n.BindChain(info)
+}
+
+// BindChain binds the pool to the chain returned by Charger.CheckChain and resets it if the chain
+// has changed
+func (n *Network) BindChain(info *charger.ChainInfo) error {
+	_, err := n.Pool.SetChain(&keypool.ChainInfo{
+		ChainID: info.ChainID.String(),
+		Genesis: info.Genesis.String(),
+	}, n.Config.GetKeepSequence())
+	return err
+}
+
 type Service struct {
-	Networks map[string]*Network
+	mtx      sync.RWMutex
+	networks map[string]*Network
+}
+
+func New(networks map[string]*Network) *Service {
+	return &Service{networks: networks}
+}
+
+func (s *Service) network(name string) (*Network, bool) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	net, ok := s.networks[name]
+	return net, ok
+}
+
+// Networks returns a copy of the network set
+func (s *Service) Networks() map[string]*Network {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	out := make(map[string]*Network, len(s.networks))
+	for name, net := range s.networks {
+		out[name] = net
+	}
+	return out
+}
+
+// SetNetworks replaces the network set. Requests in progress complete with the networks they started with.
+func (s *Service) SetNetworks(networks map[string]*Network) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.networks = networks
+}
+
+// WatchChain checks the network's chain periodically until ctx is cancelled or the network is removed
+func (s *Service) WatchChain(ctx context.Context, network string) {
+	for {
+		net, ok := s.network(network)
+		if !ok {
+			return
+		}
+		select {
+		case <-time.After(net.Config.GetChainCheck()):
+			cctx, cancel := context.WithTimeout(ctx, net.Config.GetTimeout())
+			if err := net.CheckChain(cctx); err != nil {
+				log.WithField("network", network).Error(err)
+			}
+			cancel()
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
 func logError(err error) {
@@ -46,13 +127,63 @@ func logError(err error) {
 	}
 }
 
+// logEntry attributes the operation to the client identity if any
+func logEntry(ctx context.Context, network string) *log.Entry {
+	l := log.WithField("network", network)
+	if id := identity.FromContext(ctx); id != nil {
+		l = l.WithField("identity", id.String())
+	}
+	return l
+}
+
+func clientName(ctx context.Context) string {
+	if id := identity.FromContext(ctx); id != nil {
+		return id.String()
+	}
+	return ""
+}
+
+// checkHealth refuses to hand out keys while the node is on an unexpected chain
+func checkHealth(network string, net *Network) error {
+	if err := net.Charger.Health(); err != nil {
+		log.WithField("network", network).Error(err)
+		return server.ErrUnhealthy
+	}
+	return nil
+}
+
+// takeQuota accounts a key to the client. The returned function gives it back if the key wasn't delivered.
+func takeQuota(ctx context.Context, net *Network) (undo func(), err error) {
+	client := clientName(ctx)
+	amount := net.Config.GetAmount()
+	if err := net.Pool.TakeQuota(client, net.Config.GetQuota(), amount); err != nil {
+		if errors.Is(err, keypool.ErrQuotaExceeded) {
+			return nil, server.ErrQuotaExceeded
+		}
+		return nil, err
+	}
+	return func() {
+		if err := net.Pool.ReturnQuota(client, amount); err != nil {
+			log.Error(err)
+		}
+	}, nil
+}
+
 func (s *Service) Pop(ctx context.Context, network string) (tz.PrivateKey, error) {
-	net, ok := s.Networks[network]
+	net, ok := s.network(network)
 	if !ok {
 		return nil, server.ErrUnknownNetwork
 	}
+	if err := checkHealth(network, net); err != nil {
+		return nil, err
+	}
+	undo, err := takeQuota(ctx, net)
+	if err != nil {
+		return nil, err
+	}
 	index, err := net.Pool.Get(ctx)
 	if err != nil {
+		undo()
 		logError(err)
 		return nil, err
 	}
@@ -60,36 +191,65 @@ func (s *Service) Pop(ctx context.Context, network string) (tz.PrivateKey, error
 	if err != nil {
 		return nil, err
 	}
+	logEntry(ctx, network).WithField("pkh", priv.Public().Hash()).Info("Popped")
 	return priv.ToProtocol(), nil
 }
 
 func (s *Service) Status(ctx context.Context, network string) (*server.NetworkStatus, error) {
-	net, ok := s.Networks[network]
+	net, ok := s.network(network)
 	if !ok {
 		return nil, server.ErrUnknownNetwork
 	}
-	balance, err := net.Charger.GetFunds(ctx)
-	if err != nil {
-		logError(err)
-		return nil, err
-	}
 	cnt, err := net.Pool.Count()
 	if err != nil {
 		return nil, err
 	}
-	return &server.NetworkStatus{
+	status := server.NetworkStatus{
 		Count:   cnt,
-		Balance: balance,
-	}, nil
+		Healthy: true,
+	}
+	// report the endpoints even if none of them is reachable
+	if status.Balance, err = net.Charger.GetFunds(ctx); err != nil {
+		logError(err)
+		status.Healthy = false
+		status.Error = err.Error()
+	}
+	if id := net.Charger.ChainID(); id != nil {
+		status.ChainID = id.String()
+	}
+	if err := net.Charger.Health(); err != nil {
+		status.Healthy = false
+		status.Error = err.Error()
+	}
+	for _, e := range net.RPC.Status() {
+		status.Endpoints = append(status.Endpoints, &server.EndpointStatus{
+			URL:       e.URL,
+			Priority:  e.Priority,
+			Healthy:   e.Healthy,
+			Level:     e.Level,
+			Lag:       e.Lag,
+			Errors:    e.Errors,
+			LastError: e.LastError,
+		})
+	}
+	return &status, nil
 }
 
 func (s *Service) Lease(ctx context.Context, network string) (*server.Lease, error) {
-	net, ok := s.Networks[network]
+	net, ok := s.network(network)
 	if !ok {
 		return nil, server.ErrUnknownNetwork
 	}
+	if err := checkHealth(network, net); err != nil {
+		return nil, err
+	}
+	undo, err := takeQuota(ctx, net)
+	if err != nil {
+		return nil, err
+	}
 	index, err := net.Pool.Lease(ctx, time.Now().Add(net.Config.GetLeaseTime()))
 	if err != nil {
+		undo()
 		logError(err)
 		return nil, err
 	}
@@ -97,14 +257,31 @@ func (s *Service) Lease(ctx context.Context, network string) (*server.Lease, err
 	if err != nil {
 		return nil, err
 	}
+	logEntry(ctx, network).WithFields(log.Fields{"id": index, "pkh": priv.Public().Hash()}).Info("Leased")
 	return &server.Lease{
 		ID:  index,
 		PKH: priv.Public().Hash(),
 	}, nil
 }
 
+func (s *Service) Release(ctx context.Context, network string, id uint64) error {
+	net, ok := s.network(network)
+	if !ok {
+		return server.ErrUnknownNetwork
+	}
+	if err := net.Pool.Release(ctx, id); err != nil {
+		if errors.Is(err, keypool.ErrNotLeased) {
+			return server.ErrUnknownLease
+		}
+		logError(err)
+		return err
+	}
+	logEntry(ctx, network).WithField("id", id).Info("Released")
+	return nil
+}
+
 func (s *Service) Pub(ctx context.Context, network string, id uint64) (tz.PublicKey, error) {
-	net, ok := s.Networks[network]
+	net, ok := s.network(network)
 	if !ok {
 		return nil, server.ErrUnknownNetwork
 	}
@@ -116,7 +293,7 @@ func (s *Service) Pub(ctx context.Context, network string, id uint64) (tz.Public
 }
 
 func (s *Service) Sign(ctx context.Context, network string, id uint64, r io.Reader) (tz.Signature, error) {
-	net, ok := s.Networks[network]
+	net, ok := s.network(network)
 	if !ok {
 		return nil, server.ErrUnknownNetwork
 	}
@@ -128,9 +305,143 @@ func (s *Service) Sign(ctx context.Context, network string, id uint64, r io.Read
 	if err != nil {
 		return nil, err
 	}
+	if err := net.Pool.Sign(ctx, id); err != nil {
+		if errors.Is(err, keypool.ErrNotLeased) {
+			return nil, server.ErrUnknownLease
+		}
+		logError(err)
+		return nil, err
+	}
+	logEntry(ctx, network).WithField("id", id).Debug("Signing")
 	sig, err := priv.Sign(data)
 	if err != nil {
 		return nil, err
 	}
 	return sig.ToProtocol(), nil
 }
+
+func (s *Service) Audit(ctx context.Context, network string, q *server.AuditQuery) ([]*server.AuditRecord, error) {
+	net, ok := s.network(network)
+	if !ok {
+		return nil, server.ErrUnknownNetwork
+	}
+	records, err := net.Pool.AuditLog(&keypool.AuditQuery{
+		Since:  q.Since,
+		Before: q.Before,
+		PKH:    q.PKH,
+		Limit:  q.Limit,
+	})
+	if err != nil {
+		logError(err)
+		return nil, err
+	}
+	out := make([]*server.AuditRecord, len(records))
+	for i, r := range records {
+		out[i] = &server.AuditRecord{
+			Seq:       r.ID,
+			Time:      r.Time,
+			Op:        r.Op,
+			ID:        r.KeyIndex,
+			PKH:       r.PKH,
+			Identity:  r.Identity,
+			RequestID: r.RequestID,
+		}
+	}
+	return out, nil
+}
+
+func (s *Service) Export(ctx context.Context, network string) (*server.PoolSnapshot, error) {
+	net, ok := s.network(network)
+	if !ok {
+		return nil, server.ErrUnknownNetwork
+	}
+	snapshot, err := net.Pool.Export()
+	if err != nil {
+		logError(err)
+		return nil, err
+	}
+	out := server.PoolSnapshot{
+		Sequence: snapshot.Sequence,
+		Queue:    snapshot.Queue,
+		Leases:   make([]*server.SnapshotLease, len(snapshot.Leases)),
+	}
+	for i, l := range snapshot.Leases {
+		out.Leases[i] = &server.SnapshotLease{ID: l.KeyIndex, Deadline: l.Deadline, Failures: l.Failures, Error: l.Error}
+	}
+	for _, q := range snapshot.Quarantine {
+		out.Quarantine = append(out.Quarantine, &server.SnapshotQuarantined{ID: q.KeyIndex, Time: q.Time, Failures: q.Failures, Error: q.Error})
+	}
+	if c := snapshot.Chain; c != nil {
+		out.Chain = &server.SnapshotChain{ChainID: c.ChainID, Genesis: c.Genesis}
+	}
+	logEntry(ctx, network).Info("Exported")
+	return &out, nil
+}
+
+func (s *Service) Quarantine(ctx context.Context, network string) ([]*server.QuarantinedKey, error) {
+	net, ok := s.network(network)
+	if !ok {
+		return nil, server.ErrUnknownNetwork
+	}
+	keys, err := net.Pool.Quarantined()
+	if err != nil {
+		logError(err)
+		return nil, err
+	}
+	out := make([]*server.QuarantinedKey, len(keys))
+	for i, q := range keys {
+		priv, err := net.Config.GetSeed().Derive(q.KeyIndex)
+		if err != nil {
+			return nil, err
+		}
+		out[i] = &server.QuarantinedKey{
+			ID:       q.KeyIndex,
+			PKH:      priv.Public().Hash().String(),
+			Time:     q.Time,
+			Failures: q.Failures,
+			Error:    q.Error,
+		}
+	}
+	return out, nil
+}
+
+func (s *Service) ReleaseQuarantined(ctx context.Context, network string, id uint64) error {
+	net, ok := s.network(network)
+	if !ok {
+		return server.ErrUnknownNetwork
+	}
+	if err := net.Pool.ReleaseQuarantined(ctx, id); err != nil {
+		return quarantineError(err)
+	}
+	logEntry(ctx, network).WithField("id", id).Info("Released from quarantine")
+	return nil
+}
+
+func (s *Service) DiscardQuarantined(ctx context.Context, network string, id uint64) error {
+	net, ok := s.network(network)
+	if !ok {
+		return server.ErrUnknownNetwork
+	}
+	if err := net.Pool.DiscardQuarantined(ctx, id); err != nil {
+		return quarantineError(err)
+	}
+	logEntry(ctx, network).WithField("id", id).Info("Discarded from quarantine")
+	return nil
+}
+
+func quarantineError(err error) error {
+	if errors.Is(err, keypool.ErrNotQuarantined) {
+		return server.ErrNotQuarantined
+	}
+	logError(err)
+	return err
+}
+
+func (s *Service) Events(ctx context.Context, network string) (<-chan *events.Event, func(), error) {
+	net, ok := s.network(network)
+	if !ok {
+		return nil, nil, server.ErrUnknownNetwork
+	}
+	ch, unsubscribe := net.Events.Subscribe(events.DefaultBuffer)
+	return ch, unsubscribe, nil
+}
@@ -0,0 +1,191 @@
+package service_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/charger"
+	"github.com/ecadlabs/go-tezos-keygen/config"
+	"github.com/ecadlabs/go-tezos-keygen/events"
+	"github.com/ecadlabs/go-tezos-keygen/keypool"
+	"github.com/ecadlabs/go-tezos-keygen/server"
+	"github.com/ecadlabs/go-tezos-keygen/service"
+	tz "github.com/ecadlabs/gotez/v2"
+	"github.com/ecadlabs/gotez/v2/client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type chain struct {
+	chainID *tz.ChainID
+	genesis *tz.BlockHash
+}
+
+// nodeMock serves the chain ID and the genesis hash
+func nodeMock(t *testing.T, c *atomic.Pointer[chain]) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var v any
+		switch r.URL.Path {
+		case "/chains/main/chain_id":
+			v = c.Load().chainID.String()
+		case "/chains/main/blocks/genesis/hash":
+			v = c.Load().genesis.String()
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+var (
+	testChain  = &chain{chainID: &tz.ChainID{1, 2, 3, 4}, genesis: &tz.BlockHash{1}}
+	otherChain = &chain{chainID: &tz.ChainID{5, 6, 7, 8}, genesis: &tz.BlockHash{2}}
+)
+
+// newTestNetwork runs a network named test against the node. extra is appended to its settings.
+func newTestNetwork(t *testing.T, store keypool.Store, node *httptest.Server, extra string) *service.Network {
+	cfg, err := config.New(strings.NewReader(fmt.Sprintf(`
+test:
+  url: %s
+  seed: f7353829d316c20922f8ff2ed696090801d9c775977df6423cd68a737c628b844b13c951de7cb7cd01cd62430edeefbc219885b388f06cb5d1e496f63bc9c0d5
+  private-key: edsk2mgqWz5tUQQPK2LCg4Ae2G9bdd8RGzJP9oR3S7cKgASndbnRjE
+  amount: 1000
+`, node.URL) + extra))
+	require.NoError(t, err)
+	net := cfg.Networks["test"]
+	bus := events.NewBus()
+	ch := charger.New(net, &client.Client{URL: node.URL, Client: node.Client()}, bus)
+	pool, err := keypool.New(store, net, ch, bus)
+	require.NoError(t, err)
+	t.Cleanup(func() { pool.Stop(context.Background()) })
+	return &service.Network{Pool: pool, Charger: ch, Events: bus, Config: net}
+}
+
+func TestChainMismatch(t *testing.T) {
+	var c atomic.Pointer[chain]
+	c.Store(otherChain)
+	node := nodeMock(t, &c)
+	net := newTestNetwork(t, keypool.NewMemStore(), node, "  chain-id: "+testChain.chainID.String()+"\n")
+
+	require.ErrorIs(t, net.CheckChain(context.Background()), charger.ErrChainMismatch)
+	require.ErrorIs(t, net.Charger.Health(), charger.ErrChainMismatch)
+	info, err := net.Pool.Chain()
+	require.NoError(t, err)
+	assert.Nil(t, info)
+
+	srv := server.Server{Service: service.New(map[string]*service.Network{"test": net})}
+	h := srv.Router()
+	for _, path := range []string{"/test", "/test/ephemeral"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path, nil))
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code, path)
+	}
+
+	// the node is back on the expected chain
+	c.Store(testChain)
+	require.NoError(t, net.CheckChain(context.Background()))
+	assert.NoError(t, net.Charger.Health())
+}
+
+func TestWatchChainReset(t *testing.T) {
+	var c atomic.Pointer[chain]
+	c.Store(testChain)
+	node := nodeMock(t, &c)
+	store := keypool.NewMemStore()
+	net := newTestNetwork(t, store, node, "  chain-check-interval: 10ms\n")
+	require.NoError(t, net.CheckChain(context.Background()))
+
+	err := store.Update(net.Config.(*config.NetworkConfig).GetBucket(), func(tx keypool.Tx) error {
+		for i := uint64(1); i <= 3; i++ {
+			if err := tx.Push(i); err != nil {
+				return err
+			}
+		}
+		if err := tx.PutLease(&keypool.Lease{KeyIndex: 4, Deadline: time.Now().Add(time.Hour)}); err != nil {
+			return err
+		}
+		return tx.SetSequence(4)
+	})
+	require.NoError(t, err)
+
+	svc := service.New(map[string]*service.Network{"test": net})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.WatchChain(ctx, "test")
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	c.Store(otherChain)
+	require.Eventually(t, func() bool {
+		info, err := net.Pool.Chain()
+		return err == nil && info.ChainID == otherChain.chainID.String()
+	}, 5*time.Second, 10*time.Millisecond)
+
+	snapshot, err := net.Pool.Export()
+	require.NoError(t, err)
+	assert.Equal(t, otherChain.genesis.String(), snapshot.Chain.Genesis)
+	assert.Empty(t, snapshot.Queue)
+	assert.Empty(t, snapshot.Leases)
+	assert.Zero(t, snapshot.Sequence)
+	assert.Equal(t, otherChain.chainID, net.Charger.ChainID())
+}
+
+func TestSign(t *testing.T) {
+	var c atomic.Pointer[chain]
+	c.Store(testChain)
+	node := nodeMock(t, &c)
+	store := keypool.NewMemStore()
+	net := newTestNetwork(t, store, node, "")
+
+	now := time.Now()
+	err := store.Update(net.Config.(*config.NetworkConfig).GetBucket(), func(tx keypool.Tx) error {
+		for _, l := range []*keypool.Lease{
+			{KeyIndex: 4, Deadline: now.Add(time.Hour)},
+			// released or run out
+			{KeyIndex: 5, Deadline: now},
+			// being recycled
+			{KeyIndex: 6, Deadline: now.Add(time.Hour), Failures: 1},
+		} {
+			if err := tx.PutLease(l); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+
+	svc := service.New(map[string]*service.Network{"test": net})
+	ctx := context.Background()
+	sig, err := svc.Sign(ctx, "test", 4, strings.NewReader("message"))
+	require.NoError(t, err)
+	assert.NotNil(t, sig)
+	for _, id := range []uint64{5, 6, 7} {
+		_, err := svc.Sign(ctx, "test", id, strings.NewReader("message"))
+		assert.ErrorIs(t, err, server.ErrUnknownLease, id)
+	}
+
+	log, err := net.Pool.AuditLog(&keypool.AuditQuery{})
+	require.NoError(t, err)
+	var signed []uint64
+	for _, r := range log {
+		if r.Op == keypool.AuditSign {
+			signed = append(signed, r.KeyIndex)
+		}
+	}
+	assert.Equal(t, []uint64{4}, signed)
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const certCheckInterval = time.Second
+
+// CertReloader serves a certificate key pair from files and picks up rotated files without a restart
+type CertReloader struct {
+	certFile string
+	keyFile  string
+
+	mtx     sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	c := &CertReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.load(modTime); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *CertReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *CertReloader) load(modTime time.Time) error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return nil
+}
+
+// GetCertificate is suitable for tls.Config.GetCertificate. If the files are being
+// replaced at the moment, the previous certificate is served until both are consistent again.
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(c.checked) < certCheckInterval {
+		return c.cert, nil
+	}
+	c.checked = now
+	modTime, err := c.filesModTime()
+	if err != nil {
+		log.Warn(err)
+		return c.cert, nil
+	}
+	if modTime.After(c.modTime) {
+		if err := c.load(modTime); err != nil {
+			log.Warnf("keeping the previous certificate: %v", err)
+		} else {
+			log.WithField("file", c.certFile).Info("Certificate reloaded")
+		}
+	}
+	return c.cert, nil
+}
+
+// LoadCertPool reads PEM encoded certificates from a file
+func LoadCertPool(name string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("no certificates found in " + name)
+	}
+	return pool, nil
+}
@@ -0,0 +1,71 @@
+package utils_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ecadlabs/go-tezos-keygen/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeCert(t *testing.T, dir, cn string, modTime time.Time) (certFile, keyFile string) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tpl := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &tpl, &tpl, &priv.PublicKey, priv)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+	require.NoError(t, err)
+
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	require.NoError(t, os.Chtimes(certFile, modTime, modTime))
+	require.NoError(t, os.Chtimes(keyFile, modTime, modTime))
+	return
+}
+
+func commonName(t *testing.T, r *utils.CertReloader) string {
+	cert, err := r.GetCertificate(nil)
+	require.NoError(t, err)
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+	return c.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeCert(t, dir, "first", now.Add(-time.Minute))
+
+	r, err := utils.NewCertReloader(certFile, keyFile)
+	require.NoError(t, err)
+	assert.Equal(t, "first", commonName(t, r))
+
+	writeCert(t, dir, "second", now)
+	time.Sleep(time.Second)
+	assert.Equal(t, "second", commonName(t, r))
+
+	// broken file keeps the previous certificate
+	require.NoError(t, os.WriteFile(keyFile, []byte("garbage"), 0600))
+	later := now.Add(time.Minute)
+	require.NoError(t, os.Chtimes(keyFile, later, later))
+	time.Sleep(time.Second)
+	assert.Equal(t, "second", commonName(t, r))
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// scrypt parameters used for new files
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+const encryptedVersion = 1
+
+var ErrPassphrase = errors.New("wrong passphrase or corrupted data")
+
+// encryptedData is the on disk format of a passphrase encrypted secret. The key is derived with scrypt
+// and the data is sealed with AES-256-GCM.
+type encryptedData struct {
+	Version    int    `json:"version"`
+	KDF        string `json:"kdf"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// IsEncrypted reports whether the data looks like the output of Encrypt
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), []byte("{"))
+}
+
+func newGCM(passphrase []byte, e *encryptedData) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, e.Salt, e.N, e.R, e.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt seals the data with a key derived from the passphrase
+func Encrypt(data, passphrase []byte) ([]byte, error) {
+	e := encryptedData{
+		Version: encryptedVersion,
+		KDF:     "scrypt",
+		N:       scryptN,
+		R:       scryptR,
+		P:       scryptP,
+		Salt:    make([]byte, 32),
+	}
+	if _, err := rand.Read(e.Salt); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(passphrase, &e)
+	if err != nil {
+		return nil, err
+	}
+	e.Nonce = make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(e.Nonce); err != nil {
+		return nil, err
+	}
+	e.Ciphertext = gcm.Seal(nil, e.Nonce, data, nil)
+	return json.MarshalIndent(&e, "", "  ")
+}
+
+// Decrypt opens data produced by Encrypt
+func Decrypt(data, passphrase []byte) ([]byte, error) {
+	var e encryptedData
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, err
+	}
+	if e.Version != encryptedVersion || e.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported format: version %d, kdf %q", e.Version, e.KDF)
+	}
+	gcm, err := newGCM(passphrase, &e)
+	if err != nil {
+		return nil, err
+	}
+	if len(e.Nonce) != gcm.NonceSize() {
+		return nil, ErrPassphrase
+	}
+	out, err := gcm.Open(nil, e.Nonce, e.Ciphertext, nil)
+	if err != nil {
+		return nil, ErrPassphrase
+	}
+	return out, nil
+}
@@ -0,0 +1,25 @@
+package utils_test
+
+import (
+	"testing"
+
+	"github.com/ecadlabs/go-tezos-keygen/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncrypt(t *testing.T) {
+	secret := []byte("f7353829d316c20922f8ff2ed6960908")
+	data, err := utils.Encrypt(secret, []byte("passphrase"))
+	require.NoError(t, err)
+	assert.True(t, utils.IsEncrypted(data))
+	assert.False(t, utils.IsEncrypted(secret))
+	assert.NotContains(t, string(data), string(secret))
+
+	out, err := utils.Decrypt(data, []byte("passphrase"))
+	require.NoError(t, err)
+	assert.Equal(t, secret, out)
+
+	_, err = utils.Decrypt(data, []byte("wrong"))
+	assert.ErrorIs(t, err, utils.ErrPassphrase)
+}